@@ -1,6 +1,10 @@
 package protean
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
 
 // Here is some background reading on arithmetic coding and range coding.
 // http://www.arturocampos.com/ac_arithmetic.html
@@ -106,10 +110,17 @@ const SHIFT_BITS uint32 = CODE_BITS - 9
 // Tne number of bits left over during renormalization.
 const EXTRA_BITS uint32 = (CODE_BITS-2)%8 + 1
 
+// The bits of low that are not written when the encoder is flushed.
+const FLUSH_ROUNDING uint32 = 1<<(SHIFT_BITS-8) - 1
+
 // The lowest possible value.
 // Anything lower than this will be shifted up during renormalization.
 const BOTTOM_VALUE uint32 = TOP_VALUE >> 8
 
+// The most bytes that can be coded as one sequence. The encoding ends with the
+// number of bytes plus 4 in two bytes.
+const MAX_SEQUENCE_LENGTH = 0xFFFF - 4
+
 // The state and initialiation code for arithmetic coding.
 // This class is never instantiated directly.
 // The subclasses Encoder and Decoder are used instead.
@@ -131,41 +142,28 @@ type Coder struct {
 	// The current byte that's being constructed for eventual output.
 	working uint32
 
-	// A coding table derived from the probability distribution.
-	intervals map[uint8]Interval
-
-	// The total of the lengths of all intervals in the coding table.
-	// This determines the maximum amount that the range can change by encoding
-	// one symbol.
-	total uint32
-
-	// The input buffer. This is a list of bytes represented as numbers.
-	input []uint32
+	// The model giving the coding table for each symbol.
+	model *Model
 
-	// The output buffer. This is a list of bytes represented as numbers.
-	output []uint32
+	// The state of the model in the sequence being coded.
+	context modelContext
 }
 
 // The Coder constructor normalizes the symbol probabilities and build the
 // coding table.
 func NewCoder(probs []uint32) Coder {
+	return NewModelCoder(NewModel(probs))
+}
+
+// Make a Coder that takes its coding tables from a Model.
+func NewModelCoder(model *Model) Coder {
 	this := Coder{}
 
-	// Scale the symbol probabilities to fit constraints.
-	this.probabilities = adjustProbs(probs)
+	// The model scales the symbol probabilities to fit constraints.
+	this.probabilities = model.base.frequencies[:]
 	this.low = 0x00000000
 	this.high = 0xFFFFFFFF
-	this.intervals = make(map[uint8]Interval)
-
-	// Build the symbol table.
-	var low uint32
-	for index, prob := range probs {
-		this.intervals[uint8(index)] = makeInterval(uint8(index), low, prob)
-		low = low + prob
-	}
-
-	// Calculate the sum of the lengths of all intervals.
-	this.total = sum(this.probabilities)
+	this.model = model
 
 	return this
 }
@@ -214,6 +212,9 @@ func adjustProbs(probs []uint32) []uint32 {
 type Encoder struct {
 	// extends Coder
 	Coder
+
+	// The output buffer, which encoded bytes are appended to.
+	output []byte
 }
 
 func NewEncoder(probs []uint32) Encoder {
@@ -224,33 +225,63 @@ func NewDecoder(probs []uint32) Decoder {
 	return Decoder{Coder: NewCoder(probs)}
 }
 
+// Make an Encoder using a Model, such as a context model.
+func NewModelEncoder(model *Model) Encoder {
+	return Encoder{Coder: NewModelCoder(model)}
+}
+
+// Make a Decoder using a Model. It must be the same as the Encoder's.
+func NewModelDecoder(model *Model) Decoder {
+	return Decoder{Coder: NewModelCoder(model)}
+}
+
 // Encode a sequence of bytes.
+// Returns nil if the input contains a byte that has a zero frequency where it
+// occurs, which the model could never have produced, or if it is longer than
+// MAX_SEQUENCE_LENGTH.
 func (this *Encoder) Encode(input []byte) []byte {
+	output, err := this.EncodeTo(nil, input)
+	if err != nil {
+		return nil
+	}
+
+	return output
+}
+
+// Encode src, appending the result to dst and returning the extended buffer.
+// Nothing is allocated if dst has room for the result, so a caller can reuse
+// one buffer for every sequence. If src cannot be encoded, dst is returned
+// unchanged with an error wrapping ErrMalformedPacket.
+func (this *Encoder) EncodeTo(dst []byte, src []byte) ([]byte, error) {
+	if len(src) > MAX_SEQUENCE_LENGTH {
+		return dst, fmt.Errorf("%w: %d bytes is more than the %d that can be encoded", ErrMalformedPacket, len(src), MAX_SEQUENCE_LENGTH)
+	}
+
 	// Initialize state.
 	// The Coder superclass initializes state common to Encoder and Decoder.
 	// Encoder and Decoder do some additional initialization that must be
 	// reset when encoding each byte sequence.
+	this.output = dst
 	this.init()
 
 	// Encode all of the symbols in the input []byte
 	// The primary effect is to fill up the output buffer with output bytes.
 	// Internal state variables also change after encoding each symbol.
-	for _, b := range input {
-		this.encodeSymbol(b)
+	for index, b := range src {
+		if !this.encodeSymbol(b) {
+			this.output = nil
+			return dst, fmt.Errorf("%w: byte %#02x at offset %d cannot occur there", ErrMalformedPacket, b, index)
+		}
 	}
 
 	// Flush any remaining state in the internal state variables into
 	// the output buffer.
-	this.flush()
-
-	// Copy the output buffer into an []byte that can be returned.
-	var output = make([]byte, len(this.output))
-	for index, item := range this.output {
-		output[index] = byte(item)
-	}
+	this.flush(len(src))
 
-	// Return the []byte copy of the internal output buffer.
-	return output
+	// Don't keep the caller's buffer.
+	output := this.output
+	this.output = nil
+	return output, nil
 }
 
 // Initialize state.
@@ -262,8 +293,7 @@ func (this *Encoder) init() {
 	this.high = TOP_VALUE
 	this.working = 0xCA
 	this.underflow = 0
-	this.input = []uint32{}
-	this.output = []uint32{}
+	this.context.reset()
 }
 
 // Encode a symbol. The symbol is a byte represented as a number.
@@ -271,10 +301,16 @@ func (this *Encoder) init() {
 // As a consequence, bytes may of may not be written to the output buffer.
 // When all symbols have been encoded, flush() must be called to recover any
 // remaining state.
-func (this *Encoder) encodeSymbol(symbol uint8) {
-	// Look up the corresponding interval for the symbol in the coding table.
-	// This is what we actually use for encoding.
-	interval := this.intervals[symbol]
+// Returns false if the symbol has an empty interval, so cannot be encoded.
+func (this *Encoder) encodeSymbol(symbol uint8) bool {
+	// Look up the corresponding interval for the symbol in the coding table
+	// for the current context. This is what we actually use for encoding.
+	table := this.context.table(this.model)
+	interval := table.interval(symbol)
+	total := table.total()
+	if interval.length == 0 {
+		return false
+	}
 
 	// Renormalize. This is the complicated but less interesting part of coding.
 	// This is also where bytes are actually written to the output buffer.
@@ -290,7 +326,7 @@ func (this *Encoder) encodeSymbol(symbol uint8) {
 	// The new symbol subdivides the existing range.
 	// Take the existing range and subdivide it by the total length of the
 	// intervals in the coding table.
-	newRange := this.high / this.total
+	newRange := this.high / total
 
 	// Find the place in the new subdivide range where the new symbol's interval
 	// begins.
@@ -298,7 +334,7 @@ func (this *Encoder) encodeSymbol(symbol uint8) {
 
 	// The case where the symbol being encoded has the highest range is a
 	// special case.
-	if interval.high >= this.total {
+	if interval.high >= total {
 		// Special case where the symbol being encoded has the highest range
 		// Adjust the high part of the range
 		this.high = this.high - temp
@@ -310,6 +346,10 @@ func (this *Encoder) encodeSymbol(symbol uint8) {
 
 	// Adjust the low part of the range
 	this.low = this.low + temp
+
+	// Move the model on to the context for the next symbol.
+	this.context.update(this.model, table, symbol)
+	return true
 }
 
 // Summarized from "A Fast Renormalisation Method for Arithmetic Coding" by
@@ -367,9 +407,17 @@ func (this *Encoder) renormalize() {
 	// A No renormalisation is needed since the range is in the desired interval.
 }
 
-func (this *Encoder) flush() {
+// Write the remaining state and the length to the output buffer, given the
+// number of symbols encoded.
+func (this *Encoder) flush(symbols int) {
 	// Output the internal state variables.
 	this.renormalize()
+
+	// Only the top bits of low are written, so round it up to make sure that
+	// the value written is still inside the range. When every symbol takes 8
+	// bits the low bits are already zero.
+	this.low = (this.low + FLUSH_ROUNDING) &^ FLUSH_ROUNDING
+
 	var temp = this.low >> SHIFT_BITS
 	if temp > 0xFF {
 		this.write(this.working + 1)
@@ -389,13 +437,17 @@ func (this *Encoder) flush() {
 	this.write(temp & 0xFF)
 	this.write((this.low >> (23 - 8)) & 0xFF)
 
-	// Output the length
-	this.write((uint32(len(this.output)) >> uint32(8)) & uint32(0xFF))
-	this.write(uint32(len(this.output)) & uint32(0xFF))
+	// Output the length. This counts the symbols rather than the output bytes,
+	// so that the Decoder can stop after the last symbol however many bits each
+	// one took. It is offset by 4, the extra bytes in the output when every
+	// symbol takes 8 bits.
+	length := uint32(symbols) + 4
+	this.write((length >> 8) & 0xFF)
+	this.write(length & 0xFF)
 }
 
 func (this *Encoder) write(b uint32) {
-	this.output = append(this.output, b)
+	this.output = append(this.output, byte(b))
 }
 
 // Decodes a sequence of bytes using a probability distribution with the goal of
@@ -403,48 +455,71 @@ func (this *Encoder) write(b uint32) {
 type Decoder struct {
 	//extends Coder
 	Coder
+
+	// The input buffer, holding the bytes that have not been read yet.
+	input []byte
 }
 
-// Decode a sequence of bytes
+// Decode a sequence of bytes.
+// Returns nil if the input is too short to hold the length at its end.
 func (this *Decoder) Decode(input []byte) []byte {
-	// Create an empty input buffer.)
-	this.input = make([]uint32, len(input))
+	output, err := this.DecodeTo(nil, input)
+	if err != nil {
+		return nil
+	}
 
-	// Fetch the size of the target output.
-	// This is encoded as two bytes at the end of the encoded byte sequence.
-	var sizeBytes = input[len(input)-2:]
-	// Decode the two-byte size into a number.
-	var size = decodeShort(sizeBytes) - 4
+	return output
+}
 
-	// Copy the bytes from the given []byte into the internal input buffer.
-	for index := uint16(0); index < uint16(len(input)); index++ {
-		this.input[index] = uint32(input[index])
+// Decode src, appending the result to dst and returning the extended buffer.
+// Nothing is allocated if dst has room for the result, so a caller can reuse
+// one buffer for every sequence.
+func (this *Decoder) DecodeTo(dst []byte, src []byte) ([]byte, error) {
+	if len(src) < 2 {
+		return dst, fmt.Errorf("%w: %d bytes cannot hold the length of the sequence", ErrTruncatedPacket, len(src))
 	}
 
+	// Fetch the size of the target output.
+	// This is encoded as two bytes at the end of the encoded byte sequence.
+	size := sequenceLength(src)
+
 	// Initialize state.
 	// The Coder superclass initializes state common to Encoder and Decoder.
 	// Encoder and Decoder do some additional initialization that must be
 	// reset when encoding each byte sequence.
+	this.input = src
 	this.init()
-	// Decode all of the symbols in the input buffer
-	// The primary effect is to fill up the output buffer with output bytes.
-	// Internal state variables also change after decoding each symbol.
-	this.decodeSymbols()
-	// Flush any remaining state in the internal state variables into
-	// the output buffer.
-	this.flush()
 
-	// Copy the output buffer into an []byte that can be returned.
-	output := make([]byte, len(this.output))
-	for index, item := range this.output {
-		output[index] = byte(item)
+	// Decode as many symbols as the size. The last few may take no more
+	// input, so the decoder carries on once the input buffer is empty.
+	// Internal state variables change after decoding each symbol.
+	start := len(dst)
+	for size >= 0 && len(dst)-start < size {
+		dst = append(dst, this.decodeSymbol())
 	}
 
-	if uint16(len(output)) > size {
-		output = output[:size]
+	// Without a size, decode the symbols in the input buffer until it is
+	// empty, then flush any remaining state in the internal state variables
+	// into the output buffer.
+	if size < 0 {
+		for len(this.input) > 0 {
+			dst = append(dst, this.decodeSymbol())
+		}
+
+		dst = append(dst, this.flush())
 	}
 
-	return output
+	// Don't keep the caller's buffer.
+	this.input = nil
+	return dst, nil
+}
+
+// The number of symbols in an encoded sequence, from the two bytes at its end.
+// These hold the number plus 4. The Encoder never writes less than 4, so
+// smaller values give a negative number, meaning that the sequence runs to
+// the end of the input.
+func sequenceLength(encoded []byte) int {
+	return int(binary.BigEndian.Uint16(encoded[len(encoded)-2:])) - 4
 }
 
 // Initialize state variables for decoding.
@@ -452,54 +527,44 @@ func (this *Decoder) init() {
 	// Discard first byte because the encoder is weird.
 	this.input = this.input[1:]
 
-	this.working = this.input[0]
+	this.working = uint32(this.input[0])
 	this.input = this.input[1:]
 	this.low = this.working >> (8 - EXTRA_BITS)
 	this.high = 1 << EXTRA_BITS
 	this.underflow = 0
-	this.output = []uint32{}
-}
-
-// Decode symbols from the input buffer until it is empty.
-func (this *Decoder) decodeSymbols() {
-	for len(this.input) > 0 {
-		this.decodeSymbol()
-	}
+	this.context.reset()
 }
 
 // Run the decoding algorithm. This uses internal state variables and
 // may or may not consume bytes from the input buffer.
 // The primary result of running this is changing internal state variables
-// and one byte will always be written to the output buffer.
+// and one byte will always be returned.
 // After decoding symbols, flush must be called to get the remaining state
 // out of the internal state variables.
-func (this *Decoder) decodeSymbol() {
+func (this *Decoder) decodeSymbol() uint8 {
 	// Renormalize. This is the complicated but less interesting part of coding.
 	// This is also where bytes are actually read from the input buffer.
 	this.renormalize()
 
-	//
-	this.underflow = this.high >> 8
+	// Subdivide the range by the total length of the intervals in the coding
+	// table for the current context, and find where the low end falls.
+	table := this.context.table(this.model)
+	total := table.total()
+	this.underflow = this.high / total
 	temp := (this.low / this.underflow) >> 0
 
 	// Calculate the byte to output.
-	// There is a special case for 255.
-	var result uint32
-	if temp>>8 != 0 {
-		// Special case.
-		// Output 255.
-		result = 255
-	} else {
-		// General case.
-		// Output the byte that has been calculated.
-		result = temp
-	}
-
-	// Output the decoded byte into the output buffer.
-	this.output = append(this.output, result)
+	// The symbol with the highest range also takes any values past the total.
+	interval := table.symbolAt(temp)
 
 	// Update the internal state variables base on the byte that was decoded.
-	this.update(result)
+	this.update(interval, total)
+
+	// Move the model on to the context for the next symbol.
+	this.context.update(this.model, table, interval.symbol)
+
+	// Output the decoded byte.
+	return interval.symbol
 }
 
 // Renormalizing is the tricky but boring part of coding.
@@ -530,7 +595,7 @@ func (this *Decoder) renormalize() {
 		} else {
 			// General case. There input buffer has bits that have not been decoded.
 			// Put them in the working byte.
-			this.working = this.input[0]
+			this.working = uint32(this.input[0])
 			this.input = this.input[1:]
 		}
 
@@ -543,12 +608,9 @@ func (this *Decoder) renormalize() {
 	}
 }
 
-// Update internal state variables based on the symbol that was last decoded.
-func (this *Decoder) update(symbol uint32) {
-	// Look up the corresponding interval for the symbol in the coding table.
-	// This is what we actually use for encoding.
-	interval := this.intervals[uint8(symbol)]
-
+// Update internal state variables based on the interval of the symbol that
+// was last decoded, from a coding table with the given total.
+func (this *Decoder) update(interval Interval, total uint32) {
 	// Recover the bits stored from the underflow
 	// This will be 0 if there are no underflow bits.
 	temp := this.underflow * interval.low
@@ -559,7 +621,7 @@ func (this *Decoder) update(symbol uint32) {
 
 	// The case where the symbol being encoded has the highest range is a
 	// special case.
-	if interval.high >= this.total {
+	if interval.high >= total {
 		// Special case where the symbol being encoded has the highest range
 		// Adjust the high part of the range
 		this.high = this.high - temp
@@ -570,14 +632,11 @@ func (this *Decoder) update(symbol uint32) {
 	}
 }
 
-// Get the remaining information from the internal state variables and
-// write it to the output buffer.
+// Get the remaining information from the internal state variables, returning
+// the last symbol.
 // This should be called after the input buffer is empty.
-func (this *Decoder) flush() {
+func (this *Decoder) flush() uint8 {
 	// Attempt to decode a symbol even though the input buffer is empty.
 	// This should get the remaining state out of working.
-	this.decodeSymbol()
-	// Renormalize. This should get the remaining state out of the rest of the
-	// internal state variables.
-	this.renormalize()
+	return this.decodeSymbol()
 }
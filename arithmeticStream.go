@@ -0,0 +1,252 @@
+package protean
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The size of the buffers a StreamEncoder and StreamDecoder keep between their
+// coder and the underlying writer or reader.
+const STREAM_BUFFER_SIZE = 4096
+
+// The unread bytes a StreamDecoder keeps ahead of the decoder until it reaches
+// the end of the stream. Decoding a symbol reads at most 3 bytes, and every
+// symbol the Encoder wrote is decoded with at least 4 bytes of the encoding
+// left unread, so these are the symbols decoded while there is this much
+// lookahead.
+const STREAM_LOOKAHEAD = 7
+
+// Returned by a StreamEncoder after it has been closed.
+var errStreamClosed = errors.New("protean: write to closed StreamEncoder")
+
+// Encodes a sequence of bytes as it is written, passing the encoding on to an
+// io.Writer in chunks rather than holding it all. Close writes the end of the
+// encoding, which is then the same as Encode would give for all of the bytes
+// written together.
+type StreamEncoder struct {
+	// extends Encoder
+	Encoder
+
+	writer io.Writer
+
+	// The number of symbols written so far.
+	symbols int
+
+	// The first error, which every later call returns.
+	err error
+}
+
+// Make a StreamEncoder using a Model, writing the encoding to writer.
+func NewStreamEncoder(model *Model, writer io.Writer) *StreamEncoder {
+	this := &StreamEncoder{Encoder: NewModelEncoder(model)}
+	this.output = make([]byte, 0, STREAM_BUFFER_SIZE)
+	this.Reset(writer)
+	return this
+}
+
+// Start a new sequence, writing its encoding to writer. Any sequence in progress
+// is abandoned.
+func (this *StreamEncoder) Reset(writer io.Writer) {
+	this.writer = writer
+	this.output = this.output[:0]
+	this.symbols = 0
+	this.err = nil
+	this.init()
+}
+
+// Encode p. The encoding is passed to the underlying writer as the buffer
+// fills, so some of it may still be buffered when Write returns.
+func (this *StreamEncoder) Write(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+
+	if this.symbols+len(p) > MAX_SEQUENCE_LENGTH {
+		return 0, fmt.Errorf("%w: %d bytes is more than the %d that can be encoded", ErrMalformedPacket, this.symbols+len(p), MAX_SEQUENCE_LENGTH)
+	}
+
+	for index, b := range p {
+		if !this.encodeSymbol(b) {
+			this.err = fmt.Errorf("%w: byte %#02x at offset %d cannot occur there", ErrMalformedPacket, b, this.symbols)
+			return index, this.err
+		}
+
+		this.symbols++
+		if len(this.output) >= STREAM_BUFFER_SIZE {
+			if err := this.drain(); err != nil {
+				return index + 1, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// Write the end of the encoding and everything still buffered. Later calls to
+// Write fail until the StreamEncoder is Reset.
+func (this *StreamEncoder) Close() error {
+	if this.err != nil {
+		return this.err
+	}
+
+	this.flush(this.symbols)
+	err := this.drain()
+	if err == nil {
+		this.err = errStreamClosed
+	}
+
+	return err
+}
+
+// Pass the buffered encoding on to the writer.
+func (this *StreamEncoder) drain() error {
+	_, err := this.writer.Write(this.output)
+	this.output = this.output[:0]
+	if err != nil {
+		this.err = err
+	}
+
+	return err
+}
+
+// Decodes a sequence of bytes as it is read, taking the encoding from an
+// io.Reader in chunks rather than holding it all. For any encoding an Encoder
+// produced, the bytes read are the same as Decode would give for the whole
+// encoding.
+//
+// The number of symbols is at the end of an encoding, so a StreamDecoder
+// cannot know that an arbitrary sequence of bytes will end the way Decode
+// would end it. It reports ErrMalformedPacket when it reaches the end of such
+// a sequence after returning more bytes than its length allows.
+type StreamDecoder struct {
+	// extends Decoder
+	Decoder
+
+	reader io.Reader
+
+	// The storage for the input buffer.
+	buffer []byte
+
+	// Whether the first bytes have been read and the decoder initialized.
+	started bool
+
+	// Whether the reader has reached the end of the encoding.
+	ended bool
+
+	// The number of symbols in the sequence, known once it has ended.
+	length int
+
+	// Whether the remaining state has been flushed out of the decoder.
+	flushed bool
+
+	// The number of symbols decoded so far.
+	symbols int
+
+	// The first error, which every later call returns. At the end of the
+	// sequence this is io.EOF.
+	err error
+}
+
+// Make a StreamDecoder using a Model, reading the encoding from reader. The
+// Model must be the same as the Encoder's.
+func NewStreamDecoder(model *Model, reader io.Reader) *StreamDecoder {
+	this := &StreamDecoder{Decoder: NewModelDecoder(model)}
+	this.buffer = make([]byte, STREAM_BUFFER_SIZE)
+	this.Reset(reader)
+	return this
+}
+
+// Start a new sequence, reading its encoding from reader. Any sequence in
+// progress is abandoned.
+func (this *StreamDecoder) Reset(reader io.Reader) {
+	this.reader = reader
+	this.input = this.buffer[:0]
+	this.started = false
+	this.ended = false
+	this.length = 0
+	this.flushed = false
+	this.symbols = 0
+	this.err = nil
+}
+
+// Decode into p. Read only waits for the underlying reader when it has not
+// decoded anything yet.
+func (this *StreamDecoder) Read(p []byte) (int, error) {
+	count := 0
+	for count < len(p) && this.err == nil {
+		// Before the end, keep enough lookahead to know that the next symbol
+		// is part of the sequence, and enough to start the decoder.
+		needed := STREAM_LOOKAHEAD
+		if !this.started {
+			needed = needed + 2
+		}
+
+		if !this.ended && len(this.input) < needed {
+			if count > 0 {
+				break
+			}
+
+			this.fill()
+			continue
+		}
+
+		if !this.started {
+			if len(this.input) < 2 {
+				this.err = fmt.Errorf("%w: %d bytes cannot hold the length of the sequence", ErrTruncatedPacket, len(this.input))
+				break
+			}
+
+			this.init()
+			this.started = true
+		}
+
+		if this.ended {
+			// The remaining input includes the length at the end, so the
+			// sequence can be finished as Decode would finish it.
+			if this.length >= 0 && this.symbols > this.length {
+				this.err = fmt.Errorf("%w: decoded %d bytes of a sequence of %d", ErrMalformedPacket, this.symbols, this.length)
+				break
+			}
+
+			if this.symbols == this.length || this.flushed {
+				this.err = io.EOF
+				break
+			}
+
+			if this.length < 0 && len(this.input) == 0 {
+				p[count] = this.flush()
+				this.flushed = true
+				count++
+				this.symbols++
+				continue
+			}
+		}
+
+		p[count] = this.decodeSymbol()
+		count++
+		this.symbols++
+	}
+
+	if count > 0 {
+		return count, nil
+	}
+
+	return 0, this.err
+}
+
+// Move the unread input to the start of the buffer and read more after it.
+func (this *StreamDecoder) fill() {
+	unread := copy(this.buffer, this.input)
+	read, err := this.reader.Read(this.buffer[unread:])
+	this.input = this.buffer[:unread+read]
+	if err == io.EOF {
+		// The lookahead keeps the length at the end in the buffer.
+		this.ended = true
+		if len(this.input) >= 2 {
+			this.length = sequenceLength(this.input)
+		}
+	} else if err != nil {
+		this.err = err
+	}
+}
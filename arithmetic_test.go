@@ -3,7 +3,12 @@ package protean
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
 	"testing"
+	"testing/iotest"
 )
 
 // The encoding input is a simple numerical sequence.
@@ -64,3 +69,480 @@ func TestDecodingLong(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// A skewed order-0 table, favouring the printable bytes.
+func skewedFrequencies() []uint32 {
+	frequencies := make([]uint32, 256)
+	for index := range frequencies {
+		frequencies[index] = 1
+		if index >= 0x20 && index < 0x7F {
+			frequencies[index] = 40
+		}
+	}
+
+	return frequencies
+}
+
+// A table allowing only the given bytes.
+func onlyFrequencies(allowed ...byte) []uint32 {
+	frequencies := make([]uint32, 256)
+	for _, b := range allowed {
+		frequencies[b] = 10
+	}
+
+	return frequencies
+}
+
+// Sequences survive a round trip through an Encoder and Decoder sharing a
+// context model, whether or not it adapts.
+func TestContextModelRoundTrip(t *testing.T) {
+	contexts := map[string][]uint32{
+		"":   onlyFrequencies('G', 'P'),
+		"47": onlyFrequencies('E'),
+		"50": onlyFrequencies('O', 'U'),
+		"45": onlyFrequencies('T', ' '),
+	}
+
+	inputs := [][]byte{
+		[]byte("GET /index.html"),
+		[]byte("POST"),
+		[]byte("PUT something else entirely"),
+	}
+
+	for _, adaptive := range []bool{false, true} {
+		model, err := NewContextModel(skewedFrequencies(), 1, contexts, adaptive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoder := NewModelEncoder(model)
+		decoder := NewModelDecoder(model)
+		for _, input := range inputs {
+			decoded := decoder.Decode(encoder.Encode(input))
+			if !bytes.Equal(decoded, input) {
+				t.Errorf("adaptive %v: decoded %q, expected %q", adaptive, decoded, input)
+			}
+		}
+	}
+}
+
+// Running the Decoder on arbitrary bytes produces output that follows the
+// context model, and does so deterministically.
+func TestContextModelShapesOutput(t *testing.T) {
+	contexts := map[string][]uint32{
+		"":   onlyFrequencies('a'),
+		"61": onlyFrequencies('b', 'c'),
+		"62": onlyFrequencies('a', 'c'),
+		"63": onlyFrequencies('a', 'b', 'c'),
+	}
+
+	for _, adaptive := range []bool{false, true} {
+		model, err := NewContextModel(skewedFrequencies(), 1, contexts, adaptive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := make([]byte, 64)
+		for index := range input {
+			input[index] = byte(index * 37)
+		}
+
+		encoded := append([]byte{0xCA}, input...)
+		encoded = append(encoded, 0, 0, 0, byte(len(encoded)+3))
+
+		decoder := NewModelDecoder(model)
+		shaped := decoder.Decode(encoded)
+		if len(shaped) < len(input) {
+			t.Fatalf("adaptive %v: shaped %d bytes into %d", adaptive, len(input), len(shaped))
+		}
+
+		if shaped[0] != 'a' {
+			t.Errorf("adaptive %v: first byte is %q, expected 'a'", adaptive, shaped[0])
+		}
+
+		for index := 1; index < len(shaped); index++ {
+			if shaped[index] == 'a' && shaped[index-1] == 'a' || shaped[index] == 'b' && shaped[index-1] == 'b' || shaped[index] < 'a' || shaped[index] > 'c' {
+				t.Fatalf("adaptive %v: %q follows %q", adaptive, shaped[index], shaped[index-1])
+			}
+		}
+
+		again := NewModelDecoder(model)
+		if !bytes.Equal(again.Decode(encoded), shaped) {
+			t.Errorf("adaptive %v: decoding is not deterministic", adaptive)
+		}
+	}
+}
+
+// The tables for ranges of positions are used in place of the others there.
+func TestPositionRanges(t *testing.T) {
+	digits := onlyFrequencies('0', '1', '2', '3', '4', '5', '6', '7', '8', '9')
+	lower := make([]uint32, 256)
+	for b := 'a'; b <= 'z'; b++ {
+		lower[b] = 10
+	}
+
+	for _, adaptive := range []bool{false, true} {
+		// Outside the ranges, 'R' is followed by a digit.
+		model, err := NewContextModel(lower, 1, map[string][]uint32{"52": digits}, adaptive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, positions := range []FrequencyRange{{Start: 0, End: 2, Frequencies: onlyFrequencies('R', 'S')}, {Start: 4, End: 6, Frequencies: digits}} {
+			if err := model.AddRange(positions); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		input := make([]byte, 32)
+		for index := range input {
+			input[index] = byte(index * 101)
+		}
+
+		encoded := append([]byte{0xCA}, input...)
+		encoded = append(encoded, 0, 0, 0, byte(len(input)+4))
+
+		decoder := NewModelDecoder(model)
+		shaped := decoder.Decode(encoded)
+		for index, b := range shaped {
+			var allowed bool
+			switch {
+			case index < 2:
+				allowed = b == 'R' || b == 'S'
+			case index >= 4 && index < 6, shaped[index-1] == 'R':
+				allowed = b >= '0' && b <= '9'
+			default:
+				allowed = b >= 'a' && b <= 'z'
+			}
+
+			if !allowed {
+				t.Fatalf("adaptive %v: %q at offset %d", adaptive, b, index)
+			}
+		}
+
+		encoder := NewModelEncoder(model)
+		plain := []byte("RR7b12cdefg")
+		if decoded := decoder.Decode(encoder.Encode(plain)); !bytes.Equal(decoded, plain) {
+			t.Errorf("adaptive %v: decoded %q, expected %q", adaptive, decoded, plain)
+		}
+	}
+
+	model := NewModel(lower)
+	err := model.AddRange(FrequencyRange{Start: 4, End: 2, Frequencies: digits})
+	if err == nil {
+		t.Errorf("expected an empty range to be rejected")
+	}
+}
+
+// The bound on the number of symbols accounts for the tables of each range.
+func TestMaximumSymbols(t *testing.T) {
+	model := NewModel(sampleDecompressionConfig().Frequencies)
+	if symbols := model.maximumSymbols(16); symbols != 2 {
+		t.Errorf("uniform model codes 16 bits in %d symbols, expected 2", symbols)
+	}
+
+	// Four symbols from a table of two equally likely bytes take 4 bits,
+	// leaving 12 bits for 2 more symbols.
+	err := model.AddRange(FrequencyRange{Start: 0, End: 4, Frequencies: onlyFrequencies('a', 'b')})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if symbols := model.maximumSymbols(16); symbols != 6 {
+		t.Errorf("model with a range codes 16 bits in %d symbols, expected 6", symbols)
+	}
+}
+
+// A skewed target distribution, as counts: geometric, with every byte
+// possible but the rarest about a millionth as likely as the most common.
+func geometricCounts() []uint32 {
+	counts := make([]uint32, 256)
+	for index := range counts {
+		counts[index] = uint32(1000000*math.Pow(0.95, float64(index))) + 1
+	}
+
+	return counts
+}
+
+// The Kullback-Leibler divergence in bits of the distribution given by a
+// table from the distribution given by counts.
+func divergence(counts []uint32, table *frequencyTable) float64 {
+	var countTotal float64
+	for _, count := range counts {
+		countTotal = countTotal + float64(count)
+	}
+
+	var result float64
+	for symbol, count := range counts {
+		p := float64(count) / countTotal
+		q := float64(table.frequencies[symbol]) / float64(table.total())
+		result = result + p*math.Log2(p/q)
+	}
+
+	return result
+}
+
+// High precision tables stay much closer to a skewed target distribution, and
+// still code correctly.
+func TestHighPrecision(t *testing.T) {
+	counts := geometricCounts()
+	divergences := map[int]float64{}
+	for _, precision := range []int{FREQUENCY_PRECISION_STANDARD, FREQUENCY_PRECISION_HIGH} {
+		model, err := NewPrecisionModel(precision, counts, 0, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if total := model.base.total(); total >= model.limits.maxTotal {
+			t.Errorf("precision %d: total %d is over the limit", precision, total)
+		}
+
+		divergences[precision] = divergence(counts, model.base)
+
+		encoder := NewModelEncoder(model)
+		decoder := NewModelDecoder(model)
+		plain := make([]byte, 300)
+		for index := range plain {
+			plain[index] = byte(index * 7)
+		}
+
+		if decoded := decoder.Decode(encoder.Encode(plain)); !bytes.Equal(decoded, plain) {
+			t.Errorf("precision %d: decoded %x, expected %x", precision, decoded, plain)
+		}
+	}
+
+	t.Logf("divergence: standard %.5f bits, high %.5f bits", divergences[FREQUENCY_PRECISION_STANDARD], divergences[FREQUENCY_PRECISION_HIGH])
+	if divergences[FREQUENCY_PRECISION_HIGH]*10 > divergences[FREQUENCY_PRECISION_STANDARD] {
+		t.Errorf("high precision divergence is not an order of magnitude lower")
+	}
+}
+
+// Models for the coder tests, with a function giving bytes each one can encode.
+func coderModels(t testing.TB) map[string]struct {
+	model    *Model
+	generate func(random *rand.Rand, length int) []byte
+} {
+	randomBytes := func(random *rand.Rand, length int) []byte {
+		plain := make([]byte, length)
+		random.Read(plain)
+		return plain
+	}
+
+	// Mostly 'a', which takes a small fraction of a bit with the likely table.
+	mostlyA := func(random *rand.Rand, length int) []byte {
+		plain := randomBytes(random, length)
+		for index := range plain {
+			if random.Intn(10) != 0 {
+				plain[index] = 'a'
+			}
+		}
+
+		return plain
+	}
+
+	likely := make([]uint32, 256)
+	for index := range likely {
+		likely[index] = 1
+	}
+	likely['a'] = 255
+
+	precise, err := NewPrecisionModel(FREQUENCY_PRECISION_HIGH, geometricCounts(), 0, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adaptive, err := NewContextModel(skewedFrequencies(), 2, map[string][]uint32{"6161": likely}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]struct {
+		model    *Model
+		generate func(random *rand.Rand, length int) []byte
+	}{
+		"uniform":  {NewModel(sampleDecompressionConfig().Frequencies), randomBytes},
+		"skewed":   {NewModel(skewedFrequencies()), randomBytes},
+		"likely":   {NewModel(likely), mostlyA},
+		"precise":  {precise, mostlyA},
+		"adaptive": {adaptive, mostlyA},
+	}
+}
+
+// EncodeTo and DecodeTo append to the buffers they are given, giving the same
+// bytes as Encode and Decode without allocating.
+func TestEncodeTo(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for name, test := range coderModels(t) {
+		encoder := NewModelEncoder(test.model)
+		decoder := NewModelDecoder(test.model)
+		plain := test.generate(random, 1400)
+		encoded := encoder.Encode(plain)
+
+		prefix := []byte("prefix")
+		appended, err := encoder.EncodeTo(prefix, plain)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !bytes.Equal(appended, append(prefix, encoded...)) {
+			t.Errorf("%s: EncodeTo differs from Encode", name)
+		}
+
+		appended, err = decoder.DecodeTo(prefix, encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if !bytes.Equal(appended, append(prefix, plain...)) {
+			t.Errorf("%s: DecodeTo differs from the input", name)
+		}
+
+		buffer := make([]byte, 0, 2*len(plain)+16)
+		allocations := testing.AllocsPerRun(10, func() {
+			buffer, _ = encoder.EncodeTo(buffer[:0], plain)
+			buffer, _ = decoder.DecodeTo(buffer[:0], buffer)
+		})
+
+		if allocations != 0 {
+			t.Errorf("%s: %v allocations per round trip", name, allocations)
+		}
+	}
+
+	encoder := NewModelEncoder(NewModel(onlyFrequencies('a', 'b')))
+	if _, err := encoder.EncodeTo(nil, []byte("abc")); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("expected ErrMalformedPacket for an excluded byte, got %v", err)
+	}
+
+	decoder := NewDecoder(sampleDecompressionConfig().Frequencies)
+	if _, err := decoder.DecodeTo(nil, []byte{0xCA}); !errors.Is(err, ErrTruncatedPacket) {
+		t.Errorf("expected ErrTruncatedPacket for a single byte, got %v", err)
+	}
+}
+
+// Streaming gives the same encoding as Encode however the input is split, and
+// decodes it however the encoding is read.
+func TestStreamRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(2))
+	for name, test := range coderModels(t) {
+		var encoding bytes.Buffer
+		streamEncoder := NewStreamEncoder(test.model, &encoding)
+		streamDecoder := NewStreamDecoder(test.model, &encoding)
+		encoder := NewModelEncoder(test.model)
+		for _, length := range []int{0, 1, 2, 7, 100, 5000, MAX_SEQUENCE_LENGTH} {
+			plain := test.generate(random, length)
+			expected := encoder.Encode(plain)
+
+			encoding.Reset()
+			streamEncoder.Reset(&encoding)
+			for remaining := plain; len(remaining) > 0; {
+				chunk := min(len(remaining), random.Intn(300)+1)
+				if _, err := streamEncoder.Write(remaining[:chunk]); err != nil {
+					t.Fatalf("%s, %d bytes: %v", name, length, err)
+				}
+
+				remaining = remaining[chunk:]
+			}
+
+			if err := streamEncoder.Close(); err != nil {
+				t.Fatalf("%s, %d bytes: %v", name, length, err)
+			}
+
+			if !bytes.Equal(encoding.Bytes(), expected) {
+				t.Fatalf("%s, %d bytes: the stream encoding differs from Encode", name, length)
+			}
+
+			for _, reader := range []io.Reader{bytes.NewReader(expected), iotest.OneByteReader(bytes.NewReader(expected))} {
+				streamDecoder.Reset(reader)
+				decoded, err := io.ReadAll(streamDecoder)
+				if err != nil {
+					t.Fatalf("%s, %d bytes: %v", name, length, err)
+				}
+
+				if !bytes.Equal(decoded, plain) {
+					t.Fatalf("%s, %d bytes: decoded %d bytes that differ from the input", name, length, len(decoded))
+				}
+			}
+		}
+
+		streamEncoder.Reset(io.Discard)
+		if _, err := streamEncoder.Write(make([]byte, MAX_SEQUENCE_LENGTH+1)); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("%s: expected ErrMalformedPacket for a long sequence, got %v", name, err)
+		}
+	}
+}
+
+// The length of the packets in the benchmarks, typical of a tunnel's MTU.
+const BENCHMARK_PACKET_LENGTH = 1400
+
+func benchmarkPacket(length int) []byte {
+	plain := make([]byte, length)
+	rand.New(rand.NewSource(3)).Read(plain)
+	return plain
+}
+
+func BenchmarkEncode(b *testing.B) {
+	encoder := NewModelEncoder(NewModel(skewedFrequencies()))
+	plain := benchmarkPacket(BENCHMARK_PACKET_LENGTH)
+	b.SetBytes(int64(len(plain)))
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		encoder.Encode(plain)
+	}
+}
+
+func BenchmarkEncodeTo(b *testing.B) {
+	encoder := NewModelEncoder(NewModel(skewedFrequencies()))
+	plain := benchmarkPacket(BENCHMARK_PACKET_LENGTH)
+	buffer := make([]byte, 0, 2*len(plain))
+	b.SetBytes(int64(len(plain)))
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		buffer, _ = encoder.EncodeTo(buffer[:0], plain)
+	}
+}
+
+func BenchmarkDecodeTo(b *testing.B) {
+	model := NewModel(skewedFrequencies())
+	encoder := NewModelEncoder(model)
+	decoder := NewModelDecoder(model)
+	encoded := encoder.Encode(benchmarkPacket(BENCHMARK_PACKET_LENGTH))
+	buffer := make([]byte, 0, BENCHMARK_PACKET_LENGTH)
+	b.SetBytes(BENCHMARK_PACKET_LENGTH)
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		buffer, _ = decoder.DecodeTo(buffer[:0], encoded)
+	}
+}
+
+func BenchmarkStreamEncoder(b *testing.B) {
+	encoder := NewStreamEncoder(NewModel(skewedFrequencies()), io.Discard)
+	plain := benchmarkPacket(MAX_SEQUENCE_LENGTH)
+	b.SetBytes(int64(len(plain)))
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		encoder.Reset(io.Discard)
+		encoder.Write(plain)
+		encoder.Close()
+	}
+}
+
+func BenchmarkStreamDecoder(b *testing.B) {
+	model := NewModel(skewedFrequencies())
+	plain := benchmarkPacket(MAX_SEQUENCE_LENGTH)
+	encoder := NewModelEncoder(model)
+	encoded := encoder.Encode(plain)
+	decoder := NewStreamDecoder(model, nil)
+	reader := bytes.NewReader(encoded)
+	buffer := make([]byte, STREAM_BUFFER_SIZE)
+	b.SetBytes(int64(len(plain)))
+	b.ReportAllocs()
+	for index := 0; index < b.N; index++ {
+		reader.Reset(encoded)
+		decoder.Reset(reader)
+		for {
+			if _, err := decoder.Read(buffer); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -6,31 +6,32 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
 // Accepted in serialised form by Configure().
 type SequenceConfig struct {
 	// Sequences that should be added to the outgoing packet stream.
-	AddSequences []SerializedSequenceModel
+	AddSequences []SerializedSequenceModel `json:"addSequences"`
 
 	// Sequences that should be removed from the incoming packet stream.
-	RemoveSequences []SerializedSequenceModel
+	RemoveSequences []SerializedSequenceModel `json:"removeSequences"`
 }
 
 // Sequence models where the Sequences have been encoded as strings.
 // This is used by the SequenceConfig argument passed to Configure().
 type SerializedSequenceModel struct {
 	// Index of the packet into the Sequence.
-	Index int8
+	Index int8 `json:"index"`
 
 	// Offset of the Sequence in the packet.
-	Offset int16
+	Offset int16 `json:"offset"`
 
 	// Byte Sequence encoded as a string.
-	Sequence string
+	Sequence string `json:"sequence"`
 
 	// Target packet Length.
-	Length int16
+	Length int16 `json:"length"`
 }
 
 // Sequence models where the Sequences have been decoded as []bytes.
@@ -58,7 +59,12 @@ func sampleSequenceConfig() SequenceConfig {
 }
 
 // An obfuscator that injects byte sequences.
+// Transform and Restore are safe for concurrent use, but Configure is not.
 type ByteSequenceShaper struct {
+	// Guards OutputIndex, which is updated by Transform, and RemoveSequences,
+	// which is updated by Restore.
+	lock sync.Mutex
+
 	// Sequences that should be added to the outgoing packet stream.
 	AddSequences []*SequenceModel
 
@@ -86,65 +92,137 @@ func NewByteSequenceShaper() *ByteSequenceShaper {
 		return nil
 	}
 
-	shaper.Configure(string(jsonConfig))
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return shaper
 }
 
 // This method is required to implement the Transformer API.
 // @param {[]byte} key Key to set, not used by this class.
-func (shaper *ByteSequenceShaper) SetKey(key []byte) {
+func (shaper *ByteSequenceShaper) SetKey(key []byte) error {
+	return nil
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (shaper *ByteSequenceShaper) Configure(jsonConfig string) {
+func (shaper *ByteSequenceShaper) Configure(jsonConfig string) error {
 	var config SequenceConfig
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
-		fmt.Println("Encryption shaper requires key parameter")
+		return fmt.Errorf("%w: byte sequence shaper requires addSequences and removeSequences parameters: %v", ErrMalformedConfig, err)
 	}
 
-	shaper.ConfigureStruct(config)
+	return shaper.ConfigureStruct(config)
 }
 
-func (shaper *ByteSequenceShaper) ConfigureStruct(config SequenceConfig) {
-	shaper.AddSequences, shaper.RemoveSequences = deserializeByteSequenceConfig(config)
+func (shaper *ByteSequenceShaper) ConfigureStruct(config SequenceConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	adds, rems, err := deserializeByteSequenceConfig(config)
+	if err != nil {
+		return err
+	}
+
+	shaper.AddSequences, shaper.RemoveSequences = adds, rems
+	shaper.OutputIndex = 0
+
+	if len(shaper.AddSequences) == 0 {
+		// Nothing to inject, so make the range of injected indices empty.
+		shaper.FirstIndex = 0
+		shaper.LastIndex = -1
+		return nil
+	}
 
 	// Make a note of the Index of the first packet to inject
 	shaper.FirstIndex = shaper.AddSequences[0].Index
 
 	// Make a note of the Index of the last packet to inject
 	shaper.LastIndex = shaper.AddSequences[len(shaper.AddSequences)-1].Index
+	return nil
+}
+
+// Check the config, recording any problems under path.
+func (config SequenceConfig) validate(path string, problems *ConfigErrors) {
+	for index, model := range config.AddSequences {
+		modelPath := fmt.Sprintf("%s[%d]", fieldPath(path, "addSequences"), index)
+		model.validate(modelPath, problems)
+
+		// The shaper relies on the injected packets being in index order.
+		if index > 0 && model.Index <= config.AddSequences[index-1].Index {
+			problems.add(fieldPath(modelPath, "index"), "%d is not greater than the previous index %d", model.Index, config.AddSequences[index-1].Index)
+		}
+	}
+
+	for index, model := range config.RemoveSequences {
+		model.validate(fmt.Sprintf("%s[%d]", fieldPath(path, "removeSequences"), index), problems)
+	}
+}
+
+// Check the model, recording any problems under path.
+func (model SerializedSequenceModel) validate(path string, problems *ConfigErrors) {
+	if model.Index < 0 {
+		problems.add(fieldPath(path, "index"), "%d is out of range, must not be negative", model.Index)
+	}
+
+	sequence, err := hex.DecodeString(model.Sequence)
+	if err != nil {
+		problems.add(fieldPath(path, "sequence"), "invalid hex: %v", err)
+		return
+	}
+
+	if model.Offset < 0 || int(model.Offset)+len(sequence) > int(model.Length) {
+		problems.add(fieldPath(path, "offset"), "sequence at offset %d is out of range for a packet of length %d", model.Offset, model.Length)
+	}
 }
 
 // Decode the key from string in the config information
-func deserializeByteSequenceConfig(config SequenceConfig) ([]*SequenceModel, []*SequenceModel) {
+func deserializeByteSequenceConfig(config SequenceConfig) ([]*SequenceModel, []*SequenceModel, error) {
 	adds := make([]*SequenceModel, len(config.AddSequences))
 	rems := make([]*SequenceModel, len(config.RemoveSequences))
 
 	for x, seq := range config.AddSequences {
-		adds[x] = deserializeByteSequenceModel(seq)
+		model, err := deserializeByteSequenceModel(seq)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: addSequences[%d]: %v", ErrMalformedConfig, x, err)
+		}
+
+		adds[x] = model
 	}
 
 	for x, seq := range config.RemoveSequences {
-		rems[x] = deserializeByteSequenceModel(seq)
+		model, err := deserializeByteSequenceModel(seq)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: removeSequences[%d]: %v", ErrMalformedConfig, x, err)
+		}
+
+		rems[x] = model
 	}
 
-	return adds, rems
+	return adds, rems, nil
 }
 
 // Decode the header from a string in the header model
-func deserializeByteSequenceModel(model SerializedSequenceModel) *SequenceModel {
+func deserializeByteSequenceModel(model SerializedSequenceModel) (*SequenceModel, error) {
 	sequence, err := hex.DecodeString(model.Sequence)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return &SequenceModel{Index: model.Index, Offset: model.Offset, Sequence: sequence, Length: model.Length}
+	return &SequenceModel{Index: model.Index, Offset: model.Offset, Sequence: sequence, Length: model.Length}, nil
 }
 
 // Inject header.
-func (shaper *ByteSequenceShaper) Transform(buffer []byte) [][]byte {
+func (shaper *ByteSequenceShaper) Transform(buffer []byte) ([][]byte, error) {
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
 	var results [][]byte
 
 	// Check if the current Index into the packet stream is within the range
@@ -168,21 +246,24 @@ func (shaper *ByteSequenceShaper) Transform(buffer []byte) [][]byte {
 			results = shaper.OutputAndIncrement(results, buffer)
 		}
 
-		return results
+		return results, nil
 	} else {
 		// Injection has finished and will not occur again. Take the fast path and
 		// just return the buffer.
-		return [][]byte{buffer}
+		return [][]byte{buffer}, nil
 	}
 }
 
 // Remove injected packets.
-func (shaper *ByteSequenceShaper) Restore(buffer []byte) [][]byte {
+func (shaper *ByteSequenceShaper) Restore(buffer []byte) ([][]byte, error) {
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
 	match := shaper.findMatchingPacket(buffer)
 	if match != nil {
-		return [][]byte{}
+		return [][]byte{}, nil
 	} else {
-		return [][]byte{buffer}
+		return [][]byte{buffer}, nil
 	}
 }
 
@@ -190,6 +271,12 @@ func (shaper *ByteSequenceShaper) Restore(buffer []byte) [][]byte {
 func (shaper *ByteSequenceShaper) Dispose() {
 }
 
+// Packets passing through are not modified, so there is no overhead.
+// Injected packets are separate, with the lengths given in the config.
+func (shaper *ByteSequenceShaper) Overhead(length int) int {
+	return 0
+}
+
 // Inject packets
 func (shaper *ByteSequenceShaper) Inject(results [][]byte) [][]byte {
 	nextPacket := shaper.findNextPacket(shaper.OutputIndex)
@@ -222,6 +309,11 @@ func (shaper *ByteSequenceShaper) findNextPacket(index int8) *SequenceModel {
 func (shaper *ByteSequenceShaper) findMatchingPacket(sequence []byte) *SequenceModel {
 	for i, model := range shaper.RemoveSequences {
 		target := model.Sequence
+		if len(sequence) < int(model.Offset)+len(target) {
+			// Too short to contain this Sequence
+			continue
+		}
+
 		source := sequence[int(model.Offset) : int(model.Offset)+len(target)]
 		if bytes.Equal(source, target) {
 			// Remove matched packet so that it's not matched again
@@ -0,0 +1,115 @@
+package protean
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A source of time for the parts of Protean that expire state, such as the
+// Defragmenter. Tests can use a ManualClock to drive expiry deterministically.
+type Clock interface {
+	// The current time.
+	Now() time.Time
+
+	// Call callback in its own goroutine once duration has elapsed, unless
+	// the returned Timer is stopped first.
+	AfterFunc(duration time.Duration, callback func()) Timer
+}
+
+// A pending call scheduled with Clock.AfterFunc.
+type Timer interface {
+	// Prevent the call, if it has not happened yet. Returns false if the call
+	// has already happened or the Timer was already stopped.
+	Stop() bool
+}
+
+// The Clock used when none is given, which uses the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(duration time.Duration, callback func()) Timer {
+	return time.AfterFunc(duration, callback)
+}
+
+// A Clock that only moves when it is advanced.
+// Callbacks that fall due are called synchronously by Advance, in the order of
+// their due times, so a test can observe their effects as soon as it returns.
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	pending []*manualTimer
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	due      time.Time
+	callback func()
+}
+
+// Make a ManualClock that starts at the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (this *ManualClock) Now() time.Time {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.now
+}
+
+func (this *ManualClock) AfterFunc(duration time.Duration, callback func()) Timer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	timer := &manualTimer{clock: this, due: this.now.Add(duration), callback: callback}
+	this.pending = append(this.pending, timer)
+	return timer
+}
+
+// Move the clock forward, calling the callbacks that fall due.
+// A callback may schedule further callbacks, which are also called if they fall
+// due before the new time.
+func (this *ManualClock) Advance(duration time.Duration) {
+	this.lock.Lock()
+	target := this.now.Add(duration)
+	this.lock.Unlock()
+
+	for {
+		this.lock.Lock()
+		sort.SliceStable(this.pending, func(i, j int) bool { return this.pending[i].due.Before(this.pending[j].due) })
+		if len(this.pending) == 0 || this.pending[0].due.After(target) {
+			this.now = target
+			this.lock.Unlock()
+			return
+		}
+
+		timer := this.pending[0]
+		this.pending = this.pending[1:]
+		this.now = timer.due
+		this.lock.Unlock()
+
+		// Called without the lock, so that the callback can use the clock.
+		timer.callback()
+	}
+}
+
+func (this *manualTimer) Stop() bool {
+	this.clock.lock.Lock()
+	defer this.clock.lock.Unlock()
+
+	for index, timer := range this.clock.pending {
+		if timer == this {
+			this.clock.pending = append(this.clock.pending[:index], this.clock.pending[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,141 @@
+// Command protean-proxy is a UDP-to-UDP proxy that obfuscates traffic with a
+// ProteanShaper.
+//
+// In client mode it listens for plain datagrams on a local port, transforms
+// them and sends them to a protean-proxy server. In server mode it restores
+// the datagrams it receives and forwards them to an upstream address. Replies
+// flow back along the same path.
+//
+// Usage:
+//
+//	protean-proxy -mode client -listen 127.0.0.1:5000 -remote server:7000 [-config protean.json] [-secret-file secret] [-handshake-key-file server.pub]
+//	protean-proxy -mode server -listen :7000 -remote upstream:5000 [-config protean.json] [-secret-file secret] [-handshake-key-file server.key]
+//
+// The client and server must use the same configuration, except that with a
+// handshake stage, the role and keys of the encryption and handshake sections
+// differ: the server has the private key and the client its public key.
+//
+// Keys need not be kept in the config file. The shared secret given with
+// -secret-file is given to every session with SetKey, and the hex key in the
+// file given with -handshake-key-file replaces the handshake section's
+// privateKey in server mode, or its serverPublicKey in client mode. Leading
+// and trailing whitespace in either file is ignored.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/OperatorFoundation/protean"
+)
+
+func main() {
+	mode := flag.String("mode", "", "client or server")
+	listen := flag.String("listen", "", "UDP address to listen on")
+	remote := flag.String("remote", "", "UDP address of the server (client mode) or upstream (server mode)")
+	configPath := flag.String("config", "", "JSON ProteanConfig file (default: the sample config)")
+	secretPath := flag.String("secret-file", "", "file holding the shared secret given to every session")
+	handshakeKeyPath := flag.String("handshake-key-file", "", "file holding the hex handshake private key (server mode) or server public key (client mode)")
+	idleTimeout := flag.Duration("timeout", 2*time.Minute, "close sessions after this long without traffic")
+	maxSessions := flag.Int("max-sessions", protean.DEFAULT_MAX_SESSIONS, "most peers served at once; the least recently active is dropped to make room")
+	flag.Parse()
+
+	if (*mode != MODE_CLIENT && *mode != MODE_SERVER) || *listen == "" || *remote == "" || *idleTimeout <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sessions, err := sessionManager(*mode, *configPath, *secretPath, *handshakeKeyPath, *idleTimeout, *maxSessions)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	target, err := net.ResolveUDPAddr("udp", *remote)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s listening on %v, relaying to %v", *mode, listener.LocalAddr(), target)
+	err = newRelay(*mode, listener, target, sessions, *idleTimeout).run()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Make the SessionManager for the relay, configured from the file at
+// configPath, or with the sample config if there is no file, and with the
+// keys from the files at secretPath and handshakeKeyPath if they are given.
+// The config is checked up front so that errors are reported at startup.
+func sessionManager(mode string, configPath string, secretPath string, handshakeKeyPath string, idleTimeout time.Duration, maxSessions int) (*protean.SessionManager, error) {
+	config := protean.SampleProteanConfig()
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		config = protean.ProteanConfig{}
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", configPath, protean.ErrMalformedConfig, err)
+		}
+	}
+
+	if handshakeKeyPath != "" {
+		key, err := readKeyFile(handshakeKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if mode == MODE_SERVER {
+			config.Handshake.PrivateKey = string(key)
+		} else {
+			config.Handshake.ServerPublicKey = string(key)
+		}
+	}
+
+	sessions, err := protean.NewSessionManager(config, idleTimeout, maxSessions)
+	if err != nil {
+		return nil, err
+	}
+
+	if secretPath != "" {
+		secret, err := readKeyFile(secretPath)
+		if err != nil {
+			return nil, err
+		}
+
+		err = sessions.SetKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", secretPath, err)
+		}
+	}
+
+	return sessions, nil
+}
+
+// Read a key from a file, without the whitespace around it.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s: empty key", path)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/OperatorFoundation/protean"
+)
+
+const (
+	// Accept plain datagrams locally and send obfuscated ones to the server.
+	MODE_CLIENT = "client"
+
+	// Accept obfuscated datagrams from clients and send plain ones upstream.
+	MODE_SERVER = "server"
+)
+
+// Relays datagrams between the peers of a listening socket and a target
+// address, transforming them in one direction and restoring them in the other.
+// Every source address seen on the listener is given its own Session, and
+// the Session keeps its own socket to the target, so that replies from the
+// target flow back to the right peer. The SessionManager limits the number of
+// peers, and closes a peer's socket when its Session is expired or evicted.
+type relay struct {
+	mode string
+
+	// In server mode, this restores the datagrams read from it and
+	// transforms those written to it.
+	listener net.PacketConn
+
+	target *net.UDPAddr
+
+	sessions *protean.SessionManager
+
+	// Sessions are closed after this long without traffic in either direction.
+	idleTimeout time.Duration
+}
+
+func newRelay(mode string, listener net.PacketConn, target *net.UDPAddr, sessions *protean.SessionManager, idleTimeout time.Duration) *relay {
+	if mode == MODE_SERVER {
+		listener = protean.WrapSessionPacketConn(listener, sessions)
+	}
+
+	return &relay{mode: mode, listener: listener, target: target, sessions: sessions, idleTimeout: idleTimeout}
+}
+
+// Read datagrams from the listener and forward them until the listener is
+// closed. The sessions are disposed of before returning.
+func (this *relay) run() error {
+	defer this.sessions.Dispose()
+
+	buffer := make([]byte, protean.MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := this.listener.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		upstream, err := this.upstream(addr)
+		if err != nil {
+			log.Printf("could not open session for %v: %v", addr, err)
+			continue
+		}
+
+		// In client mode the upstream socket transforms the datagram.
+		_, err = upstream.WriteTo(buffer[:n], this.target)
+		if err != nil {
+			log.Printf("could not write to %v: %v", this.target, err)
+		}
+	}
+}
+
+// Find the socket to the target for a peer, opening it if this is the peer's
+// first datagram.
+func (this *relay) upstream(addr net.Addr) (net.PacketConn, error) {
+	session, err := this.sessions.Get(addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	if attached := session.Attached(); attached != nil {
+		return attached.(net.PacketConn), nil
+	}
+
+	var upstream net.PacketConn
+	upstream, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Packets the client's Session sends of its own accord, such as
+	// handshake messages, go to the server as well.
+	if this.mode == MODE_CLIENT {
+		upstream = protean.WrapPacketConn(upstream, session)
+	}
+
+	err = session.Attach(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	go this.reply(upstream, addr)
+	return upstream, nil
+}
+
+// Forward datagrams from the target back to a peer until the peer's socket is
+// closed with its Session.
+func (this *relay) reply(upstream net.PacketConn, peer net.Addr) {
+	buffer := make([]byte, protean.MAX_DATAGRAM_SIZE)
+	for {
+		upstream.SetReadDeadline(time.Now().Add(this.idleTimeout))
+		n, addr, err := upstream.ReadFrom(buffer)
+		if err != nil {
+			// Expiring the idle sessions closes this socket if the peer has
+			// been idle too, which ends the loop.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				this.sessions.Expire()
+				continue
+			}
+
+			return
+		}
+
+		// The socket is not connected, so that WrapPacketConn can write to
+		// the target with WriteTo, and can be sent datagrams from anywhere.
+		if source, ok := addr.(*net.UDPAddr); !ok || !source.IP.Equal(this.target.IP) || source.Port != this.target.Port {
+			continue
+		}
+
+		// In server mode the listener transforms the datagram.
+		_, err = this.listener.WriteTo(buffer[:n], peer)
+		if err != nil {
+			log.Printf("could not write to %v: %v", peer, err)
+		}
+	}
+}
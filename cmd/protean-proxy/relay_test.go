@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/protean"
+)
+
+func listenLoopback(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Start a relay on loopback and return the address it listens on.
+func startRelay(t *testing.T, mode string, target net.Addr, sessions *protean.SessionManager) net.Addr {
+	listener := listenLoopback(t)
+	go newRelay(mode, listener, target.(*net.UDPAddr), sessions, time.Minute).run()
+	return listener.LocalAddr()
+}
+
+func sampleSessions(t *testing.T) *protean.SessionManager {
+	sessions, err := protean.NewSessionManager(protean.SampleProteanConfig(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sessions
+}
+
+// Write a file in a temporary directory and return its path.
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Send a datagram to the client relay from a new application socket, and
+// return the reply.
+func exchange(t *testing.T, client net.Addr, message string, timeout time.Duration) ([]byte, error) {
+	app := listenLoopback(t)
+	app.SetReadDeadline(time.Now().Add(timeout))
+
+	_, err := app.WriteTo([]byte(message), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, protean.MAX_DATAGRAM_SIZE)
+	n, _, err := app.ReadFrom(buffer)
+	return buffer[:n], err
+}
+
+// Echo datagrams back to their sender, prefixed with "echo:".
+func startEcho(t *testing.T) net.Addr {
+	conn := listenLoopback(t)
+	go func() {
+		buffer := make([]byte, protean.MAX_DATAGRAM_SIZE)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(append([]byte("echo:"), buffer[:n]...), addr)
+		}
+	}()
+
+	return conn.LocalAddr()
+}
+
+// Two applications talk to an echo server through a client and server relay,
+// and each gets its own replies back.
+func TestRelayLoopback(t *testing.T) {
+	echo := startEcho(t)
+	server := startRelay(t, MODE_SERVER, echo, sampleSessions(t))
+	client := startRelay(t, MODE_CLIENT, server, sampleSessions(t))
+
+	for _, name := range []string{"alice", "bob"} {
+		reply, err := exchange(t, client, name, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := []byte("echo:" + name); !bytes.Equal(reply, expected) {
+			t.Errorf("received %q, expected %q", reply, expected)
+		}
+	}
+}
+
+// The relays derive their keys from the secret files, so a client with the
+// wrong secret gets no replies.
+func TestRelaySecretFile(t *testing.T) {
+	configs := make(map[string]string)
+	for _, role := range []string{protean.ROLE_CLIENT, protean.ROLE_SERVER} {
+		config := protean.SampleProteanConfig()
+		config.Encryption = protean.EncryptionConfig{Mode: protean.ENCRYPTION_MODE_AES_256_GCM, Role: role}
+		data, err := json.Marshal(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		configs[role] = writeFile(t, role+".json", data)
+	}
+
+	relaySessions := func(mode string, config string, secret string) *protean.SessionManager {
+		sessions, err := sessionManager(mode, config, writeFile(t, "secret", []byte(secret+"\n")), "", time.Minute, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return sessions
+	}
+
+	echo := startEcho(t)
+	server := startRelay(t, MODE_SERVER, echo, relaySessions(MODE_SERVER, configs[protean.ROLE_SERVER], "correct horse"))
+
+	client := startRelay(t, MODE_CLIENT, server, relaySessions(MODE_CLIENT, configs[protean.ROLE_CLIENT], "correct horse"))
+	if reply, err := exchange(t, client, "alice", 5*time.Second); err != nil || string(reply) != "echo:alice" {
+		t.Fatalf("same secret: received %q: %v", reply, err)
+	}
+
+	wrong := startRelay(t, MODE_CLIENT, server, relaySessions(MODE_CLIENT, configs[protean.ROLE_CLIENT], "battery staple"))
+	if reply, err := exchange(t, wrong, "mallory", 500*time.Millisecond); err == nil {
+		t.Errorf("wrong secret: received %q", reply)
+	}
+
+	if _, err := sessionManager(MODE_CLIENT, configs[protean.ROLE_CLIENT], writeFile(t, "secret", []byte(" \n")), "", time.Minute, 0); err == nil {
+		t.Error("accepted an empty secret")
+	}
+}
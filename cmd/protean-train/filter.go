@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A UDP datagram read from a capture.
+type datagram struct {
+	source      net.IP
+	destination net.IP
+
+	sourcePort      uint16
+	destinationPort uint16
+
+	payload []byte
+}
+
+// Decides whether a datagram is used for training.
+type filter func(packet datagram) bool
+
+// Parse a filter expression in a subset of the BPF syntax used by tcpdump.
+// The primitives are:
+//
+//	udp, ip, ip6
+//	[src|dst] port N
+//	[src|dst] portrange N-M
+//	[src|dst] host ADDRESS
+//	[src|dst] net CIDR
+//
+// A bare number is taken as "port N", and a protocol may qualify the
+// primitive following it, as in "udp port 53". Primitives can be combined with and, or
+// and not (or &&, || and !) and grouped with parentheses. An empty expression
+// accepts every datagram.
+func parseFilter(expression string) (filter, error) {
+	expression = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expression)
+	parser := &filterParser{tokens: strings.Fields(expression)}
+	if len(parser.tokens) == 0 {
+		return func(datagram) bool { return true }, nil
+	}
+
+	result, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if token, ok := parser.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q in filter", token)
+	}
+
+	return result, nil
+}
+
+// A recursive descent parser over the tokens of a filter expression.
+type filterParser struct {
+	tokens []string
+}
+
+func (this *filterParser) peek() (string, bool) {
+	if len(this.tokens) == 0 {
+		return "", false
+	}
+
+	return this.tokens[0], true
+}
+
+func (this *filterParser) next() (string, error) {
+	token, ok := this.peek()
+	if !ok {
+		return "", fmt.Errorf("filter ends unexpectedly")
+	}
+
+	this.tokens = this.tokens[1:]
+	return token, nil
+}
+
+// Consume the next token if it is one of the given alternatives.
+func (this *filterParser) accept(alternatives ...string) bool {
+	token, ok := this.peek()
+	if !ok {
+		return false
+	}
+
+	for _, alternative := range alternatives {
+		if token == alternative {
+			this.tokens = this.tokens[1:]
+			return true
+		}
+	}
+
+	return false
+}
+
+// or := and ("or" and)*
+func (this *filterParser) or() (filter, error) {
+	left, err := this.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for this.accept("or", "||") {
+		right, err := this.and()
+		if err != nil {
+			return nil, err
+		}
+
+		previous := left
+		left = func(packet datagram) bool { return previous(packet) || right(packet) }
+	}
+
+	return left, nil
+}
+
+// and := not ("and" not)*
+func (this *filterParser) and() (filter, error) {
+	left, err := this.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for this.accept("and", "&&") {
+		right, err := this.not()
+		if err != nil {
+			return nil, err
+		}
+
+		previous := left
+		left = func(packet datagram) bool { return previous(packet) && right(packet) }
+	}
+
+	return left, nil
+}
+
+// not := ("not" not) | "(" or ")" | primitive
+func (this *filterParser) not() (filter, error) {
+	if this.accept("not", "!") {
+		inner, err := this.not()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(packet datagram) bool { return !inner(packet) }, nil
+	}
+
+	if this.accept("(") {
+		inner, err := this.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if !this.accept(")") {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+
+		return inner, nil
+	}
+
+	return this.primitive()
+}
+
+// primitive := ("udp" | "ip" | "ip6") [primitive] | [direction] kind value
+func (this *filterParser) primitive() (filter, error) {
+	token, err := this.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var protocol filter
+	switch token {
+	case "udp":
+		protocol = func(datagram) bool { return true }
+	case "ip":
+		protocol = func(packet datagram) bool { return packet.source.To4() != nil }
+	case "ip6":
+		protocol = func(packet datagram) bool { return packet.source.To4() == nil }
+	}
+
+	if protocol != nil {
+		// A protocol may qualify the primitive after it, as in "udp port 53".
+		following, ok := this.peek()
+		switch {
+		case !ok, following == "and", following == "&&", following == "or", following == "||", following == ")":
+			return protocol, nil
+		}
+
+		qualified, err := this.primitive()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(packet datagram) bool { return protocol(packet) && qualified(packet) }, nil
+	}
+
+	// Which ends of the datagram a primitive applies to.
+	matchSource, matchDestination := true, true
+	if token == "src" || token == "dst" {
+		matchSource, matchDestination = token == "src", token == "dst"
+		token, err = this.next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A bare number is a port.
+	kind, value := token, token
+	if _, err := strconv.ParseUint(token, 10, 16); err == nil {
+		kind = "port"
+	} else {
+		value, err = this.next()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Make a filter that applies match to the selected ends.
+	either := func(match func(address net.IP, port uint16) bool) filter {
+		return func(packet datagram) bool {
+			return (matchSource && match(packet.source, packet.sourcePort)) ||
+				(matchDestination && match(packet.destination, packet.destinationPort))
+		}
+	}
+
+	switch kind {
+	case "port":
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in filter", value)
+		}
+
+		return either(func(_ net.IP, candidate uint16) bool { return candidate == uint16(port) }), nil
+	case "portrange":
+		low, high, found := strings.Cut(value, "-")
+		first, err := strconv.ParseUint(low, 10, 16)
+		if err != nil || !found {
+			return nil, fmt.Errorf("invalid port range %q in filter", value)
+		}
+
+		last, err := strconv.ParseUint(high, 10, 16)
+		if err != nil || last < first {
+			return nil, fmt.Errorf("invalid port range %q in filter", value)
+		}
+
+		return either(func(_ net.IP, candidate uint16) bool {
+			return uint64(candidate) >= first && uint64(candidate) <= last
+		}), nil
+	case "host":
+		host := net.ParseIP(value)
+		if host == nil {
+			return nil, fmt.Errorf("invalid address %q in filter", value)
+		}
+
+		return either(func(address net.IP, _ uint16) bool { return host.Equal(address) }), nil
+	case "net":
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in filter", value)
+		}
+
+		return either(func(address net.IP, _ uint16) bool { return network.Contains(address) }), nil
+	default:
+		return nil, fmt.Errorf("unknown filter primitive %q", kind)
+	}
+}
@@ -0,0 +1,130 @@
+// Command protean-train builds the frequency tables of a decompression stage
+// from captured traffic, so that shaped packets mimic a real protocol.
+//
+// It reads a pcap or pcapng file, selects UDP datagrams with a filter in a
+// subset of the tcpdump syntax, counts the bytes of their payloads and writes
+// the resulting DecompressionConfig as JSON. With -order, it also counts the
+// bytes following each context of up to that many preceding bytes, so that
+// the shaped packets follow the n-gram statistics of the capture. With
+// -positions, each of that many leading offsets gets a table of its own, so
+// that the start of each shaped packet looks like the protocol's header. With
+// -precision 16, the frequencies keep 16 bits rather than 8, so that skewed
+// distributions are mimicked more closely. With -base, the decompression
+// section of an existing ProteanConfig is replaced and the whole config is
+// written instead.
+//
+// Usage:
+//
+//	protean-train -input capture.pcapng [-filter "udp port 53"] [-order 1] [-positions 12] [-precision 16] [-base protean.json] [-output trained.json]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/OperatorFoundation/protean"
+)
+
+func main() {
+	input := flag.String("input", "", "pcap or pcapng file to read")
+	expression := flag.String("filter", "", "which UDP datagrams to use, such as \"udp port 53 and not host 10.0.0.1\"")
+	order := flag.Int("order", 0, fmt.Sprintf("number of preceding bytes to condition the frequencies on, from 0 to %d", protean.MAX_CONTEXT_ORDER))
+	floor := flag.Uint("floor", 0, fmt.Sprintf("lowest frequency for any byte, from 0 to %d; with 0 only the bytes seen are produced", MAX_FLOOR))
+	positions := flag.Int("positions", 0, "number of leading offsets to give tables of their own")
+	precision := flag.Int("precision", protean.FREQUENCY_PRECISION_STANDARD, fmt.Sprintf("bits per frequency, %d or %d", protean.FREQUENCY_PRECISION_STANDARD, protean.FREQUENCY_PRECISION_HIGH))
+	minimumSamples := flag.Uint64("min-samples", 64, "bytes a context or offset must be seen with to get its own table")
+	basePath := flag.String("base", "", "ProteanConfig file whose decompression section is replaced")
+	outputPath := flag.String("output", "", "file to write (default: standard output)")
+	flag.Parse()
+
+	if *input == "" || *order < 0 || *order > protean.MAX_CONTEXT_ORDER || *positions < 0 || *floor > MAX_FLOOR ||
+		(*precision != protean.FREQUENCY_PRECISION_STANDARD && *precision != protean.FREQUENCY_PRECISION_HIGH) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	accept, err := parseFilter(*expression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	capture, err := os.Open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer capture.Close()
+
+	counted := newStatistics(*order, *positions)
+	err = readDatagrams(capture, accept, func(packet datagram) {
+		counted.add(packet.payload)
+	})
+	if err != nil {
+		log.Fatalf("%s: %v", *input, err)
+	}
+
+	log.Printf("counted %d payloads from %s", counted.payloads, *input)
+
+	config, err := counted.config(uint32(*floor), *minimumSamples, *precision)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	output, err := render(config, *basePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *outputPath == "" {
+		_, err = os.Stdout.Write(output)
+	} else {
+		err = os.WriteFile(*outputPath, output, 0644)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Serialise the trained config, into the ProteanConfig at basePath if there is
+// one. The result is checked by the same validation the shaper applies.
+func render(config protean.DecompressionConfig, basePath string) ([]byte, error) {
+	if basePath == "" {
+		err := (&protean.DecompressionShaper{}).ConfigureStruct(config)
+		if err != nil {
+			return nil, err
+		}
+
+		return marshal(config)
+	}
+
+	data, err := os.ReadFile(basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var base protean.ProteanConfig
+	err = json.Unmarshal(data, &base)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", basePath, err)
+	}
+
+	base.Decompression = config
+	err = base.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", basePath, err)
+	}
+
+	return marshal(base)
+}
+
+func marshal(value interface{}) ([]byte, error) {
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(output, '\n'), nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/OperatorFoundation/protean"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// The magic number at the start of a pcapng file.
+const PCAPNG_MAGIC = 0x0A0D0D0A
+
+// The largest frequency adjustProbs accepts for a single byte.
+const MAX_FREQUENCY = 255
+
+// The largest frequency for a single byte with FREQUENCY_PRECISION_HIGH.
+const MAX_HIGH_PRECISION_FREQUENCY = 65535
+
+// The largest floor for the frequencies, which leaves at least half of the
+// total for the counts.
+const MAX_FLOOR = 31
+
+// Read the UDP datagrams from a pcap or pcapng capture, passing those accepted
+// by the filter to handle.
+func readDatagrams(reader io.Reader, accept filter, handle func(packet datagram)) error {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return fmt.Errorf("reading capture: %w", err)
+	}
+
+	var source *gopacket.PacketSource
+	if binary.LittleEndian.Uint32(magic) == PCAPNG_MAGIC {
+		ngReader, err := pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return err
+		}
+
+		source = gopacket.NewPacketSource(ngReader, ngReader.LinkType())
+	} else {
+		pcapReader, err := pcapgo.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+
+		source = gopacket.NewPacketSource(pcapReader, pcapReader.LinkType())
+	}
+
+	source.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for {
+		packet, err := source.NextPacket()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok {
+			continue
+		}
+
+		candidate := datagram{sourcePort: uint16(udp.SrcPort), destinationPort: uint16(udp.DstPort), payload: udp.Payload}
+		switch network := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			candidate.source, candidate.destination = network.SrcIP, network.DstIP
+		case *layers.IPv6:
+			candidate.source, candidate.destination = network.SrcIP, network.DstIP
+		default:
+			continue
+		}
+
+		if accept(candidate) {
+			handle(candidate)
+		}
+	}
+}
+
+// Byte counts gathered from the payloads of datagrams.
+type statistics struct {
+	// The number of preceding bytes that contexts are conditioned on.
+	order int
+
+	// The number of leading offsets counted separately.
+	positions int
+
+	// The number of payloads counted.
+	payloads int
+
+	// The count of each byte value over all payloads.
+	counts [256]uint64
+
+	// The count of each byte value past the leading offsets.
+	tailCounts [256]uint64
+
+	// The count of each byte value at each of the leading offsets.
+	offsets [][256]uint64
+
+	// The counts of each byte value following each context, keyed by the
+	// preceding bytes. Contexts shorter than the order are the starts of
+	// payloads.
+	contexts map[string]*[256]uint64
+}
+
+func newStatistics(order int, positions int) *statistics {
+	return &statistics{order: order, positions: positions, contexts: make(map[string]*[256]uint64), offsets: make([][256]uint64, positions)}
+}
+
+// Count the bytes of a payload.
+func (this *statistics) add(payload []byte) {
+	this.payloads++
+	for index, b := range payload {
+		this.counts[b]++
+
+		// The leading offsets have tables of their own, used in place of
+		// the contexts.
+		if index < this.positions {
+			this.offsets[index][b]++
+			continue
+		}
+
+		this.tailCounts[b]++
+		if this.order == 0 {
+			continue
+		}
+
+		context := string(payload[max(0, index-this.order):index])
+		counts, ok := this.contexts[context]
+		if !ok {
+			counts = &[256]uint64{}
+			this.contexts[context] = counts
+		}
+
+		counts[b]++
+	}
+}
+
+// Make the config for a decompression stage from the counts.
+// Every byte is given at least floor, so that with a floor of zero only the
+// bytes seen can be produced. Contexts and offsets seen fewer than
+// minimumSamples times are left to the overall frequencies. The frequencies
+// are scaled to the given precision, one of the FREQUENCY_PRECISION constants.
+func (this *statistics) config(floor uint32, minimumSamples uint64, precision int) (protean.DecompressionConfig, error) {
+	// The overall frequencies are for the bytes past the leading offsets,
+	// unless there are too few of them.
+	frequencies := scaleFrequencies(this.tailCounts[:], floor, precision)
+	if nonzero(frequencies) < 2 {
+		frequencies = scaleFrequencies(this.counts[:], floor, precision)
+	}
+
+	if nonzero(frequencies) < 2 {
+		return protean.DecompressionConfig{}, fmt.Errorf("the capture has fewer than two distinct bytes, so cannot be mimicked")
+	}
+
+	config := protean.DecompressionConfig{Frequencies: frequencies}
+	if precision != protean.FREQUENCY_PRECISION_STANDARD {
+		config.Precision = precision
+	}
+
+	for offset, counts := range this.offsets {
+		if total(counts[:]) < minimumSamples {
+			continue
+		}
+
+		table := informative(scaleFrequencies(counts[:], floor, precision), frequencies)
+		config.Ranges = append(config.Ranges, protean.FrequencyRange{Start: offset, End: offset + 1, Frequencies: table})
+	}
+
+	if this.order == 0 {
+		return config, nil
+	}
+
+	config.Order = this.order
+	config.Contexts = make(map[string][]uint32)
+	for context, counts := range this.contexts {
+		if total(counts[:]) < minimumSamples {
+			continue
+		}
+
+		table := informative(scaleFrequencies(counts[:], floor, precision), frequencies)
+		config.Contexts[hex.EncodeToString([]byte(context))] = table
+	}
+
+	return config, nil
+}
+
+// A table with a single possible byte would carry no information, so give the
+// byte most frequent overall after it the least chance of occurring instead.
+func informative(table []uint32, overall []uint32) []uint32 {
+	if nonzero(table) >= 2 {
+		return table
+	}
+
+	alternative := -1
+	for index, frequency := range overall {
+		if table[index] == 0 && (alternative < 0 || frequency > overall[alternative]) {
+			alternative = index
+		}
+	}
+
+	table[alternative] = 1
+	return table
+}
+
+// The sum of counts.
+func total(counts []uint64) uint64 {
+	var result uint64
+	for _, count := range counts {
+		result = result + count
+	}
+
+	return result
+}
+
+// Scale counts to frequencies that the coder accepts unchanged at the given
+// precision: with FREQUENCY_PRECISION_STANDARD, none above MAX_FREQUENCY and a
+// total below MAX_TOTAL_FREQUENCY, and with FREQUENCY_PRECISION_HIGH, none
+// above MAX_HIGH_PRECISION_FREQUENCY and a total below
+// MAX_HIGH_PRECISION_TOTAL. Each byte is given at least floor, and each byte
+// that was counted at least 1.
+func scaleFrequencies(counts []uint64, floor uint32, precision int) []uint32 {
+	floor = min(floor, MAX_FLOOR)
+
+	highestFrequency, totalFrequency := uint64(MAX_FREQUENCY), uint64(protean.MAX_TOTAL_FREQUENCY)
+	if precision == protean.FREQUENCY_PRECISION_HIGH {
+		highestFrequency, totalFrequency = MAX_HIGH_PRECISION_FREQUENCY, uint64(protean.MAX_HIGH_PRECISION_TOTAL)
+	}
+
+	var highest, total uint64
+	for _, count := range counts {
+		highest = max(highest, count)
+		total = total + count
+	}
+
+	frequencies := make([]uint32, len(counts))
+	if total == 0 {
+		for index := range frequencies {
+			frequencies[index] = floor
+		}
+
+		return frequencies
+	}
+
+	// Leave room for the floor, or the 1 given to each byte counted, under
+	// both limits.
+	reserved := uint64(max(floor, 1))
+	limit := min(float64(highestFrequency-reserved)/float64(highest), float64(totalFrequency-1-reserved*uint64(len(counts)))/float64(total))
+
+	for index, count := range counts {
+		frequency := uint32(float64(count) * limit)
+		if count > 0 {
+			frequency = max(frequency, 1)
+		}
+
+		frequencies[index] = max(frequency, floor)
+	}
+
+	return frequencies
+}
+
+// The number of nonzero frequencies.
+func nonzero(frequencies []uint32) int {
+	var result int
+	for _, frequency := range frequencies {
+		if frequency != 0 {
+			result++
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/protean"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Serialise an Ethernet frame carrying a UDP datagram.
+func udpFrame(t *testing.T, source string, sourcePort uint16, destination string, destinationPort uint16, payload []byte) []byte {
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(source).To4(),
+		DstIP:    net.ParseIP(destination).To4(),
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(sourcePort), DstPort: layers.UDPPort(destinationPort)}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, ethernet, ip, udp, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// A capture of DNS-like queries to port 53, and some other traffic to port 9.
+func testFrames(t *testing.T) [][]byte {
+	var frames [][]byte
+	for index := 0; index < 50; index++ {
+		frames = append(frames, udpFrame(t, "10.0.0.1", 40000, "10.0.0.53", 53, []byte("abcabcabd")))
+		frames = append(frames, udpFrame(t, "10.0.0.1", 40000, "10.0.0.9", 9, []byte{0xFF, 0xFE, 0xFD}))
+	}
+
+	return frames
+}
+
+func writePcap(t *testing.T, frames [][]byte) []byte {
+	var capture bytes.Buffer
+	writer := pcapgo.NewWriter(&capture)
+	err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frame := range frames {
+		info := gopacket.CaptureInfo{Timestamp: time.Unix(0, 0), CaptureLength: len(frame), Length: len(frame)}
+		if err := writer.WritePacket(info, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return capture.Bytes()
+}
+
+func writePcapng(t *testing.T, frames [][]byte) []byte {
+	var capture bytes.Buffer
+	writer, err := pcapgo.NewNgWriter(&capture, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frame := range frames {
+		info := gopacket.CaptureInfo{Timestamp: time.Unix(0, 0), CaptureLength: len(frame), Length: len(frame)}
+		if err := writer.WritePacket(info, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return capture.Bytes()
+}
+
+// Both capture formats are read, and only the selected datagrams are counted.
+func TestTrainFromCapture(t *testing.T) {
+	frames := testFrames(t)
+	accept, err := parseFilter("udp dst port 53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, capture := range map[string][]byte{"pcap": writePcap(t, frames), "pcapng": writePcapng(t, frames)} {
+		counted := newStatistics(1, 0)
+		err := readDatagrams(bytes.NewReader(capture), accept, func(packet datagram) {
+			counted.add(packet.payload)
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if counted.payloads != 50 {
+			t.Fatalf("%s: counted %d payloads, expected 50", name, counted.payloads)
+		}
+
+		config, err := counted.config(0, 1, protean.FREQUENCY_PRECISION_STANDARD)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for b, frequency := range config.Frequencies {
+			if seen := b >= 'a' && b <= 'd'; seen != (frequency != 0) {
+				t.Errorf("%s: byte %q has frequency %d", name, byte(b), frequency)
+			}
+		}
+
+		if config.Frequencies['a'] <= config.Frequencies['d'] {
+			t.Errorf("%s: 'a' is no more frequent than 'd'", name)
+		}
+
+		// Payloads always start with 'a', but the other bytes are given a
+		// small chance so that the table still carries information.
+		if start := config.Contexts[""]; start['a'] < 100*start['b'] || start['b'] == 0 {
+			t.Errorf("%s: unexpected table for the start of a payload", name)
+		}
+
+		if afterB := config.Contexts["62"]; afterB['c'] == 0 || afterB['d'] == 0 || afterB['a'] != 0 {
+			t.Errorf("%s: unexpected table after 'b'", name)
+		}
+
+		shaper := &protean.DecompressionShaper{}
+		if err := shaper.ConfigureStruct(config); err != nil {
+			t.Errorf("%s: trained config is rejected: %v", name, err)
+		}
+	}
+}
+
+// Each leading offset gets a table of its own, and the overall frequencies
+// come from the bytes after them.
+func TestTrainPositions(t *testing.T) {
+	counted := newStatistics(0, 2)
+	for index := 0; index < 10; index++ {
+		counted.add([]byte{0x80, byte(index), 'x', 'y'})
+	}
+
+	config, err := counted.config(0, 10, protean.FREQUENCY_PRECISION_STANDARD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Ranges) != 2 || config.Ranges[1].Start != 1 || config.Ranges[1].End != 2 {
+		t.Fatalf("unexpected ranges %+v", config.Ranges)
+	}
+
+	// The fixed first byte is almost certain.
+	first := config.Ranges[0].Frequencies
+	if nonzero(first) != 2 || first[0x80] < 100*(sum(first)-first[0x80]) {
+		t.Errorf("unexpected table for the first offset")
+	}
+
+	if nonzero(config.Ranges[1].Frequencies) != 10 {
+		t.Errorf("unexpected table for the second offset")
+	}
+
+	if nonzero(config.Frequencies) != 2 || config.Frequencies['x'] == 0 || config.Frequencies['y'] == 0 {
+		t.Errorf("unexpected overall frequencies")
+	}
+
+	shaper := &protean.DecompressionShaper{}
+	if err := shaper.ConfigureStruct(config); err != nil {
+		t.Errorf("trained config is rejected: %v", err)
+	}
+}
+
+func sum(frequencies []uint32) uint32 {
+	var result uint32
+	for _, frequency := range frequencies {
+		result = result + frequency
+	}
+
+	return result
+}
+
+// Scaled frequencies keep their proportions within the limits of the coder.
+func TestScaleFrequencies(t *testing.T) {
+	counts := make([]uint64, 256)
+	counts[0] = 1000000
+	counts[1] = 500000
+	counts[2] = 1
+
+	for _, floor := range []uint32{0, 1, 8} {
+		frequencies := scaleFrequencies(counts, floor, protean.FREQUENCY_PRECISION_STANDARD)
+		var total uint32
+		for index, frequency := range frequencies {
+			total = total + frequency
+			if frequency > MAX_FREQUENCY {
+				t.Errorf("floor %d: byte %d has frequency %d", floor, index, frequency)
+			}
+
+			if frequency < floor || (counts[index] > 0 && frequency == 0) {
+				t.Errorf("floor %d: byte %d has frequency %d", floor, index, frequency)
+			}
+		}
+
+		if total >= protean.MAX_TOTAL_FREQUENCY {
+			t.Errorf("floor %d: total %d is too high", floor, total)
+		}
+
+		if frequencies[0] < 2*frequencies[1]-1 || frequencies[0] > 2*frequencies[1]+1 {
+			t.Errorf("floor %d: proportions lost: %d and %d", floor, frequencies[0], frequencies[1])
+		}
+	}
+
+	// With high precision, the frequencies fill the larger total instead.
+	frequencies := scaleFrequencies(counts, 0, protean.FREQUENCY_PRECISION_HIGH)
+	if total := sum(frequencies); total >= protean.MAX_HIGH_PRECISION_TOTAL || total < protean.MAX_HIGH_PRECISION_TOTAL/2 {
+		t.Errorf("high precision: total %d is out of range", total)
+	}
+
+	if frequencies[2] != 1 || frequencies[0] < 2*frequencies[1]-1 || frequencies[0] > 2*frequencies[1]+1 {
+		t.Errorf("high precision: proportions lost: %v", frequencies[:3])
+	}
+}
+
+func TestFilter(t *testing.T) {
+	packet := datagram{
+		source:          net.ParseIP("10.0.0.1"),
+		destination:     net.ParseIP("192.168.1.53"),
+		sourcePort:      40000,
+		destinationPort: 53,
+	}
+
+	tests := map[string]bool{
+		"":                                 true,
+		"udp":                              true,
+		"port 53":                          true,
+		"53":                               true,
+		"src port 53":                      false,
+		"dst 53":                           true,
+		"portrange 50-60":                  true,
+		"src portrange 50-60":              false,
+		"host 10.0.0.1":                    true,
+		"dst host 10.0.0.1":                false,
+		"net 192.168.0.0/16":               true,
+		"ip":                               true,
+		"ip6":                              false,
+		"udp port 53 and not host 1.2.3.4": true,
+		"port 54 or port 40000":            true,
+		"!(port 53)":                       false,
+		"port 53 && (host 1.2.3.4 || src net 10.0.0.0/8)": true,
+	}
+
+	for expression, expected := range tests {
+		accept, err := parseFilter(expression)
+		if err != nil {
+			t.Errorf("%q: %v", expression, err)
+			continue
+		}
+
+		if accept(packet) != expected {
+			t.Errorf("%q: expected %v", expression, expected)
+		}
+	}
+
+	for _, expression := range []string{"port", "port x", "(port 53", "port 53 port 54", "portrange 9-1", "frob 3"} {
+		if _, err := parseFilter(expression); err == nil {
+			t.Errorf("%q: expected an error", expression)
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package protean
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+)
+
+// The largest number of preceding bytes a Model can condition on.
+const MAX_CONTEXT_ORDER = 3
+
+// The limit on the total of the frequencies in a table, as required by the
+// precision of the coder.
+const MAX_TOTAL_FREQUENCY uint32 = 16384
+
+// The limit on the total of the frequencies in a table with
+// FREQUENCY_PRECISION_HIGH. The coder keeps at least 2^23 values in its range,
+// so this still leaves each unit of frequency 2^7 values.
+const MAX_HIGH_PRECISION_TOTAL uint32 = 1 << 16
+
+// Precisions of the frequencies in a Model, as bits per frequency.
+const (
+	// Frequencies of up to 255 with a total below MAX_TOTAL_FREQUENCY, as
+	// produced by adjustProbs. This is the default.
+	FREQUENCY_PRECISION_STANDARD = 8
+
+	// Frequencies of up to 16 bits with a total below
+	// MAX_HIGH_PRECISION_TOTAL, so that rare bytes can be given much lower
+	// probabilities, and common bytes much higher ones.
+	FREQUENCY_PRECISION_HIGH = 16
+)
+
+// The amount added to the frequency of a symbol each time an adaptive Model
+// codes it.
+const ADAPTIVE_INCREMENT uint32 = 16
+
+// Marks the key of a position range, distinguishing it from a contextKey.
+const RANGE_KEY uint32 = 1 << 31
+
+// The highest frequency an adaptive Model will give a symbol, which bounds how
+// much a packet can expand however skewed it becomes.
+const MAX_ADAPTIVE_FREQUENCY uint32 = 255
+
+// The limits on the frequencies in the tables of a Model.
+type frequencyLimits struct {
+	// The limit on the total of the frequencies.
+	maxTotal uint32
+
+	// The amount an adaptive Model adds to a frequency, and the highest
+	// frequency it will give.
+	adaptiveIncrement uint32
+	adaptiveLimit     uint32
+}
+
+var standardLimits = &frequencyLimits{
+	maxTotal:          MAX_TOTAL_FREQUENCY,
+	adaptiveIncrement: ADAPTIVE_INCREMENT,
+	adaptiveLimit:     MAX_ADAPTIVE_FREQUENCY,
+}
+
+// The same proportions of the total as the standard limits.
+var highPrecisionLimits = &frequencyLimits{
+	maxTotal:          MAX_HIGH_PRECISION_TOTAL,
+	adaptiveIncrement: ADAPTIVE_INCREMENT * 4,
+	adaptiveLimit:     (MAX_ADAPTIVE_FREQUENCY + 1) * 4,
+}
+
+// The limits for a precision, nil if it is not one of the
+// FREQUENCY_PRECISION constants. Zero selects the standard precision.
+func precisionLimits(precision int) *frequencyLimits {
+	switch precision {
+	case 0, FREQUENCY_PRECISION_STANDARD:
+		return standardLimits
+	case FREQUENCY_PRECISION_HIGH:
+		return highPrecisionLimits
+	default:
+		return nil
+	}
+}
+
+// Scale frequencies to fit within the limits.
+func (this *frequencyLimits) scale(frequencies []uint32) []uint32 {
+	if this == standardLimits {
+		return adjustProbs(frequencies)
+	}
+
+	var total uint64
+	var nonzero uint64
+	for _, frequency := range frequencies {
+		total = total + uint64(frequency)
+		if frequency != 0 {
+			nonzero++
+		}
+	}
+
+	if total < uint64(this.maxTotal) {
+		return frequencies
+	}
+
+	// Scale down in proportion, rounding down but keeping every nonzero
+	// frequency above zero, which adds at most one to each.
+	available := uint64(this.maxTotal) - 1 - nonzero
+	results := make([]uint32, len(frequencies))
+	for index, frequency := range frequencies {
+		if frequency != 0 {
+			results[index] = uint32(uint64(frequency)*available/total) + 1
+		}
+	}
+
+	return results
+}
+
+// The frequencies of the 256 byte values, with the intervals they occupy in the
+// coding space.
+type frequencyTable struct {
+	limits *frequencyLimits
+
+	frequencies [256]uint32
+
+	// The low end of the interval of each symbol, followed by the total.
+	cumulative [257]uint32
+
+	// The highest symbol with a nonzero frequency. Its interval extends to the
+	// top of the range, so it also covers any rounding left over.
+	last uint8
+
+	// The symbol at the start of each of 256 equal slices of the coding
+	// space, each 2^slice values long, so that symbolAt only has to search
+	// within one slice.
+	slices [256]uint8
+	slice  uint32
+}
+
+func newFrequencyTable(frequencies []uint32, limits *frequencyLimits) *frequencyTable {
+	table := &frequencyTable{limits: limits}
+	copy(table.frequencies[:], limits.scale(frequencies))
+	table.rebuild()
+	return table
+}
+
+// Recompute the intervals from the frequencies.
+func (this *frequencyTable) rebuild() {
+	var low uint32
+	for symbol, frequency := range this.frequencies {
+		this.cumulative[symbol] = low
+		low = low + frequency
+		if frequency != 0 {
+			this.last = uint8(symbol)
+		}
+	}
+
+	this.cumulative[256] = low
+
+	this.slice = 0
+	for low > 256<<this.slice {
+		this.slice++
+	}
+
+	symbol := 0
+	for index := range this.slices {
+		start := uint32(index) << this.slice
+		for symbol < 255 && this.cumulative[symbol+1] <= start {
+			symbol++
+		}
+
+		this.slices[index] = uint8(symbol)
+	}
+}
+
+// The total of the frequencies.
+func (this *frequencyTable) total() uint32 {
+	return this.cumulative[256]
+}
+
+// The interval for a symbol.
+func (this *frequencyTable) interval(symbol uint8) Interval {
+	return makeInterval(symbol, this.cumulative[symbol], this.frequencies[symbol])
+}
+
+// The interval containing value, which is an offset into the coding space
+// scaled to the total.
+func (this *frequencyTable) symbolAt(value uint32) Interval {
+	if value >= this.cumulative[this.last] {
+		return this.interval(this.last)
+	}
+
+	// Search the slice containing value for the first symbol whose interval
+	// ends after it. Symbols with a zero frequency have empty intervals, so
+	// are never found.
+	symbol := this.slices[value>>this.slice]
+	for this.cumulative[symbol+1] <= value {
+		symbol++
+	}
+
+	return this.interval(symbol)
+}
+
+// Make a symbol more probable, as an adaptive Model does after coding it.
+// Symbols with a zero frequency are never coded, so they stay at zero.
+func (this *frequencyTable) increment(symbol uint8) {
+	if this.frequencies[symbol] == 0 {
+		return
+	}
+
+	limits := this.limits
+	if this.frequencies[symbol] < limits.adaptiveLimit {
+		this.frequencies[symbol] = min(this.frequencies[symbol]+limits.adaptiveIncrement, limits.adaptiveLimit)
+	}
+
+	// Halve the frequencies when the total grows too large, keeping those that
+	// are nonzero above zero.
+	if this.total()+limits.adaptiveIncrement >= limits.maxTotal {
+		for index, frequency := range this.frequencies {
+			if frequency != 0 {
+				this.frequencies[index] = (frequency + 1) / 2
+			}
+		}
+	}
+
+	this.rebuild()
+}
+
+// The fewest bits of input that coding one symbol from this table can consume.
+// The coder expands its input the most when every symbol it produces is the
+// most probable one.
+func (this *frequencyTable) minimumBits(adaptive bool) float64 {
+	highest := max(this.frequencies[:])
+	var nonzero uint32
+	for _, frequency := range this.frequencies {
+		if frequency != 0 {
+			nonzero++
+		}
+	}
+
+	if !adaptive {
+		return math.Log2(float64(this.total()) / float64(highest))
+	}
+
+	// Adapting can raise the most probable symbol to the adaptive limit and
+	// halve each of the others down to 1.
+	if highest < this.limits.adaptiveLimit {
+		highest = this.limits.adaptiveLimit
+	}
+
+	return math.Log2(float64(highest+nonzero-1) / float64(highest))
+}
+
+// A probability model for the arithmetic coder, giving the frequencies used
+// to code each symbol.
+//
+// An order-0 Model uses the same frequencies for every byte. A Model of higher
+// order conditions them on up to MAX_CONTEXT_ORDER preceding bytes, so that the
+// coded bytes follow the n-gram statistics of a target protocol rather than
+// only its byte distribution. An adaptive Model also makes each symbol more
+// probable every time it is coded.
+//
+// A Model can also have tables for ranges of positions in the sequence, so
+// that its first bytes can follow the distribution of a protocol header while
+// the rest follow that of its payload. In a range, its table is used in place
+// of any context.
+//
+// The state of a Model is reset at the start of each sequence, so an Encoder
+// and a Decoder with the same Model stay in sync however many sequences are
+// lost or reordered between them.
+type Model struct {
+	limits *frequencyLimits
+
+	order int
+
+	adaptive bool
+
+	// The frequencies used when no context has its own table.
+	base *frequencyTable
+
+	// The tables for particular contexts, by contextKey.
+	contexts map[uint32]*frequencyTable
+
+	// The tables for ranges of positions, in order.
+	ranges []positionTable
+}
+
+// A frequency table for a range of positions in a sequence.
+type FrequencyRange struct {
+	// The position of the first byte the table applies to.
+	Start int `json:"start"`
+
+	// The position after the last byte the table applies to, or zero for the
+	// rest of the sequence.
+	End int `json:"end,omitempty"`
+
+	// The relative frequency of each of the 256 byte values.
+	Frequencies []uint32 `json:"frequencies"`
+}
+
+type positionTable struct {
+	start int
+	end   int
+	table *frequencyTable
+}
+
+// Use the given frequencies for a range of positions.
+// Ranges must be added in order and must not overlap, and they must all be
+// added before the Model is used.
+func (this *Model) AddRange(positions FrequencyRange) error {
+	if positions.Start < 0 || (positions.End != 0 && positions.End <= positions.Start) {
+		return fmt.Errorf("range from %d to %d is empty", positions.Start, positions.End)
+	}
+
+	if count := len(this.ranges); count > 0 {
+		previous := this.ranges[count-1]
+		if previous.end == 0 || positions.Start < previous.end {
+			return fmt.Errorf("range starting at %d overlaps the range before it", positions.Start)
+		}
+	}
+
+	if len(positions.Frequencies) != 256 {
+		return fmt.Errorf("range starting at %d has %d frequencies, expected 256", positions.Start, len(positions.Frequencies))
+	}
+
+	this.ranges = append(this.ranges, positionTable{start: positions.Start, end: positions.End, table: newFrequencyTable(positions.Frequencies, this.limits)})
+	return nil
+}
+
+// Make an order-0 Model with the given frequencies for every byte.
+func NewModel(frequencies []uint32) *Model {
+	return &Model{limits: standardLimits, base: newFrequencyTable(frequencies, standardLimits)}
+}
+
+// Make a Model of the given order, using the tables in contexts where the
+// preceding bytes match their key, and frequencies elsewhere.
+// Each key is the preceding bytes in hex, oldest first. A key shorter than the
+// order applies at the start of a sequence, before there are enough preceding
+// bytes.
+func NewContextModel(frequencies []uint32, order int, contexts map[string][]uint32, adaptive bool) (*Model, error) {
+	return NewPrecisionModel(FREQUENCY_PRECISION_STANDARD, frequencies, order, contexts, adaptive)
+}
+
+// Make a Model as NewContextModel does, with frequencies of the given
+// precision, one of the FREQUENCY_PRECISION constants.
+func NewPrecisionModel(precision int, frequencies []uint32, order int, contexts map[string][]uint32, adaptive bool) (*Model, error) {
+	limits := precisionLimits(precision)
+	if limits == nil {
+		return nil, fmt.Errorf("unknown precision %d, must be %d or %d", precision, FREQUENCY_PRECISION_STANDARD, FREQUENCY_PRECISION_HIGH)
+	}
+
+	if order < 0 || order > MAX_CONTEXT_ORDER {
+		return nil, fmt.Errorf("order %d is out of range, must be from 0 to %d", order, MAX_CONTEXT_ORDER)
+	}
+
+	model := &Model{limits: limits, order: order, adaptive: adaptive, base: newFrequencyTable(frequencies, limits), contexts: make(map[uint32]*frequencyTable)}
+	for context, frequencies := range contexts {
+		preceding, err := hex.DecodeString(context)
+		if err != nil {
+			return nil, fmt.Errorf("context %q: %v", context, err)
+		}
+
+		if len(preceding) > order {
+			return nil, fmt.Errorf("context %q is longer than the order %d", context, order)
+		}
+
+		var history uint32
+		for _, b := range preceding {
+			history = history<<8 | uint32(b)
+		}
+
+		model.contexts[contextKey(history, len(preceding))] = newFrequencyTable(frequencies, limits)
+	}
+
+	return model, nil
+}
+
+// The fewest bits of input that coding one symbol outside the position
+// ranges can consume, in the worst case over the tables for the contexts.
+func (this *Model) minimumBits() float64 {
+	bits := this.base.minimumBits(this.adaptive)
+	for _, table := range this.contexts {
+		bits = min(bits, table.minimumBits(this.adaptive))
+	}
+
+	return bits
+}
+
+// The fewest bits of input that coding one symbol can consume, in the worst
+// case over every table including those of the position ranges.
+func (this *Model) minimumBitsAnywhere() float64 {
+	bits := this.minimumBits()
+	for _, positions := range this.ranges {
+		bits = min(bits, positions.table.minimumBits(this.adaptive))
+	}
+
+	return bits
+}
+
+// The most symbols that can be coded from the given number of bits of input,
+// which is when every symbol is the most probable one in its table.
+func (this *Model) maximumSymbols(bits float64) int {
+	general := this.minimumBits()
+
+	// Consume the bits at the given rate up to position end, or for the rest
+	// of the sequence if end is negative, returning true once they run out.
+	symbols := 0
+	consume := func(end int, rate float64) bool {
+		if end < 0 || float64(end-symbols)*rate >= bits {
+			symbols = symbols + int(math.Ceil(bits/rate))
+			return true
+		}
+
+		bits = bits - float64(end-symbols)*rate
+		symbols = end
+		return false
+	}
+
+	for _, positions := range this.ranges {
+		end := positions.end
+		if end == 0 {
+			end = -1
+		}
+
+		if consume(positions.start, general) || consume(end, positions.table.minimumBits(this.adaptive)) {
+			return symbols
+		}
+	}
+
+	consume(-1, general)
+	return symbols
+}
+
+// Identifies a context by its preceding bytes, most recent in the low byte,
+// and how many of them there are.
+func contextKey(history uint32, length int) uint32 {
+	return uint32(length)<<24 | history&(1<<(8*length)-1)
+}
+
+// The state of a Model while coding a sequence.
+type modelContext struct {
+	// The preceding bytes, most recent in the low byte.
+	history uint32
+
+	// The number of preceding bytes, up to the order of the Model.
+	length int
+
+	// The position of the next symbol in the sequence.
+	position int
+
+	// The first position range that has not been passed.
+	nextRange int
+
+	// The tables of an adaptive Model as they have been adapted so far in this
+	// sequence, by contextKey.
+	adapted map[uint32]*frequencyTable
+
+	// Tables adapted in earlier sequences, kept to be reused rather than
+	// allocating new ones for each sequence.
+	spare []*frequencyTable
+}
+
+// Return to the state at the start of a sequence.
+func (this *modelContext) reset() {
+	this.history = 0
+	this.length = 0
+	this.position = 0
+	this.nextRange = 0
+	for _, table := range this.adapted {
+		this.spare = append(this.spare, table)
+	}
+
+	clear(this.adapted)
+}
+
+// The key and the unadapted table for the next symbol, from the range
+// containing its position if there is one, otherwise from its context.
+func (this *modelContext) lookup(model *Model) (uint32, *frequencyTable) {
+	for this.nextRange < len(model.ranges) && model.ranges[this.nextRange].end != 0 && this.position >= model.ranges[this.nextRange].end {
+		this.nextRange++
+	}
+
+	if this.nextRange < len(model.ranges) && this.position >= model.ranges[this.nextRange].start {
+		return RANGE_KEY | uint32(this.nextRange), model.ranges[this.nextRange].table
+	}
+
+	key := contextKey(this.history, this.length)
+	if len(model.contexts) == 0 {
+		return key, model.base
+	}
+
+	if table, ok := model.contexts[key]; ok {
+		return key, table
+	}
+
+	return key, model.base
+}
+
+// The table to code the next symbol with.
+func (this *modelContext) table(model *Model) *frequencyTable {
+	key, table := this.lookup(model)
+	if !model.adaptive {
+		return table
+	}
+
+	if adapted, ok := this.adapted[key]; ok {
+		return adapted
+	}
+
+	return table
+}
+
+// Move on to the next symbol after coding symbol with table.
+func (this *modelContext) update(model *Model, table *frequencyTable, symbol uint8) {
+	if model.adaptive {
+		// Each context and range adapts its own copy of its table.
+		key, _ := this.lookup(model)
+		adapted, ok := this.adapted[key]
+		if !ok {
+			if len(this.spare) > 0 {
+				adapted = this.spare[len(this.spare)-1]
+				this.spare = this.spare[:len(this.spare)-1]
+			} else {
+				adapted = &frequencyTable{}
+			}
+
+			*adapted = *table
+			if this.adapted == nil {
+				this.adapted = make(map[uint32]*frequencyTable)
+			}
+
+			this.adapted[key] = adapted
+		}
+
+		adapted.increment(symbol)
+	}
+
+	if model.order > 0 {
+		this.history = this.history<<8 | uint32(symbol)
+		this.length = min(this.length+1, model.order)
+	}
+
+	this.position++
+}
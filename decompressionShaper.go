@@ -1,12 +1,55 @@
 package protean
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync"
 )
 
+// The bytes Transform frames a packet with before decoding it: a header byte,
+// the 2 byte length and a byte of padding.
+const DECOMPRESSION_FRAMING_SIZE = 4
+
+// The padding after the data, the midpoint of the byte values.
+const DECOMPRESSION_PADDING = 0x80
+
+// The longest packet the decompression stage can carry, as the length is
+// framed in 2 bytes.
+const MAX_DECOMPRESSION_LENGTH = 0xFFFF
+
+// Accepted in serialised form by Configure().
 type DecompressionConfig struct {
-	Frequencies []uint32
+	// The relative frequency of each of the 256 byte values in the output.
+	Frequencies []uint32 `json:"frequencies"`
+
+	// The number of preceding bytes the frequencies are conditioned on, from 0
+	// to MAX_CONTEXT_ORDER. Zero, the default, uses Frequencies for every byte.
+	Order int `json:"order,omitempty"`
+
+	// Frequency tables of 256 entries for particular contexts, keyed by the
+	// preceding bytes in hex, oldest first. A key shorter than Order applies
+	// at the start of a packet. Bytes whose context has no table use
+	// Frequencies.
+	Contexts map[string][]uint32 `json:"contexts,omitempty"`
+
+	// Adapt the frequencies to the bytes already produced in each packet,
+	// making each byte more probable every time it occurs.
+	Adaptive bool `json:"adaptive,omitempty"`
+
+	// Frequency tables for ranges of offsets in each packet, in order and not
+	// overlapping. In a range its table is used in place of Frequencies and
+	// Contexts, so that the first bytes of a packet can mimic a protocol
+	// header while the rest mimics its payload.
+	Ranges []FrequencyRange `json:"ranges,omitempty"`
+
+	// The precision of the frequencies, one of the FREQUENCY_PRECISION
+	// constants. Zero selects FREQUENCY_PRECISION_STANDARD, which scales each
+	// table to frequencies of at most 255. FREQUENCY_PRECISION_HIGH keeps
+	// 16 bits, so that skewed distributions are mimicked more closely.
+	Precision int `json:"precision,omitempty"`
 }
 
 // Creates a sample (non-random) config, suitable for testing.
@@ -19,6 +62,60 @@ func sampleDecompressionConfig() DecompressionConfig {
 	return DecompressionConfig{Frequencies: probs}
 }
 
+// Check the config, recording any problems under path.
+func (config DecompressionConfig) validate(path string, problems *ConfigErrors) {
+	validateFrequencies(fieldPath(path, "frequencies"), config.Frequencies, problems)
+
+	if precisionLimits(config.Precision) == nil {
+		problems.add(fieldPath(path, "precision"), "unknown precision %d, must be %d or %d", config.Precision, FREQUENCY_PRECISION_STANDARD, FREQUENCY_PRECISION_HIGH)
+	}
+
+	if config.Order < 0 || config.Order > MAX_CONTEXT_ORDER {
+		problems.add(fieldPath(path, "order"), "%d is out of range, must be from 0 to %d", config.Order, MAX_CONTEXT_ORDER)
+	}
+
+	for context, frequencies := range config.Contexts {
+		contextPath := fmt.Sprintf("%s[%q]", fieldPath(path, "contexts"), context)
+		preceding, err := hex.DecodeString(context)
+		if err != nil {
+			problems.add(contextPath, "invalid hex: %v", err)
+		} else if len(preceding) > config.Order {
+			problems.add(contextPath, "has %d bytes, more than the order %d", len(preceding), config.Order)
+		}
+
+		validateFrequencies(contextPath, frequencies, problems)
+	}
+
+	previousEnd := 0
+	for index, positions := range config.Ranges {
+		rangePath := fmt.Sprintf("%s[%d]", fieldPath(path, "ranges"), index)
+		if positions.Start < previousEnd || (index > 0 && previousEnd == 0) {
+			problems.add(fieldPath(rangePath, "start"), "overlaps the range before it")
+		}
+
+		if positions.Start < 0 || (positions.End != 0 && positions.End <= positions.Start) {
+			problems.add(rangePath, "range from %d to %d is empty", positions.Start, positions.End)
+		}
+
+		validateFrequencies(fieldPath(rangePath, "frequencies"), positions.Frequencies, problems)
+		previousEnd = positions.End
+	}
+}
+
+// Check a table of frequencies, recording any problems under path.
+func validateFrequencies(path string, frequencies []uint32, problems *ConfigErrors) {
+	// There must be one frequency for every possible byte value.
+	if len(frequencies) != 256 {
+		problems.add(path, "has %d entries, expected 256", len(frequencies))
+	} else if sum(frequencies) == 0 {
+		problems.add(path, "all frequencies are zero")
+	} else if max(frequencies) == sum(frequencies) {
+		// A single possible output byte carries no information, so any input
+		// would expand without limit.
+		problems.add(path, "at least two frequencies must be nonzero")
+	}
+}
+
 // A Transformer that uses an arithmetic coder to change the entropy.
 // This Transformer uses a somewhat unusual technique of reverse compression.
 // The only instance I know of this being done previously is in Dust:
@@ -47,11 +144,19 @@ func sampleDecompressionConfig() DecompressionConfig {
 //
 // The important thing to realize is that the compression algorithm is being
 // run in reverse, contrary to normal expectations.
+//
+// Transform and Restore are safe for concurrent use, but Configure is not.
 type DecompressionShaper struct {
 	//implements Transformer
 
+	// Serializes use of the encoder and decoder, which keep their working
+	// state between calls.
+	lock sync.Mutex
+
 	Frequencies []uint32
 
+	model *Model
+
 	encoder Encoder
 
 	decoder Decoder
@@ -65,79 +170,191 @@ func NewDecompressionShaper() *DecompressionShaper {
 		return nil
 	}
 
-	shaper.Configure(string(jsonConfig))
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return shaper
 }
 
 // This method is required to implement the Transformer API.
 // @param {[]byte} key Key to set, not used by this class.
-func (shaper *DecompressionShaper) SetKey(key []byte) {
+func (shaper *DecompressionShaper) SetKey(key []byte) error {
+	return nil
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (this *DecompressionShaper) Configure(jsonConfig string) {
+func (this *DecompressionShaper) Configure(jsonConfig string) error {
 	var config DecompressionConfig
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
-		fmt.Println("Decompression shaper requires key parameter")
+		return fmt.Errorf("%w: decompression shaper requires frequencies parameter: %v", ErrMalformedConfig, err)
 	}
 
-	this.ConfigureStruct(config)
+	return this.ConfigureStruct(config)
 }
 
-func (this *DecompressionShaper) ConfigureStruct(config DecompressionConfig) {
+func (this *DecompressionShaper) ConfigureStruct(config DecompressionConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	model, err := NewPrecisionModel(config.Precision, config.Frequencies, config.Order, config.Contexts, config.Adaptive)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedConfig, err)
+	}
+
+	for _, positions := range config.Ranges {
+		if err := model.AddRange(positions); err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedConfig, err)
+		}
+	}
+
 	this.Frequencies = config.Frequencies
-	this.encoder = NewEncoder(this.Frequencies)
-	this.decoder = NewDecoder(this.Frequencies)
+	this.model = model
+	this.encoder = NewModelEncoder(model)
+	this.decoder = NewModelDecoder(model)
+	return nil
 }
 
 // Decompress the bytestream. The purpose of this Transform is to take a high
 // entropy bytestream and produce a lower entropy one.
-func (shaper *DecompressionShaper) Transform(buffer []byte) [][]byte {
+func (shaper *DecompressionShaper) Transform(buffer []byte) ([][]byte, error) {
+	if len(buffer) > MAX_DECOMPRESSION_LENGTH {
+		return nil, fmt.Errorf("%w: %d bytes is more than the %d the decompression stage can carry", ErrMalformedPacket, len(buffer), MAX_DECOMPRESSION_LENGTH)
+	}
+
 	// The purpose of this section of code is to encode the data in the format
 	// expected by the decoder. This format is inherited from the original
 	// psuedocode implementation in the range encoding paper.
 	// The decoder expects data to be in the following format:
 	// - header - 1 byte
-	// - data - variable
-	// - footer - 2 bytes
 	// - length - 2 bytes
+	// - data - variable
+	// - padding - 1 byte
+	// The length is shaped along with the data, so that Restore knows where
+	// the data ends however many bytes the encoder produces after it.
+	framed := make([]byte, 0, len(buffer)+DECOMPRESSION_FRAMING_SIZE)
 
 	// Create a header byte. This is an arbitrary value that is required but
 	// ignored by the decoder. A non-zero value is used to simplify debugging.
-	header := encodeByte(0xCA)
-	// Create some trailing zero bytes. These are consumed by the decoder.
-	footer := make([]byte, 2)
-	// Create an encoded length. This is required but ignored by the decoder.
-	length := encodeShort(uint16(len(buffer)))
-	// Construct an encoded buffer if the form expected by the decoder.
-	encoded := append(header, buffer...)
-	encoded = append(encoded, footer...)
-	encoded = append(encoded, length...)
+	framed = append(framed, 0xCA)
+	framed = binary.BigEndian.AppendUint16(framed, uint16(len(buffer)))
+	framed = append(framed, buffer...)
+	framed = append(framed, DECOMPRESSION_PADDING)
 
 	// Use a decoder to decompress.
 	// This is backwards from what you'd normally expect.
-	// The decoded bytes will have two trailing zeros added, so these are
-	// sliced off.
-	decoded := shaper.decoder.Decode(encoded)
-	decoded = decoded[:len(decoded)-2]
-	return [][]byte{decoded}
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+	decoded, err := shaper.shape(framed)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{decoded}, nil
 }
 
-func (shaper *DecompressionShaper) Restore(buffer []byte) [][]byte {
+// Decode framed one symbol at a time, until encoding the symbols decoded so
+// far gives back every byte of it but the padding.
+//
+// The decoder reads the framed bytes as a number, and each symbol narrows an
+// interval containing it. The encoder narrows the same interval for the same
+// symbols, and writes a number inside it. The padding puts the number read
+// half way between the numbers starting with the rest of framed and the next
+// ones, so once the interval is narrow enough, every number in it starts
+// with the rest of framed.
+func (shaper *DecompressionShaper) shape(framed []byte) ([]byte, error) {
+	decoder := &shaper.decoder
+	encoder := &shaper.encoder
+	decoder.input = framed
+	decoder.init()
+	encoder.output = nil
+	encoder.init()
+	defer func() {
+		decoder.input = nil
+		encoder.output = nil
+	}()
+
+	target := framed[:len(framed)-1]
+	var decoded []byte
+	for len(decoded) < MAX_SEQUENCE_LENGTH {
+		symbol := decoder.decodeSymbol()
+		encoder.encodeSymbol(symbol)
+		decoded = append(decoded, symbol)
+
+		// Flushing writes the working byte, the bytes held back for a carry
+		// and 2 bytes of the low end before the length, so until those
+		// could reach the end of target there is no need to try.
+		if len(encoder.output)+int(encoder.underflow)+3 < len(target) {
+			continue
+		}
+
+		// Finish a copy of the encoder, as encoding the symbols in Restore
+		// would.
+		finished := *encoder
+		finished.flush(len(decoded))
+		if bytes.HasPrefix(finished.output, target) {
+			return decoded, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: packet expands to more than the %d bytes the encoder can code", ErrMalformedPacket, MAX_SEQUENCE_LENGTH)
+}
+
+func (shaper *DecompressionShaper) Restore(buffer []byte) ([][]byte, error) {
 	// Use an encoder to compress.
 	// This is backwards from what you'd normally expect.
-	encoded := shaper.encoder.Encode(buffer)
+	shaper.lock.Lock()
+	encoded, err := shaper.encoder.EncodeTo(nil, buffer)
+	shaper.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
 	// The encoder generates data to be in the following format:
 	// - header - 1 byte
-	// - data - variable
-	// - footer - 2 bytes
 	// - length - 2 bytes
+	// - data - variable
+	// - whatever else the encoder wrote to finish
 	// Slice off the extra bytes and only return the data.
-	return [][]byte{encoded[1 : len(encoded)-4]}
+	if len(encoded) < 3 {
+		return nil, fmt.Errorf("%w: encoder produced %d bytes, expected at least 3", ErrTruncatedPacket, len(encoded))
+	}
+
+	length := int(binary.BigEndian.Uint16(encoded[1:3]))
+	if len(encoded) < 3+length {
+		return nil, fmt.Errorf("%w: encoder produced %d bytes, expected at least %d", ErrTruncatedPacket, len(encoded), 3+length)
+	}
+
+	return [][]byte{encoded[3 : 3+length]}, nil
 }
 
 // No-op (we have no state or any resources to Dispose).
 func (shaper *DecompressionShaper) Dispose() {
 }
+
+// The worst-case ratio of the length of a shaped packet to the length of the
+// packet given to Transform, approached as packets grow long. This is 8 bits
+// over the fewest bits of the packet that any of the tables can carry in one
+// byte, so 1 for uniform frequencies and larger the more skewed they are.
+func (shaper *DecompressionShaper) ExpansionFactor() float64 {
+	return 8 / shaper.model.minimumBitsAnywhere()
+}
+
+// The maximum number of bytes added to a packet of the given length.
+// Each output byte carries at least log2(total / highest frequency) bits of the
+// input, in the table for its offset where that is least, so this bounds the
+// expansion when every output byte is the most probable one.
+func (shaper *DecompressionShaper) Overhead(length int) int {
+	// The symbols must narrow the interval to the length, the data and half of
+	// the padding byte. The rest of the framing is margin for the precision
+	// the coder loses when it subdivides the range and finishes.
+	framedLength := length + DECOMPRESSION_FRAMING_SIZE + 1
+	decodedLength := shaper.model.maximumSymbols(float64(8 * framedLength))
+	return decodedLength - length
+}
@@ -0,0 +1,147 @@
+package protean
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Configs for the decompression tests, from uniform to heavily shaped.
+func decompressionConfigs() map[string]DecompressionConfig {
+	likely := make([]uint32, 256)
+	for index := range likely {
+		likely[index] = 1
+	}
+	likely['a'] = 255
+
+	return map[string]DecompressionConfig{
+		"uniform": sampleDecompressionConfig(),
+		"skewed":  {Frequencies: skewedFrequencies()},
+		"likely":  {Frequencies: likely},
+		"precise": {Frequencies: geometricCounts(), Precision: FREQUENCY_PRECISION_HIGH},
+		"context": {
+			Frequencies: skewedFrequencies(),
+			Order:       1,
+			Contexts:    map[string][]uint32{"": onlyFrequencies('G', 'P'), "47": onlyFrequencies('E', 'e')},
+			Adaptive:    true,
+		},
+		"ranges": {
+			Frequencies: skewedFrequencies(),
+			Ranges:      []FrequencyRange{{Start: 0, End: 2, Frequencies: onlyFrequencies(0x80, 0x81)}, {Start: 4, Frequencies: likely}},
+		},
+	}
+}
+
+func newTestDecompressionShaper(t testing.TB, config DecompressionConfig) *DecompressionShaper {
+	shaper := &DecompressionShaper{}
+	if err := shaper.ConfigureStruct(config); err != nil {
+		t.Fatal(err)
+	}
+
+	return shaper
+}
+
+// Restore gives back exactly what Transform was given, within the overhead.
+func checkDecompressionRoundTrip(t testing.TB, name string, shaper *DecompressionShaper, plain []byte) {
+	transformed, err := shaper.Transform(plain)
+	if err != nil {
+		t.Fatalf("%s, %d bytes: %v", name, len(plain), err)
+	}
+
+	if len(transformed) != 1 {
+		t.Fatalf("%s, %d bytes: transformed into %d packets", name, len(plain), len(transformed))
+	}
+
+	if expansion := len(transformed[0]) - len(plain); expansion > shaper.Overhead(len(plain)) {
+		t.Errorf("%s, %d bytes: expanded by %d, more than the overhead %d", name, len(plain), expansion, shaper.Overhead(len(plain)))
+	}
+
+	restored, err := shaper.Restore(transformed[0])
+	if err != nil {
+		t.Fatalf("%s, %d bytes: %v", name, len(plain), err)
+	}
+
+	if len(restored) != 1 || !bytes.Equal(restored[0], plain) {
+		t.Fatalf("%s: restored %x, expected %x", name, restored, plain)
+	}
+}
+
+func TestDecompressionRoundTrip(t *testing.T) {
+	for name, config := range decompressionConfigs() {
+		shaper := newTestDecompressionShaper(t, config)
+		for length := 0; length < 300; length++ {
+			plain := make([]byte, length)
+			for index := range plain {
+				plain[index] = byte(index*151 + length)
+			}
+
+			checkDecompressionRoundTrip(t, name, shaper, plain)
+		}
+
+		for _, plain := range [][]byte{{0x00}, {0xFF}, {0x80}, {0x7F}, {0xFF, 0xFF}, bytes.Repeat([]byte{0xFF}, 100), make([]byte, 100)} {
+			checkDecompressionRoundTrip(t, name, shaper, plain)
+		}
+	}
+}
+
+// Skewed tables expand packets more, and the overhead grows in proportion.
+func TestDecompressionExpansionFactor(t *testing.T) {
+	configs := decompressionConfigs()
+	uniform := newTestDecompressionShaper(t, configs["uniform"])
+	if factor := uniform.ExpansionFactor(); factor != 1 {
+		t.Errorf("uniform frequencies expand by %v, expected 1", factor)
+	}
+
+	for _, name := range []string{"skewed", "likely", "ranges"} {
+		shaper := newTestDecompressionShaper(t, configs[name])
+		factor := shaper.ExpansionFactor()
+		if factor <= 1 {
+			t.Errorf("%s: expansion factor %v, expected more than 1", name, factor)
+		}
+
+		// The framing adds a few bytes, which are expanded too.
+		if overhead := shaper.Overhead(1000); float64(overhead) < (factor-1)*1000 || float64(overhead) > (factor-1)*1000+10*factor {
+			t.Errorf("%s: overhead %d for 1000 bytes is out of line with the factor %v", name, overhead, factor)
+		}
+	}
+}
+
+// The shaped bytes follow the frequencies, rather than carrying the input
+// through unchanged.
+func TestDecompressionShapesOutput(t *testing.T) {
+	shaper := newTestDecompressionShaper(t, DecompressionConfig{Frequencies: onlyFrequencies('a', 'b', 'c')})
+	plain := make([]byte, 64)
+	for index := range plain {
+		plain[index] = byte(index * 37)
+	}
+
+	transformed, err := shaper.Transform(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range transformed[0] {
+		if b < 'a' || b > 'c' {
+			t.Fatalf("shaped packet %q contains %q", transformed[0], b)
+		}
+	}
+}
+
+func FuzzDecompressionRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00})
+	f.Add([]byte{0xFF})
+	f.Add([]byte("GET /index.html"))
+	f.Add(bytes.Repeat([]byte{0xFF}, 64))
+
+	configs := decompressionConfigs()
+	shapers := make(map[string]*DecompressionShaper)
+	for name, config := range configs {
+		shapers[name] = newTestDecompressionShaper(f, config)
+	}
+
+	f.Fuzz(func(t *testing.T, plain []byte) {
+		for name, shaper := range shapers {
+			checkDecompressionRoundTrip(t, name, shaper, plain)
+		}
+	})
+}
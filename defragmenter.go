@@ -1,13 +1,147 @@
 package protean
 
 import (
+	"container/list"
 	"encoding/hex"
-	"fmt"
+	"sync"
 	"time"
 )
 
+// The default time a partial packet is kept after its first fragment arrives.
 // Cache expiration is set to 60 seconds.
-const CACHE_EXPIRATION_TIME time.Duration = time.Duration(60 * 1000)
+const CACHE_EXPIRATION_TIME time.Duration = 60 * time.Second
+
+// Eviction policies accepted in DefragmenterLimits.Eviction.
+const (
+	// Evict the partial packet whose first fragment arrived longest ago.
+	EVICTION_OLDEST = "oldest"
+
+	// Evict the partial packet whose most recent fragment arrived longest ago.
+	EVICTION_LRU = "lru"
+)
+
+// Defaults for the DefragmenterLimits fields that are left as zero.
+const (
+	DEFAULT_MAX_PARTIAL_PACKETS            = 1024
+	DEFAULT_MAX_BUFFERED_BYTES             = 16 * 1024 * 1024
+	DEFAULT_MAX_PARTIAL_PACKETS_PER_SOURCE = 64
+	DEFAULT_MAX_FRAGMENTS_PER_PACKET       = 256
+)
+
+// Limits on the memory the Defragmenter uses to hold partial packets.
+// When a new fragment would exceed a limit, partial packets are evicted
+// according to the eviction policy until it fits. Zero values select the
+// defaults.
+type DefragmenterLimits struct {
+	// The maximum number of partial packets held at once.
+	MaxPartialPackets int `json:"maxPartialPackets,omitempty"`
+
+	// The maximum number of payload bytes held in partial packets at once.
+	MaxBufferedBytes int `json:"maxBufferedBytes,omitempty"`
+
+	// The maximum number of partial packets held at once for a single source.
+	MaxPartialPacketsPerSource int `json:"maxPartialPacketsPerSource,omitempty"`
+
+	// Fragments claiming that their packet has more fragments than this are
+	// dropped, and the FragmentationShaper refuses to send packets that
+	// would need more. With the default, packets of up to 256 times the
+	// fragment payload can be sent.
+	MaxFragmentsPerPacket int `json:"maxFragmentsPerPacket,omitempty"`
+
+	// One of the EVICTION constants. The empty string selects EVICTION_OLDEST.
+	Eviction string `json:"eviction,omitempty"`
+}
+
+// Check the limits, recording any problems under path.
+func (limits DefragmenterLimits) validate(path string, problems *ConfigErrors) {
+	if limits.MaxPartialPackets < 0 {
+		problems.add(fieldPath(path, "maxPartialPackets"), "%d is negative", limits.MaxPartialPackets)
+	}
+
+	if limits.MaxBufferedBytes < 0 {
+		problems.add(fieldPath(path, "maxBufferedBytes"), "%d is negative", limits.MaxBufferedBytes)
+	}
+
+	if limits.MaxPartialPacketsPerSource < 0 {
+		problems.add(fieldPath(path, "maxPartialPacketsPerSource"), "%d is negative", limits.MaxPartialPacketsPerSource)
+	}
+
+	if limits.MaxFragmentsPerPacket < 0 || limits.MaxFragmentsPerPacket > 65535 {
+		problems.add(fieldPath(path, "maxFragmentsPerPacket"), "%d is out of range, must be from 0 to 65535", limits.MaxFragmentsPerPacket)
+	}
+
+	switch limits.Eviction {
+	case "", EVICTION_OLDEST, EVICTION_LRU:
+	default:
+		problems.add(fieldPath(path, "eviction"), "unknown eviction policy %q", limits.Eviction)
+	}
+}
+
+// Replace zero values with the defaults.
+func (limits DefragmenterLimits) withDefaults() DefragmenterLimits {
+	if limits.MaxPartialPackets == 0 {
+		limits.MaxPartialPackets = DEFAULT_MAX_PARTIAL_PACKETS
+	}
+
+	if limits.MaxBufferedBytes == 0 {
+		limits.MaxBufferedBytes = DEFAULT_MAX_BUFFERED_BYTES
+	}
+
+	if limits.MaxPartialPacketsPerSource == 0 {
+		limits.MaxPartialPacketsPerSource = DEFAULT_MAX_PARTIAL_PACKETS_PER_SOURCE
+	}
+
+	if limits.MaxFragmentsPerPacket == 0 {
+		limits.MaxFragmentsPerPacket = DEFAULT_MAX_FRAGMENTS_PER_PACKET
+	}
+
+	if limits.Eviction == "" {
+		limits.Eviction = EVICTION_OLDEST
+	}
+
+	return limits
+}
+
+// Counts of the fragments the Defragmenter has dropped, by reason.
+type DefragmenterStats struct {
+	// Fragments dropped because a fragment with the same index had already
+	// arrived.
+	DuplicateFragments uint64
+
+	// Fragments dropped because they claimed too many fragments in their
+	// packet, or disagreed with earlier fragments about how many there are.
+	InvalidFragments uint64
+
+	// Fragments dropped because they could not fit in the buffer, even after
+	// evicting other partial packets.
+	RejectedFragments uint64
+
+	// Partial packets evicted to make room for new fragments.
+	EvictedPackets uint64
+
+	// Fragments discarded along with the evicted packets.
+	EvictedFragments uint64
+
+	// Partial packets discarded because they expired before all of their
+	// fragments arrived.
+	ExpiredPackets uint64
+
+	// Fragments discarded along with the expired packets.
+	ExpiredFragments uint64
+}
+
+// Sum two sets of counts.
+func (this DefragmenterStats) add(other DefragmenterStats) DefragmenterStats {
+	return DefragmenterStats{
+		DuplicateFragments: this.DuplicateFragments + other.DuplicateFragments,
+		InvalidFragments:   this.InvalidFragments + other.InvalidFragments,
+		RejectedFragments:  this.RejectedFragments + other.RejectedFragments,
+		EvictedPackets:     this.EvictedPackets + other.EvictedPackets,
+		EvictedFragments:   this.EvictedFragments + other.EvictedFragments,
+		ExpiredPackets:     this.ExpiredPackets + other.ExpiredPackets,
+		ExpiredFragments:   this.ExpiredFragments + other.ExpiredFragments,
+	}
+}
 
 // Tracks the fragments for a single packet identifier
 type PacketTracker struct {
@@ -16,27 +150,109 @@ type PacketTracker struct {
 
 	// Counts of the number remaining
 	// This is an optimization to avoid scanning Pieces repeatedly for counts.
-	Counter uint8
+	Counter uint16
 
-	// Stores the Timer objects for expiring each identifier
+	// Stores the time the first fragment arrived, from which the packet
+	// expires.
 	// See RFC 815, section 7, paragraph 2 (p. 8)
-	Timer *time.Timer
+	Arrived time.Time
+
+	// The source of the first fragment of this packet.
+	Source string
+
+	// The number of payload bytes held for this packet.
+	Bytes int
+
+	// The packet identifier, as used for the tracker key.
+	hexid string
+
+	// Position in the eviction order.
+	element *list.Element
+
+	// Position in the timer wheel.
+	wheelSlot    *list.List
+	wheelElement *list.Element
+}
+
+// The number of fragments held for this packet.
+func (this *PacketTracker) held() uint64 {
+	return uint64(len(this.Pieces) - int(this.Counter))
 }
 
 // The Defragmenter gathers fragmented packets in a buffer and defragments them.
 // The cache expiration strategy is taken from RFC 815: IP Datagram Reassembly
 // Algorithms.
+//
+// The memory used by partial packets is bounded by DefragmenterLimits, so that
+// a peer sending fragments that are never completed cannot exhaust it.
+//
+// Partial packets are expired using a timer wheel driven by a single Timer
+// from the Clock, which is only running while there are partial packets.
+//
+// A Defragmenter is safe for concurrent use.
 type Defragmenter struct {
+	// Guards all of the other fields, which are also used by the Timer.
+	lock sync.Mutex
+
+	clock Clock
+
+	// How long a partial packet is kept after its first fragment arrives.
+	timeout time.Duration
+
+	// When each partial packet expires.
+	wheel *timerWheel
+
+	// Runs until the next partial packet expires, nil if there are none.
+	timer Timer
+
+	// Set by Dispose, after which the Timer is not restarted.
+	disposed bool
+
 	// Associates packet identifiers with indexed lists of fragments
 	// The packet identifiers are converted from []bytes to hex strings so
 	// that they can be used as map keys.
-	tracker map[string]PacketTracker
+	tracker map[string]*PacketTracker
 
 	// Stores the packet identifiers for which we have all fragments
 	complete [][][]byte
+
+	limits DefragmenterLimits
+
+	// The partial packets in eviction order, first to be evicted at the front.
+	order *list.List
+
+	// The number of partial packets held for each source.
+	sources map[string]int
+
+	// The number of payload bytes held in partial packets.
+	bufferedBytes int
+
+	stats DefragmenterStats
+}
+
+// Make a Defragmenter that keeps partial packets for the given timeout,
+// measured by clock. A zero timeout selects CACHE_EXPIRATION_TIME, and a nil
+// clock selects SystemClock.
+func NewDefragmenter(limits DefragmenterLimits, timeout time.Duration, clock Clock) *Defragmenter {
+	if timeout == 0 {
+		timeout = CACHE_EXPIRATION_TIME
+	}
+
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	return &Defragmenter{clock: clock, timeout: timeout, wheel: newTimerWheel(timeout, clock.Now()), tracker: make(map[string]*PacketTracker), limits: limits.withDefaults(), order: list.New(), sources: make(map[string]int)}
+}
+
+// Add a fragment from an unknown source.
+func (this *Defragmenter) AddFragment(fragment *Fragment) {
+	this.AddFragmentFrom("", fragment)
 }
 
 // Add a fragment that has been received from the network.
+// The source identifies the peer that sent the fragment, and is used to limit
+// the number of partial packets held for each peer.
 // Fragments are processed according to the following logic:
 //   If the packet identifier is recognized:
 //     If we have a fragment for this index:
@@ -45,7 +261,19 @@ type Defragmenter struct {
 //      This fragment a new fragment for an existing packet
 //   Else:
 //     This fragment a new fragment for a new packet.
-func (this *Defragmenter) AddFragment(fragment *Fragment) {
+func (this *Defragmenter) AddFragmentFrom(source string, fragment *Fragment) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	// Expire packets before checking the limits, in case the Timer is late.
+	now := this.clock.Now()
+	this.expire(now)
+
+	if int(fragment.Count) > this.limits.MaxFragmentsPerPacket {
+		this.stats.InvalidFragments++
+		return
+	}
+
 	// Convert []byte to hex string so that it can be used as a map key
 	hexid := hex.EncodeToString(fragment.Id)
 
@@ -54,37 +282,47 @@ func (this *Defragmenter) AddFragment(fragment *Fragment) {
 
 		// Get list of fragment contents for this packet identifier
 		fragmentList := tracked.Pieces
-		if fragmentList[fragment.Index] != nil {
+		if int(fragment.Index) >= len(fragmentList) {
+			// The fragment disagrees with the earlier fragments about the
+			// total number of fragments, so it cannot belong to this packet.
+			this.stats.InvalidFragments++
+		} else if fragmentList[fragment.Index] != nil {
 			// Duplicate fragment
 
 			// The fragmentation system does not retransmit dropped packets.
 			// Therefore, a duplicate is an error.
 			// However, it might be a recoverable error.
-			// So let's log it and continue.
-			fmt.Println("Duplicate fragment %1: %2 / %3", hexid, fragment.Index, fragment.Count)
+			// So let's count it and continue.
+			this.stats.DuplicateFragments++
 		} else {
 			// New fragment for an existing packet
 
+			// Make room for the payload, keeping this packet.
+			if !this.makeRoom(len(fragment.Payload), tracked) {
+				this.stats.RejectedFragments++
+				return
+			}
+
 			// Only the payload is stored explicitly.
 			// The other information is stored implicitly in the data structure.
 			fragmentList[fragment.Index] = fragment.Payload
-			tracked.Pieces = fragmentList
+			tracked.Bytes = tracked.Bytes + len(fragment.Payload)
+			this.bufferedBytes = this.bufferedBytes + len(fragment.Payload)
 
 			// Decrement the Counter for this packet identifier
 			tracked.Counter = tracked.Counter - 1
 
-			this.tracker[hexid] = tracked
+			if this.limits.Eviction == EVICTION_LRU {
+				this.order.MoveToBack(tracked.element)
+			}
 
 			// If we have all fragments for this packet identifier, it is complete.
-			if this.tracker[hexid].Counter == 0 {
+			if tracked.Counter == 0 {
 				// Extract the completed packet fragments from the tracker
-				this.complete = append(this.complete, this.tracker[hexid].Pieces)
-
-				// Stop the Timer now that the packet is complete
-				tracked.Timer.Stop()
+				this.complete = append(this.complete, tracked.Pieces)
 
 				// Delete the completed packet from the tracker
-				delete(this.tracker, hexid)
+				this.remove(tracked)
 			}
 		}
 	} else {
@@ -104,37 +342,61 @@ func (this *Defragmenter) AddFragment(fragment *Fragment) {
 			// Deal with the case where there is only one fragment for this packet.
 			this.complete = append(this.complete, fragmentList)
 		} else {
-			// Store time the first fragment arrived, to set the cache expiration.
+			// Make room for a new partial packet from this source.
+			for this.sources[source] >= this.limits.MaxPartialPacketsPerSource {
+				this.evict(this.oldestFrom(source))
+			}
+
+			for len(this.tracker) >= this.limits.MaxPartialPackets {
+				this.evict(this.order.Front().Value.(*PacketTracker))
+			}
+
+			if !this.makeRoom(len(fragment.Payload), nil) {
+				this.stats.RejectedFragments++
+				return
+			}
+
+			// Store the fragment information in the tracker, with the time
+			// the first fragment arrived to set the cache expiration.
 			// See RFC 815, section 7, paragraph 2 (p. 8)
-			// Cache expiration is set to 60 seconds.
-			var timer = time.AfterFunc(CACHE_EXPIRATION_TIME, func() { this.reap(hexid) })
+			tracked := &PacketTracker{Pieces: fragmentList, Counter: counter, Arrived: now, Source: source, Bytes: len(fragment.Payload), hexid: hexid}
+			this.wheel.add(tracked, now.Add(this.timeout))
+			this.startTimer(now)
 
-			// Store the fragment information in the tracker
-			this.tracker[hexid] = PacketTracker{Pieces: fragmentList, Counter: counter, Timer: timer}
+			tracked.element = this.order.PushBack(tracked)
+			this.tracker[hexid] = tracked
+			this.sources[source] = this.sources[source] + 1
+			this.bufferedBytes = this.bufferedBytes + len(fragment.Payload)
 		}
 	}
 }
 
 // Returns the number of packets for which all fragments have arrived.
 func (this *Defragmenter) CompleteCount() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	return len(this.complete)
 }
 
-// Return an []byte for each packet where all fragments are available.
+// Return an []byte for each packet where all fragments are available, in the
+// order in which the packets were completed.
 // Calling this clears the set of stored completed fragments.
 func (this *Defragmenter) GetComplete() [][]byte {
-	var packets [][]byte
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
-	for i := 0; i < len(this.complete); i++ {
-		// Obtain the contents from the fragments for a completed packet
-		// Get the last elemnet of the list
-		fragmentList := this.complete[len(this.complete)-1]
-		// Remove the last element of the list
-		this.complete = this.complete[:len(this.complete)-1]
+	var packets [][]byte
 
+	for _, fragmentList := range this.complete {
 		// Assemble the fragment contents into one []byte per packet
-		if fragmentList != nil && len(fragmentList) > 0 {
-			var packet []byte
+		if len(fragmentList) > 0 {
+			var length int
+			for _, fragment := range fragmentList {
+				length = length + len(fragment)
+			}
+
+			packet := make([]byte, 0, length)
 			for _, fragment := range fragmentList {
 				packet = append(packet, fragment...)
 			}
@@ -143,10 +405,125 @@ func (this *Defragmenter) GetComplete() [][]byte {
 		}
 	}
 
+	this.complete = nil
+
 	return packets
 }
 
-func (this *Defragmenter) reap(hexid string) {
-	// Remove the fragments from the cache now that the packet has expired
-	delete(this.tracker, hexid)
+// Returns the counts of dropped fragments so far.
+func (this *Defragmenter) Stats() DefragmenterStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.stats
+}
+
+// Returns the number of partial packets and the payload bytes they hold.
+func (this *Defragmenter) Buffered() (packets int, bytes int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.tracker), this.bufferedBytes
+}
+
+// Evict partial packets until there is room for length more bytes.
+// The packet the bytes are for, if any, is never evicted.
+// Returns false if there cannot be enough room.
+func (this *Defragmenter) makeRoom(length int, keep *PacketTracker) bool {
+	if length > this.limits.MaxBufferedBytes {
+		return false
+	}
+
+	for this.bufferedBytes+length > this.limits.MaxBufferedBytes {
+		victim := this.order.Front()
+		if victim != nil && victim.Value.(*PacketTracker) == keep {
+			victim = victim.Next()
+		}
+
+		if victim == nil {
+			return false
+		}
+
+		this.evict(victim.Value.(*PacketTracker))
+	}
+
+	return true
+}
+
+// Find the first partial packet from source in eviction order.
+func (this *Defragmenter) oldestFrom(source string) *PacketTracker {
+	for element := this.order.Front(); element != nil; element = element.Next() {
+		tracked := element.Value.(*PacketTracker)
+		if tracked.Source == source {
+			return tracked
+		}
+	}
+
+	return nil
+}
+
+// Discard a partial packet to make room for others.
+func (this *Defragmenter) evict(tracked *PacketTracker) {
+	this.stats.EvictedPackets++
+	this.stats.EvictedFragments = this.stats.EvictedFragments + tracked.held()
+	this.remove(tracked)
+}
+
+// Stop tracking a partial packet.
+func (this *Defragmenter) remove(tracked *PacketTracker) {
+	delete(this.tracker, tracked.hexid)
+	this.order.Remove(tracked.element)
+	this.wheel.remove(tracked)
+	this.bufferedBytes = this.bufferedBytes - tracked.Bytes
+
+	this.sources[tracked.Source] = this.sources[tracked.Source] - 1
+	if this.sources[tracked.Source] == 0 {
+		delete(this.sources, tracked.Source)
+	}
+}
+
+// Discard the partial packets that have expired by now.
+func (this *Defragmenter) expire(now time.Time) {
+	// Remove the fragments from the cache now that the packets have expired
+	for _, tracked := range this.wheel.advance(now) {
+		this.stats.ExpiredPackets++
+		this.stats.ExpiredFragments = this.stats.ExpiredFragments + tracked.held()
+		this.remove(tracked)
+	}
+}
+
+// Start the Timer for the next partial packet to expire, if it is not already
+// running.
+func (this *Defragmenter) startTimer(now time.Time) {
+	if this.timer != nil || this.disposed {
+		return
+	}
+
+	if due, ok := this.wheel.next(); ok {
+		this.timer = this.clock.AfterFunc(due.Sub(now), this.tick)
+	}
+}
+
+// Called by the Timer when a partial packet is due to expire.
+func (this *Defragmenter) tick() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	this.timer = nil
+	this.expire(now)
+	this.startTimer(now)
+}
+
+// Stop the Timer. Partial packets are no longer expired, except when
+// fragments are added.
+func (this *Defragmenter) Dispose() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.disposed = true
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
 }
@@ -0,0 +1,175 @@
+package protean
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Make fragment index of a packet with the given id and number of fragments.
+func testFragment(id byte, index uint16, count uint16, payload []byte) *Fragment {
+	return &Fragment{Length: uint16(len(payload)), Id: bytes.Repeat([]byte{id}, 32), Index: index, Count: count, Payload: payload}
+}
+
+func TestDefragmenterMaxPartialPackets(t *testing.T) {
+	for _, eviction := range []string{EVICTION_OLDEST, EVICTION_LRU} {
+		defragmenter := NewDefragmenter(DefragmenterLimits{MaxPartialPackets: 2, Eviction: eviction}, 0, nil)
+
+		defragmenter.AddFragment(testFragment(1, 0, 3, []byte("a")))
+		defragmenter.AddFragment(testFragment(2, 0, 2, []byte("b")))
+		// Packet 1 is the oldest, but it is the most recently used.
+		defragmenter.AddFragment(testFragment(1, 1, 3, []byte("a")))
+		defragmenter.AddFragment(testFragment(3, 0, 2, []byte("c")))
+
+		// Complete whichever of packets 1 and 2 should have survived.
+		survivor := byte(2)
+		if eviction == EVICTION_LRU {
+			survivor = 1
+		}
+
+		defragmenter.AddFragment(testFragment(survivor, 2, 3, []byte("z")))
+		defragmenter.AddFragment(testFragment(survivor, 1, 2, []byte("z")))
+
+		if defragmenter.CompleteCount() != 1 {
+			t.Errorf("%s: expected packet %d to survive eviction", eviction, survivor)
+		}
+
+		stats := defragmenter.Stats()
+		if stats.EvictedPackets != 1 {
+			t.Errorf("%s: expected 1 evicted packet, got %+v", eviction, stats)
+		}
+	}
+}
+
+func TestDefragmenterPerSourceLimit(t *testing.T) {
+	defragmenter := NewDefragmenter(DefragmenterLimits{MaxPartialPacketsPerSource: 1}, 0, nil)
+
+	defragmenter.AddFragmentFrom("victim", testFragment(1, 0, 2, []byte("a")))
+	defragmenter.AddFragmentFrom("attacker", testFragment(2, 0, 2, []byte("b")))
+	defragmenter.AddFragmentFrom("attacker", testFragment(3, 0, 2, []byte("c")))
+
+	// The attacker only evicts its own partial packets.
+	defragmenter.AddFragmentFrom("victim", testFragment(1, 1, 2, []byte("a")))
+	if defragmenter.CompleteCount() != 1 {
+		t.Error("the victim's packet was evicted")
+	}
+
+	if packets, _ := defragmenter.Buffered(); packets != 1 {
+		t.Errorf("expected 1 partial packet, got %d", packets)
+	}
+}
+
+func TestDefragmenterMaxBufferedBytes(t *testing.T) {
+	defragmenter := NewDefragmenter(DefragmenterLimits{MaxBufferedBytes: 10}, 0, nil)
+
+	defragmenter.AddFragment(testFragment(1, 0, 2, make([]byte, 6)))
+	defragmenter.AddFragment(testFragment(2, 0, 2, make([]byte, 6)))
+	if packets, bytes := defragmenter.Buffered(); packets != 1 || bytes != 6 {
+		t.Errorf("expected 1 packet of 6 bytes, got %d packets of %d bytes", packets, bytes)
+	}
+
+	// A fragment larger than the whole buffer is rejected outright.
+	defragmenter.AddFragment(testFragment(3, 0, 2, make([]byte, 11)))
+
+	// So is a fragment that could only fit by evicting its own packet.
+	defragmenter.AddFragment(testFragment(2, 1, 3, make([]byte, 6)))
+
+	stats := defragmenter.Stats()
+	if stats.EvictedPackets != 1 || stats.EvictedFragments != 1 || stats.RejectedFragments != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDefragmenterInvalidFragments(t *testing.T) {
+	defragmenter := NewDefragmenter(DefragmenterLimits{MaxFragmentsPerPacket: 4}, 0, nil)
+
+	defragmenter.AddFragment(testFragment(1, 0, 5, []byte("a")))
+	defragmenter.AddFragment(testFragment(2, 0, 2, []byte("b")))
+	defragmenter.AddFragment(testFragment(2, 3, 4, []byte("b")))
+	defragmenter.AddFragment(testFragment(2, 0, 2, []byte("b")))
+
+	stats := defragmenter.Stats()
+	if stats.InvalidFragments != 2 || stats.DuplicateFragments != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Partial packets expire once the timeout has passed since their first
+// fragment, however recently other fragments arrived.
+func TestDefragmenterExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	defragmenter := NewDefragmenter(DefragmenterLimits{}, time.Second, clock)
+
+	defragmenter.AddFragment(testFragment(1, 0, 3, []byte("a")))
+	clock.Advance(900 * time.Millisecond)
+	defragmenter.AddFragment(testFragment(1, 1, 3, []byte("b")))
+	defragmenter.AddFragment(testFragment(2, 0, 2, []byte("c")))
+
+	// Allow for the timer wheel rounding the deadline up by a tick.
+	clock.Advance(100*time.Millisecond + time.Second/WHEEL_SLOTS)
+	if packets, _ := defragmenter.Buffered(); packets != 1 {
+		t.Errorf("expected only packet 2 to remain, got %d packets", packets)
+	}
+
+	defragmenter.AddFragment(testFragment(1, 2, 3, []byte("z")))
+	defragmenter.AddFragment(testFragment(2, 1, 2, []byte("d")))
+	if complete := defragmenter.GetComplete(); len(complete) != 1 || string(complete[0]) != "cd" {
+		t.Errorf("expected only packet 2 to complete, got %q", complete)
+	}
+
+	stats := defragmenter.Stats()
+	if stats.ExpiredPackets != 1 || stats.ExpiredFragments != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// The lone fragment of the expired packet is now the start of a new one.
+	clock.Advance(2 * time.Second)
+	if packets, bytes := defragmenter.Buffered(); packets != 0 || bytes != 0 {
+		t.Errorf("expected nothing buffered, got %d packets of %d bytes", packets, bytes)
+	}
+}
+
+// Partial packets expire while fragments are still being added from other
+// goroutines. Run with -race to check the expiration timer.
+func TestDefragmenterConcurrentExpiry(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	defragmenter := NewDefragmenter(DefragmenterLimits{}, time.Second, clock)
+
+	var group sync.WaitGroup
+	for sender := 0; sender < 8; sender++ {
+		group.Add(1)
+		go func(sender int) {
+			defer group.Done()
+			for packet := 0; packet < 32; packet++ {
+				id := make([]byte, 32)
+				id[0], id[1] = byte(sender), byte(packet)
+				fragment := &Fragment{Length: 1, Id: id, Index: 0, Count: 2, Payload: []byte{byte(packet)}}
+				defragmenter.AddFragmentFrom(fmt.Sprint(sender), fragment)
+				defragmenter.Buffered()
+				defragmenter.Stats()
+			}
+		}(sender)
+	}
+
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for step := 0; step < 32; step++ {
+			clock.Advance(100 * time.Millisecond)
+		}
+	}()
+
+	group.Wait()
+	clock.Advance(2 * time.Second)
+
+	if packets, bytes := defragmenter.Buffered(); packets != 0 || bytes != 0 {
+		t.Errorf("%d partial packets of %d bytes were not expired", packets, bytes)
+	}
+
+	stats := defragmenter.Stats()
+	if stats.ExpiredPackets+stats.EvictedPackets != 8*32 {
+		t.Errorf("expected every packet to expire or be evicted, got %+v", stats)
+	}
+}
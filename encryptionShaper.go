@@ -1,7 +1,6 @@
 package protean
 
 import (
-	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -9,14 +8,61 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const CHUNK_SIZE = 16
 const IV_SIZE = 16
 
+// Encryption modes accepted in EncryptionConfig.Mode.
+const (
+	// Unauthenticated AES CBC with a random IV and a length prefix.
+	// This is the default when no mode is given.
+	ENCRYPTION_MODE_AES_CBC = "aes-cbc"
+
+	// AES GCM with a 16-byte key.
+	ENCRYPTION_MODE_AES_128_GCM = "aes-128-gcm"
+
+	// AES GCM with a 32-byte key.
+	ENCRYPTION_MODE_AES_256_GCM = "aes-256-gcm"
+
+	// ChaCha20-Poly1305 with a 32-byte key.
+	ENCRYPTION_MODE_CHACHA20_POLY1305 = "chacha20-poly1305"
+)
+
 // Accepted in serialised form by Configure().
 type EncryptionConfig struct {
-	Key string
+	// Key encoded as a hex string, used in both directions.
+	// It may be empty if the keys are to be derived from a secret given to
+	// SetKey. In CBC mode its length also selects the size of the derived
+	// keys, which are 32 bytes if it is empty.
+	Key string `json:"key"`
+
+	// One of the ENCRYPTION_MODE constants.
+	// The empty string selects ENCRYPTION_MODE_AES_CBC.
+	Mode string `json:"mode,omitempty"`
+
+	// ROLE_CLIENT or ROLE_SERVER, selecting which of the keys derived by
+	// SetKey is used for each direction. Required for SetKey, which fails
+	// without it, as the same key would otherwise be used in both directions.
+	Role string `json:"role,omitempty"`
+
+	// Move to a new key epoch after this many packets have been sent in the
+	// current one. Zero disables rotation by packet count.
+	RekeyAfterPackets uint64 `json:"rekeyAfterPackets,omitempty"`
+
+	// Move to a new key epoch after this many milliseconds. Zero disables
+	// rotation by time.
+	RekeyInterval uint32 `json:"rekeyInterval,omitempty"`
+
+	// Milliseconds for which packets from the previous epoch are still
+	// accepted after the next one is first received. Zero selects
+	// DEFAULT_REKEY_GRACE_PERIOD.
+	RekeyGracePeriod uint32 `json:"rekeyGracePeriod,omitempty"`
 }
 
 // Creates a sample (non-random) config, suitable for testing.
@@ -26,9 +72,62 @@ func sampleEncryptionConfig() EncryptionConfig {
 	return EncryptionConfig{Key: hexHeader}
 }
 
-// A packet shaper that encrypts the packets with AES CBC.
+// A packet shaper that encrypts the packets with AES CBC, or with an AEAD
+// cipher in the authenticated modes.
+//
+// In the authenticated modes each packet consists of a random per-packet nonce
+// followed by the sealed contents, and Restore rejects any packet that has
+// been forged or corrupted with ErrAuthenticationFailed.
+//
+// By default the key from the config is used in both directions. Once a
+// shared secret is given to SetKey, separate keys for sending and receiving are
+// derived from it instead, according to the configured role.
+//
+// In the authenticated modes the keys can also be rotated, by setting
+// RekeyAfterPackets or RekeyInterval in the config. Each packet is then
+// prefixed with the EPOCH_SIZE-byte number of the key epoch it was sealed in.
+// The sender moves to a new epoch when either limit is reached, deriving its
+// key from the previous one, and the receiver follows when it authenticates a
+// packet from the new epoch. Packets from the previous epoch are accepted for a
+// grace period, so that those still in flight during the rotation are not
+// dropped. Rotation starts again from epoch zero whenever the keys are set.
 type EncryptionShaper struct {
+	// The key from the config.
 	key []byte
+
+	mode string
+
+	role string
+
+	// The limits on each key epoch, zero if not applied.
+	rekeyAfterPackets uint64
+	rekeyInterval     time.Duration
+
+	gracePeriod time.Duration
+
+	clock Clock
+
+	// The secret given to SetKey, nil if there has been none.
+	secret []byte
+
+	// The keys used by Transform and Restore, nil if there are none.
+	// They are replaced as a whole, so that a new key can be set while packets
+	// are being transformed.
+	keys atomic.Pointer[encryptionKeys]
+}
+
+// The keys for each direction.
+type encryptionKeys struct {
+	sendKey    []byte
+	receiveKey []byte
+
+	// The AEAD ciphers for the authenticated modes, nil in CBC mode.
+	sendAEAD    cipher.AEAD
+	receiveAEAD cipher.AEAD
+
+	// The key epochs in each direction, nil if keys are not rotated.
+	sendEpochs    *sendEpochs
+	receiveEpochs *receiveEpochs
 }
 
 func NewEncryptionShaper() *EncryptionShaper {
@@ -39,75 +138,377 @@ func NewEncryptionShaper() *EncryptionShaper {
 		return nil
 	}
 
-	shaper.Configure(string(jsonConfig))
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return shaper
 }
 
-// This method is required to implement the Transformer API.
-// @param {[]byte} key Key to set, not used by this class.
-func (shaper *EncryptionShaper) SetKey(key []byte) {
+// Derive the keys for each direction from a shared secret, replacing the key
+// from the config. The secret is kept, so the keys are derived again if the
+// shaper is reconfigured.
+// @param {[]byte} key Shared secret to derive the keys from.
+func (shaper *EncryptionShaper) SetKey(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty secret", ErrMalformedConfig)
+	}
+
+	shaper.secret = key
+	return shaper.setDirectionKeys()
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (shaper *EncryptionShaper) Configure(jsonConfig string) {
+func (shaper *EncryptionShaper) Configure(jsonConfig string) error {
 	var config EncryptionConfig
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
-		fmt.Println("Encryption shaper requires key parameter")
+		return fmt.Errorf("%w: encryption shaper requires key parameter: %v", ErrMalformedConfig, err)
+	}
+
+	return shaper.ConfigureStruct(config)
+}
+
+func (shaper *EncryptionShaper) ConfigureStruct(config EncryptionConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	key, err := deserializeEncryptionConfig(config)
+	if err != nil {
+		return err
+	}
+
+	if shaper.clock == nil {
+		shaper.clock = SystemClock
+	}
+
+	shaper.key = key
+	shaper.mode = config.Mode
+	shaper.role = config.Role
+	shaper.rekeyAfterPackets = config.RekeyAfterPackets
+	shaper.rekeyInterval = time.Duration(config.RekeyInterval) * time.Millisecond
+	shaper.gracePeriod = DEFAULT_REKEY_GRACE_PERIOD
+	if config.RekeyGracePeriod != 0 {
+		shaper.gracePeriod = time.Duration(config.RekeyGracePeriod) * time.Millisecond
+	}
+
+	return shaper.setDirectionKeys()
+}
+
+// Set the Clock used to time key epochs.
+// This takes effect the next time the shaper is configured.
+func (shaper *EncryptionShaper) SetClock(clock Clock) {
+	shaper.clock = clock
+}
+
+// Whether the keys are rotated.
+func (shaper *EncryptionShaper) rotating() bool {
+	return shaper.rekeyAfterPackets != 0 || shaper.rekeyInterval != 0
+}
+
+// Set the keys used for sending and receiving, deriving them from the secret
+// if there is one.
+func (shaper *EncryptionShaper) setDirectionKeys() error {
+	sendKey, receiveKey := shaper.key, shaper.key
+	if shaper.secret != nil {
+		var err error
+		sendKey, receiveKey, err = deriveDirectionKeys(shaper.secret, shaper.role, encryptionKeySize(shaper.mode, len(shaper.key)))
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(sendKey) == 0 {
+		shaper.keys.Store(nil)
+		return nil
+	}
+
+	sendAEAD, err := makeAEAD(shaper.mode, sendKey)
+	if err != nil {
+		return fmt.Errorf("%w: key: %v", ErrMalformedConfig, err)
+	}
+
+	receiveAEAD, err := makeAEAD(shaper.mode, receiveKey)
+	if err != nil {
+		return fmt.Errorf("%w: key: %v", ErrMalformedConfig, err)
+	}
+
+	keys := &encryptionKeys{sendKey: sendKey, receiveKey: receiveKey, sendAEAD: sendAEAD, receiveAEAD: receiveAEAD}
+	if shaper.rotating() {
+		keys.sendEpochs = &sendEpochs{current: epochKey{key: sendKey, aead: sendAEAD}, started: shaper.clock.Now()}
+		keys.receiveEpochs = &receiveEpochs{current: epochKey{key: receiveKey, aead: receiveAEAD}}
+	}
+
+	shaper.keys.Store(keys)
+	return nil
+}
+
+// The size of the keys to derive for a mode, given the size of the key from
+// the config.
+func encryptionKeySize(mode string, configured int) int {
+	switch mode {
+	case ENCRYPTION_MODE_AES_128_GCM:
+		return 16
+	case ENCRYPTION_MODE_AES_256_GCM, ENCRYPTION_MODE_CHACHA20_POLY1305:
+		return 32
+	default:
+		if configured == 0 {
+			return 32
+		}
+
+		return configured
+	}
+}
+
+// Check the config, recording any problems under path.
+func (config EncryptionConfig) validate(path string, problems *ConfigErrors) {
+	switch config.Role {
+	case "", ROLE_CLIENT, ROLE_SERVER:
+	default:
+		problems.add(fieldPath(path, "role"), "unknown role %q", config.Role)
+	}
+
+	// Without authentication a forged epoch could move the receiver on to
+	// keys the sender is not using.
+	if (config.RekeyAfterPackets != 0 || config.RekeyInterval != 0) && !isAuthenticatedMode(config.Mode) {
+		problems.add(fieldPath(path, "mode"), "key rotation requires an authenticated mode")
+	}
+
+	key, err := deserializeEncryptionModel(config.Key)
+	if err != nil {
+		problems.add(fieldPath(path, "key"), "invalid hex: %v", err)
+		return
+	}
+
+	// The key may be left to SetKey.
+	if len(key) == 0 {
+		if !isEncryptionMode(config.Mode) {
+			problems.add(fieldPath(path, "mode"), "unknown encryption mode %q", config.Mode)
+		}
+
+		return
+	}
+
+	_, err = makeAEAD(config.Mode, key)
+	if err != nil {
+		if isEncryptionMode(config.Mode) {
+			problems.add(fieldPath(path, "key"), "%v", err)
+		} else {
+			problems.add(fieldPath(path, "mode"), "%v", err)
+		}
 	}
+}
 
-	shaper.ConfigureStruct(config)
+// Check whether mode is one of the ENCRYPTION_MODE constants or empty.
+func isEncryptionMode(mode string) bool {
+	switch mode {
+	case "", ENCRYPTION_MODE_AES_CBC, ENCRYPTION_MODE_AES_128_GCM, ENCRYPTION_MODE_AES_256_GCM, ENCRYPTION_MODE_CHACHA20_POLY1305:
+		return true
+	default:
+		return false
+	}
 }
 
-func (shaper *EncryptionShaper) ConfigureStruct(config EncryptionConfig) {
-	shaper.key = deserializeEncryptionConfig(config)
+// Check whether mode is one of the AEAD modes, which detect changes to the
+// packet. The empty string selects CBC, which does not.
+func isAuthenticatedMode(mode string) bool {
+	switch mode {
+	case ENCRYPTION_MODE_AES_128_GCM, ENCRYPTION_MODE_AES_256_GCM, ENCRYPTION_MODE_CHACHA20_POLY1305:
+		return true
+	default:
+		return false
+	}
 }
 
 // Decode the key from string in the config information
-func deserializeEncryptionConfig(config EncryptionConfig) []byte {
-	return deserializeEncryptionModel(config.Key)
+func deserializeEncryptionConfig(config EncryptionConfig) ([]byte, error) {
+	key, err := deserializeEncryptionModel(config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key: %v", ErrMalformedConfig, err)
+	}
+
+	return key, nil
+}
+
+// Make the AEAD cipher for an authenticated mode.
+// Returns a nil AEAD in CBC mode, after checking that the key is a valid AES key.
+func makeAEAD(mode string, key []byte) (cipher.AEAD, error) {
+	switch mode {
+	case "", ENCRYPTION_MODE_AES_CBC:
+		_, err := aes.NewCipher(key)
+		return nil, err
+	case ENCRYPTION_MODE_AES_128_GCM, ENCRYPTION_MODE_AES_256_GCM:
+		keySize := 16
+		if mode == ENCRYPTION_MODE_AES_256_GCM {
+			keySize = 32
+		}
+
+		if len(key) != keySize {
+			return nil, fmt.Errorf("%s requires a %d byte key, got %d bytes", mode, keySize, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(block)
+	case ENCRYPTION_MODE_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %q", mode)
+	}
 }
 
 // Decode the header from a string in the header model
-func deserializeEncryptionModel(model string) []byte {
-	config, _ := hex.DecodeString(model)
-	return config
+func deserializeEncryptionModel(model string) ([]byte, error) {
+	return hex.DecodeString(model)
 }
 
 // Inject header.
-func (shaper *EncryptionShaper) Transform(buffer []byte) [][]byte {
+func (shaper *EncryptionShaper) Transform(buffer []byte) ([][]byte, error) {
+	keys := shaper.keys.Load()
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+
+	if keys.sendEpochs != nil {
+		current, err := keys.sendEpochs.next(shaper.mode, shaper.clock.Now(), shaper.rekeyAfterPackets, shaper.rekeyInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]byte, EPOCH_SIZE, EPOCH_SIZE+current.aead.NonceSize()+len(buffer)+current.aead.Overhead())
+		binary.BigEndian.PutUint32(result, current.epoch)
+		return [][]byte{append(result, seal(current.aead, buffer)...)}, nil
+	}
+
+	if keys.sendAEAD != nil {
+		return [][]byte{seal(keys.sendAEAD, buffer)}, nil
+	}
+
 	// This Transform performs the following steps:
 	// - Generate a new random CHUNK_SIZE-byte IV for every packet
 	// - Encrypt the packet contents with the random IV and symmetric key
 	// - Concatenate the IV and encrypted packet contents
 	var iv []byte = makeIV()
-	var encrypted []byte = encrypt(shaper.key, iv, buffer)
-	return [][]byte{append(iv, encrypted...)}
+	encrypted, err := encrypt(keys.sendKey, iv, buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{append(iv, encrypted...)}, nil
 }
 
-func (shaper *EncryptionShaper) Restore(buffer []byte) [][]byte {
+func (shaper *EncryptionShaper) Restore(buffer []byte) ([][]byte, error) {
+	keys := shaper.keys.Load()
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+
+	if keys.receiveEpochs != nil {
+		if len(buffer) < EPOCH_SIZE {
+			return nil, fmt.Errorf("%w: packet shorter than key epoch", ErrTruncatedPacket)
+		}
+
+		epoch := binary.BigEndian.Uint32(buffer)
+		plaintext, err := keys.receiveEpochs.open(shaper.mode, epoch, buffer[EPOCH_SIZE:], shaper.clock.Now(), shaper.gracePeriod)
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{plaintext}, nil
+	}
+
+	if keys.receiveAEAD != nil {
+		plaintext, err := open(keys.receiveAEAD, buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{plaintext}, nil
+	}
+
 	// This Restore performs the following steps:
 	// - Split the first CHUNK_SIZE bytes from the rest of the packet
 	//     The two parts are the IV and the encrypted packet contents
 	// - Decrypt the encrypted packet contents with the IV and symmetric key
 	// - Return the decrypted packet contents
+	if len(buffer) < IV_SIZE+CHUNK_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than an IV and one block", ErrTruncatedPacket, len(buffer))
+	}
+
 	var iv = buffer[0:IV_SIZE]
 	var ciphertext = buffer[IV_SIZE:]
-	return [][]byte{decrypt(shaper.key, iv, ciphertext)}
+	plaintext, err := decrypt(keys.receiveKey, iv, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{plaintext}, nil
 }
 
 // No-op (we have no state or any resources to Dispose).
 func (shaper *EncryptionShaper) Dispose() {
 }
 
+// The maximum number of bytes added to a packet of the given length.
+func (shaper *EncryptionShaper) Overhead(length int) int {
+	// All of the AEAD modes use a 12-byte nonce and a 16-byte tag.
+	if isAuthenticatedMode(shaper.mode) {
+		if shaper.rotating() {
+			return EPOCH_SIZE + chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+		}
+
+		return chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+	}
+
+	// The IV, the length prefix, and padding to a multiple of CHUNK_SIZE.
+	plaintextLength := 2 + length
+	paddedLength := (plaintextLength + CHUNK_SIZE - 1) / CHUNK_SIZE * CHUNK_SIZE
+	return IV_SIZE + paddedLength - length
+}
+
+// Encrypt and authenticate a packet with an AEAD cipher.
+// The result is a random nonce followed by the sealed contents.
+func seal(aead cipher.AEAD, buffer []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(buffer)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, buffer, nil)
+}
+
+// Authenticate and decrypt a packet produced by seal().
+func open(aead cipher.AEAD, buffer []byte) ([]byte, error) {
+	if len(buffer) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than a nonce and tag", ErrTruncatedPacket, len(buffer))
+	}
+
+	nonce := buffer[:aead.NonceSize()]
+	ciphertext := buffer[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+
+	return plaintext, nil
+}
+
 func makeIV() []byte {
 	var randomBytes = make([]byte, IV_SIZE)
 	rand.Read(randomBytes)
 	return randomBytes
 }
 
-func encrypt(key []byte, iv []byte, buffer []byte) []byte {
+func encrypt(key []byte, iv []byte, buffer []byte) ([]byte, error) {
+	if len(buffer) > math.MaxUint16 {
+		return nil, fmt.Errorf("packet of %d bytes is too long to encrypt", len(buffer))
+	}
+
 	var length []byte = encodeShort(uint16(len(buffer)))
 	var remainder = (len(length) + len(buffer)) % CHUNK_SIZE
 	var plaintext []byte
@@ -122,7 +523,7 @@ func encrypt(key []byte, iv []byte, buffer []byte) []byte {
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	var enc = cipher.NewCBCEncrypter(block, iv)
@@ -136,35 +537,26 @@ func encrypt(key []byte, iv []byte, buffer []byte) []byte {
 		ciphertext = append(ciphertext, cipherChunk...)
 	}
 
-	return ciphertext
+	return ciphertext, nil
 }
 
 func encodeShort(value uint16) []byte {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, value)
-	if err != nil {
-		fmt.Println("binary.Write failed:", err)
-	}
-	fmt.Printf("% x", buf.Bytes())
-
-	return buf.Bytes()
+	return binary.BigEndian.AppendUint16(nil, value)
 }
 
+// Decode the first two bytes of b, which must have at least two.
 func decodeShort(b []byte) uint16 {
-	var value uint16
-	reader := bytes.NewReader(b)
-	err := binary.Read(reader, binary.BigEndian, &value)
-	if err != nil {
-		fmt.Println("binary.Read failed:", err)
-	}
-
-	return value
+	return binary.BigEndian.Uint16(b)
 }
 
-func decrypt(key []byte, iv []byte, ciphertext []byte) []byte {
+func decrypt(key []byte, iv []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext)%CHUNK_SIZE != 0 {
+		return nil, fmt.Errorf("%w: ciphertext is not a multiple of the block size", ErrTruncatedPacket)
+	}
+
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	var dec = cipher.NewCBCDecrypter(block, iv)
 
@@ -181,9 +573,11 @@ func decrypt(key []byte, iv []byte, ciphertext []byte) []byte {
 	length := decodeShort(lengthBytes)
 	rest := plaintext[2:]
 
-	if len(rest) > int(length) {
-		return rest[0:length]
-	} else {
-		return rest
+	// CBC provides no integrity protection, but a length that does not fit
+	// the decrypted contents can only come from a corrupted or forged packet.
+	if int(length) > len(rest) || len(rest)-int(length) >= CHUNK_SIZE {
+		return nil, fmt.Errorf("%w: decrypted length does not match the packet", ErrAuthenticationFailed)
 	}
+
+	return rest[0:length], nil
 }
@@ -0,0 +1,173 @@
+package protean
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func newAuthenticatedShaper(t *testing.T, mode string, keySize int) *EncryptionShaper {
+	shaper := &EncryptionShaper{}
+	config := EncryptionConfig{Key: hex.EncodeToString(make([]byte, keySize)), Mode: mode}
+	err := shaper.ConfigureStruct(config)
+	if err != nil {
+		t.Fatalf("%s: %v", mode, err)
+	}
+
+	return shaper
+}
+
+var authenticatedModes = []struct {
+	mode    string
+	keySize int
+}{
+	{ENCRYPTION_MODE_AES_128_GCM, 16},
+	{ENCRYPTION_MODE_AES_256_GCM, 32},
+	{ENCRYPTION_MODE_CHACHA20_POLY1305, 32},
+}
+
+// Packets survive a round trip through every authenticated mode.
+func TestAuthenticatedRoundTrip(t *testing.T) {
+	for _, test := range authenticatedModes {
+		shaper := newAuthenticatedShaper(t, test.mode, test.keySize)
+		plain := []byte("attack at dawn")
+
+		transformed, err := shaper.Transform(plain)
+		if err != nil {
+			t.Fatalf("%s: %v", test.mode, err)
+		}
+
+		restored, err := shaper.Restore(transformed[0])
+		if err != nil {
+			t.Fatalf("%s: %v", test.mode, err)
+		}
+
+		if !bytes.Equal(restored[0], plain) {
+			t.Errorf("%s: restored %x, expected %x", test.mode, restored[0], plain)
+		}
+	}
+}
+
+// Flipping any bit of an authenticated packet causes it to be rejected.
+func TestAuthenticatedRejectsTampering(t *testing.T) {
+	for _, test := range authenticatedModes {
+		shaper := newAuthenticatedShaper(t, test.mode, test.keySize)
+		transformed, err := shaper.Transform([]byte("attack at dawn"))
+		if err != nil {
+			t.Fatalf("%s: %v", test.mode, err)
+		}
+
+		packet := transformed[0]
+		for index := range packet {
+			tampered := append([]byte{}, packet...)
+			tampered[index] ^= 0x01
+			_, err := shaper.Restore(tampered)
+			if !errors.Is(err, ErrAuthenticationFailed) {
+				t.Fatalf("%s: byte %d: expected ErrAuthenticationFailed, got %v", test.mode, index, err)
+			}
+		}
+
+		_, err = shaper.Restore(packet[:len(packet)/2])
+		if !errors.Is(err, ErrAuthenticationFailed) && !errors.Is(err, ErrTruncatedPacket) {
+			t.Errorf("%s: expected truncated packet to be rejected, got %v", test.mode, err)
+		}
+	}
+}
+
+// Keys of the wrong size for the mode are rejected at configuration time.
+func TestAuthenticatedKeySize(t *testing.T) {
+	shaper := &EncryptionShaper{}
+	config := EncryptionConfig{Key: hex.EncodeToString(make([]byte, 16)), Mode: ENCRYPTION_MODE_AES_256_GCM}
+	err := shaper.ConfigureStruct(config)
+	if !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("expected ErrMalformedConfig, got %v", err)
+	}
+}
+
+// A client and server sharing a secret can talk to each other, but use a
+// different key in each direction.
+func TestSetKeyDirections(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	modes := []string{ENCRYPTION_MODE_AES_CBC, ENCRYPTION_MODE_AES_128_GCM, ENCRYPTION_MODE_CHACHA20_POLY1305}
+	for _, mode := range modes {
+		shapers := map[string]*EncryptionShaper{}
+		for _, role := range []string{ROLE_CLIENT, ROLE_SERVER} {
+			shaper := &EncryptionShaper{}
+			err := shaper.ConfigureStruct(EncryptionConfig{Mode: mode, Role: role})
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+
+			if _, err := shaper.Transform([]byte("too soon")); !errors.Is(err, ErrNoKey) {
+				t.Errorf("%s: expected ErrNoKey before SetKey, got %v", mode, err)
+			}
+
+			err = shaper.SetKey(secret)
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+
+			shapers[role] = shaper
+		}
+
+		client, server := shapers[ROLE_CLIENT], shapers[ROLE_SERVER]
+		if keys := client.keys.Load(); bytes.Equal(keys.sendKey, keys.receiveKey) {
+			t.Errorf("%s: client uses the same key in both directions", mode)
+		}
+
+		for _, pair := range [][2]*EncryptionShaper{{client, server}, {server, client}} {
+			transformed, err := pair[0].Transform([]byte("attack at dawn"))
+			if err != nil {
+				t.Fatalf("%s: %v", mode, err)
+			}
+
+			restored, err := pair[1].Restore(transformed[0])
+			if err != nil || !bytes.Equal(restored[0], []byte("attack at dawn")) {
+				t.Errorf("%s: restored %q, %v", mode, restored, err)
+			}
+
+			// A reflected packet is not accepted by its sender.
+			reflected, err := pair[0].Restore(transformed[0])
+			if err == nil && bytes.Equal(reflected[0], []byte("attack at dawn")) {
+				t.Errorf("%s: sender restored its own packet", mode)
+			}
+		}
+
+		// Without a role the same key would be used in both directions.
+		shaper := &EncryptionShaper{}
+		if err := shaper.ConfigureStruct(EncryptionConfig{Mode: mode}); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+
+		if err := shaper.SetKey(secret); !errors.Is(err, ErrMalformedConfig) {
+			t.Errorf("%s: SetKey without a role: got %v", mode, err)
+		}
+	}
+}
+
+// SetKey on a ProteanShaper reaches its encryption stage, and survives
+// reconfiguration.
+func TestProteanShaperSetKey(t *testing.T) {
+	config := testPipelineConfig()
+	config.Encryption = EncryptionConfig{Mode: ENCRYPTION_MODE_AES_256_GCM}
+
+	shapers := map[string]*ProteanShaper{}
+	for _, role := range []string{ROLE_CLIENT, ROLE_SERVER} {
+		config.Encryption.Role = role
+		shaper := &ProteanShaper{}
+		err := shaper.SetKey([]byte("shared secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = shaper.ConfigureStruct(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		shapers[role] = shaper
+	}
+
+	roundTripBetween(t, shapers[ROLE_CLIENT], shapers[ROLE_SERVER], []byte("hello"))
+}
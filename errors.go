@@ -0,0 +1,96 @@
+package protean
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors reported by the TransformerV2 methods.
+// The shapers wrap these with additional detail, so callers should test for
+// them with errors.Is rather than by equality.
+var (
+	// The configuration could not be parsed or contains invalid values.
+	ErrMalformedConfig = errors.New("protean: malformed config")
+
+	// The packet failed an integrity or authenticity check.
+	ErrAuthenticationFailed = errors.New("protean: authentication failed")
+
+	// The packet is too short to contain the structure being decoded.
+	ErrTruncatedPacket = errors.New("protean: truncated packet")
+
+	// The packet has the right length but its fields are inconsistent.
+	ErrMalformedPacket = errors.New("protean: malformed packet")
+
+	// The packet does not begin with the header that should be removed.
+	ErrUnknownHeader = errors.New("protean: unknown header")
+
+	// A packet was transformed or restored before a key was set.
+	ErrNoKey = errors.New("protean: no key")
+
+	// The packet is too large to be sent within the configured limits.
+	ErrPacketTooLarge = errors.New("protean: packet too large")
+)
+
+// A problem with a single field of a config.
+// ConfigError wraps ErrMalformedConfig.
+type ConfigError struct {
+	// Path to the offending field using the JSON field names,
+	// for example "injection.addSequences[0].sequence".
+	Path string
+
+	// Description of the problem.
+	Problem string
+}
+
+func (this ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", this.Path, this.Problem)
+}
+
+func (this ConfigError) Unwrap() error {
+	return ErrMalformedConfig
+}
+
+// Every problem found when validating a config.
+type ConfigErrors []ConfigError
+
+func (this ConfigErrors) Error() string {
+	problems := make([]string, len(this))
+	for index, problem := range this {
+		problems[index] = problem.Error()
+	}
+
+	return fmt.Sprintf("%v: %s", ErrMalformedConfig, strings.Join(problems, "; "))
+}
+
+func (this ConfigErrors) Unwrap() []error {
+	errs := make([]error, len(this))
+	for index, problem := range this {
+		errs[index] = problem
+	}
+
+	return errs
+}
+
+// Return problems as an error, or nil if there are none.
+func (this ConfigErrors) err() error {
+	if len(this) == 0 {
+		return nil
+	}
+
+	return this
+}
+
+// Record a problem with the field at path.
+func (this *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*this = append(*this, ConfigError{Path: path, Problem: fmt.Sprintf(format, args...)})
+}
+
+// Join a field name onto the path of its parent.
+func fieldPath(parent string, field string) string {
+	if parent == "" {
+		return field
+	}
+
+	return parent + "." + field
+}
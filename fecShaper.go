@@ -0,0 +1,599 @@
+package protean
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// The maximum number of data and parity shards in a group, which is limited by
+// the size of the Reed-Solomon field.
+const MAX_FEC_SHARDS = 256
+
+// The size of the random identifier for a group of shards.
+const FEC_GROUP_ID_SIZE = 8
+
+// The FEC header consists of:
+//   - group id, 8 bytes
+//   - shard index within the group, 1 byte
+//   - number of data shards in the group, 1 byte
+//   - number of parity shards in the group, 1 byte
+const FEC_HEADER_SIZE = FEC_GROUP_ID_SIZE + 1 + 1 + 1
+
+// Each data shard is prefixed with its length before parity is computed, so
+// that a rebuilt shard can be trimmed to its original length.
+const FEC_LENGTH_SIZE = 2
+
+// The maximum number of groups held by the receiver at once.
+const FEC_MAX_GROUPS = 1024
+
+// The maximum number of shard bytes held by the receiver at once, across all
+// of the groups that are not yet complete. When a shard would exceed this, the
+// oldest groups are dropped to make room.
+const FEC_MAX_BUFFERED_BYTES = 4 * 1024 * 1024
+
+// How long the receiver waits for the shards of a group after the first one
+// arrives. Data fragments that have not arrived or been rebuilt by then are
+// counted as lost.
+const FEC_GROUP_TIMEOUT time.Duration = 10 * time.Second
+
+// Accepted in serialised form by Configure().
+type FECConfig struct {
+	// The number of fragments in each group protected by parity. The last
+	// group of a packet may have fewer.
+	DataShards int `json:"dataShards"`
+
+	// The number of parity packets sent for each group.
+	// A group can be rebuilt from any of its packets, as long as at least as
+	// many arrive as there are fragments in the group.
+	ParityShards int `json:"parityShards"`
+}
+
+// Creates a sample (non-random) config, suitable for testing.
+func sampleFECConfig() FECConfig {
+	return FECConfig{DataShards: 4, ParityShards: 2}
+}
+
+// Check the config, recording any problems under path.
+func (config FECConfig) validate(path string, problems *ConfigErrors) {
+	if config.DataShards < 1 || config.DataShards >= MAX_FEC_SHARDS {
+		problems.add(fieldPath(path, "dataShards"), "%d is out of range, must be from 1 to %d", config.DataShards, MAX_FEC_SHARDS-1)
+	}
+
+	if config.ParityShards < 1 || config.ParityShards >= MAX_FEC_SHARDS {
+		problems.add(fieldPath(path, "parityShards"), "%d is out of range, must be from 1 to %d", config.ParityShards, MAX_FEC_SHARDS-1)
+	} else if config.DataShards+config.ParityShards > MAX_FEC_SHARDS {
+		problems.add(fieldPath(path, "parityShards"), "%d data and %d parity shards is more than the maximum of %d", config.DataShards, config.ParityShards, MAX_FEC_SHARDS)
+	}
+}
+
+// Counts of the fragments handled by the receiving side of an FECShaper.
+type FECStats struct {
+	// Fragments that were lost, but rebuilt from the parity packets.
+	RecoveredFragments uint64
+
+	// Fragments that were lost and could not be rebuilt, because too few
+	// packets of their group arrived before it expired.
+	LostFragments uint64
+}
+
+// Sum two sets of counts.
+func (this FECStats) add(other FECStats) FECStats {
+	return FECStats{
+		RecoveredFragments: this.RecoveredFragments + other.RecoveredFragments,
+		LostFragments:      this.LostFragments + other.LostFragments,
+	}
+}
+
+// A Transformer that adds Reed-Solomon parity to fragmented packets, so that a
+// packet can be rebuilt when some of its fragments are lost.
+// It must directly follow a FragmentationShaper in the pipeline.
+//
+// The fragments of each packet are divided into groups of DataShards. Each
+// fragment is sent as soon as it is transformed, and ParityShards parity
+// packets are sent once the last fragment of its group has been.
+//
+// The receiver holds shards until their group is complete or expires, bounded
+// by FEC_MAX_GROUPS and FEC_MAX_BUFFERED_BYTES. As every group has the same
+// timeout, groups are expired in the order they arrived by a single Timer from
+// the Clock, which is only running while there are groups.
+//
+// Transform and Restore are safe for concurrent use, but Configure is not.
+type FECShaper struct {
+	dataShards   int
+	parityShards int
+
+	// Used to expire groups, nil for SystemClock.
+	clock Clock
+
+	// Guards all of the following fields, which are also used by the Timer.
+	lock sync.Mutex
+
+	// Runs until the oldest group expires, nil if there are none.
+	timer Timer
+
+	// Set by Dispose, after which the Timer is not restarted.
+	disposed bool
+
+	// The number of shard bytes held in groups that are not complete.
+	bufferedBytes int
+
+	// Reed-Solomon encoders by number of data shards.
+	encoders map[int]reedsolomon.Encoder
+
+	// Groups being sent, by packet id and group number.
+	sending map[string]*fecSendGroup
+
+	// Groups being received, by source and group id.
+	receiving map[string]*fecGroup
+
+	// The groups being received, in the order they were first seen.
+	order *list.List
+
+	stats FECStats
+}
+
+// The fragments of a group that have been sent so far.
+type fecSendGroup struct {
+	id     []byte
+	shards [][]byte
+	count  int
+}
+
+// The shards of a group that have been received so far.
+type fecGroup struct {
+	key     string
+	arrived time.Time
+	element *list.Element
+
+	dataShards   int
+	parityShards int
+
+	// Indexed by shard index, nil for those that have not arrived.
+	shards   [][]byte
+	received int
+
+	// The number of data shards received.
+	dataReceived int
+
+	// The number of shard bytes held.
+	bytes int
+
+	// Set once every fragment has been received or rebuilt. The group is kept
+	// until it expires, so that late shards are not taken for a new group.
+	done bool
+}
+
+func NewFECShaper() *FECShaper {
+	shaper := &FECShaper{}
+	config := sampleFECConfig()
+	jsonConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
+	return shaper
+}
+
+// This method is required to implement the Transformer API.
+// @param {[]byte} key Key to set, not used by this class.
+func (shaper *FECShaper) SetKey(key []byte) error {
+	return nil
+}
+
+// Set the Clock used to expire groups.
+// This takes effect the next time the shaper is configured.
+func (shaper *FECShaper) SetClock(clock Clock) {
+	shaper.clock = clock
+}
+
+// Configure the Transformer with the number of data and parity shards.
+func (shaper *FECShaper) Configure(jsonConfig string) error {
+	var config FECConfig
+	err := json.Unmarshal([]byte(jsonConfig), &config)
+	if err != nil {
+		return fmt.Errorf("%w: FEC shaper requires dataShards and parityShards parameters: %v", ErrMalformedConfig, err)
+	}
+
+	return shaper.ConfigureStruct(config)
+}
+
+func (shaper *FECShaper) ConfigureStruct(config FECConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	if shaper.clock == nil {
+		shaper.clock = SystemClock
+	}
+
+	shaper.Dispose()
+
+	shaper.dataShards = config.DataShards
+	shaper.parityShards = config.ParityShards
+	shaper.encoders = make(map[int]reedsolomon.Encoder)
+	shaper.sending = make(map[string]*fecSendGroup)
+	shaper.receiving = make(map[string]*fecGroup)
+	shaper.order = list.New()
+	shaper.bufferedBytes = 0
+	shaper.disposed = false
+	shaper.stats = FECStats{}
+	return nil
+}
+
+// Send a fragment, followed by the parity for its group if it is the last
+// fragment of the group.
+func (this *FECShaper) Transform(buffer []byte) ([][]byte, error) {
+	fragment, err := decodeFragment(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("FEC shaper must follow fragmentation: %w", err)
+	}
+
+	group := int(fragment.Index) / this.dataShards
+	first := group * this.dataShards
+	dataShards := int(fragment.Count) - first
+	if dataShards > this.dataShards {
+		dataShards = this.dataShards
+	}
+
+	key := fmt.Sprintf("%x/%d", fragment.Id, group)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	sending, ok := this.sending[key]
+	if !ok {
+		sending = &fecSendGroup{id: makeGroupId(), shards: make([][]byte, dataShards)}
+		this.sending[key] = sending
+	}
+
+	index := int(fragment.Index) - first
+	if sending.shards[index] == nil {
+		sending.shards[index] = buffer
+		sending.count++
+	}
+
+	results := [][]byte{encodeShard(sending.id, index, dataShards, this.parityShards, buffer)}
+	if sending.count < dataShards {
+		return results, nil
+	}
+
+	delete(this.sending, key)
+
+	parity, err := this.encodeParity(sending.shards)
+	if err != nil {
+		return nil, err
+	}
+
+	for offset, shard := range parity {
+		results = append(results, encodeShard(sending.id, dataShards+offset, dataShards, this.parityShards, shard))
+	}
+
+	return results, nil
+}
+
+// Restore a shard from an unknown source.
+func (this *FECShaper) Restore(buffer []byte) ([][]byte, error) {
+	return this.RestoreFrom("", buffer)
+}
+
+// Return the fragment carried by a data shard, along with any fragments of
+// its group that can now be rebuilt. Parity shards yield only rebuilt
+// fragments.
+func (this *FECShaper) RestoreFrom(source string, buffer []byte) ([][]byte, error) {
+	if len(buffer) < FEC_HEADER_SIZE {
+		return nil, fmt.Errorf("%w: FEC shard shorter than header", ErrTruncatedPacket)
+	}
+
+	id := buffer[:FEC_GROUP_ID_SIZE]
+	index := int(buffer[FEC_GROUP_ID_SIZE])
+	dataShards := int(buffer[FEC_GROUP_ID_SIZE+1])
+	parityShards := int(buffer[FEC_GROUP_ID_SIZE+2])
+	shard := buffer[FEC_HEADER_SIZE:]
+
+	// The sender groups the fragments as configured, ending with a smaller
+	// group if the fragments run out, so any other counts are forged. They
+	// are rejected before a group is made, so that the number of encoders
+	// is bounded.
+	if dataShards == 0 || dataShards > this.dataShards || parityShards != this.parityShards || index >= dataShards+parityShards {
+		return nil, fmt.Errorf("%w: FEC shard %d of %d data and %d parity shards", ErrMalformedPacket, index, dataShards, parityShards)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	this.expire(now)
+
+	key := source + "/" + hex.EncodeToString(id)
+	group, ok := this.receiving[key]
+	if !ok {
+		for len(this.receiving) >= FEC_MAX_GROUPS {
+			this.drop(this.order.Front().Value.(*fecGroup))
+		}
+
+		group = &fecGroup{key: key, arrived: now, dataShards: dataShards, parityShards: parityShards, shards: make([][]byte, dataShards+parityShards)}
+		group.element = this.order.PushBack(group)
+		this.receiving[key] = group
+		this.startTimer(now)
+	} else if group.dataShards != dataShards || group.parityShards != parityShards {
+		return nil, fmt.Errorf("%w: FEC shard disagrees with its group about the number of shards", ErrMalformedPacket)
+	}
+
+	// Late or duplicate shards carry nothing new.
+	if group.done || group.shards[index] != nil {
+		return [][]byte{}, nil
+	}
+
+	results := [][]byte{}
+	if index < dataShards {
+		results = append(results, shard)
+		group.dataReceived++
+	}
+
+	// The shard is copied, so that the group holds no more than its share of
+	// the caller's buffer.
+	if !this.makeRoom(group, len(shard)) {
+		return results, nil
+	}
+
+	group.shards[index] = append([]byte(nil), shard...)
+	group.received++
+	group.bytes = group.bytes + len(shard)
+	this.bufferedBytes = this.bufferedBytes + len(shard)
+
+	if group.dataReceived == dataShards {
+		this.finish(group)
+	} else if group.received >= dataShards {
+		rebuilt, err := this.rebuild(group)
+		this.finish(group)
+		if err != nil {
+			return nil, err
+		}
+
+		this.stats.RecoveredFragments = this.stats.RecoveredFragments + uint64(len(rebuilt))
+		results = append(results, rebuilt...)
+	}
+
+	return results, nil
+}
+
+// Stop the Timer. Groups are no longer expired, except when shards arrive.
+func (shaper *FECShaper) Dispose() {
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
+	shaper.disposed = true
+	if shaper.timer != nil {
+		shaper.timer.Stop()
+		shaper.timer = nil
+	}
+}
+
+// Returns the counts of recovered and lost fragments so far.
+func (this *FECShaper) Stats() FECStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.expire(this.clock.Now())
+	return this.stats
+}
+
+// Each fragment gains a header, and each parity packet is also as long as the
+// length prefix of the longest fragment in its group.
+func (this *FECShaper) Overhead(length int) int {
+	return FEC_HEADER_SIZE + FEC_LENGTH_SIZE
+}
+
+// Make the Reed-Solomon encoder for groups with the given number of data
+// shards, reusing one made earlier if possible.
+func (this *FECShaper) encoder(dataShards int) (reedsolomon.Encoder, error) {
+	if encoder, ok := this.encoders[dataShards]; ok {
+		return encoder, nil
+	}
+
+	encoder, err := reedsolomon.New(dataShards, this.parityShards)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	this.encoders[dataShards] = encoder
+	return encoder, nil
+}
+
+// Compute the parity shards for a group of fragments.
+func (this *FECShaper) encodeParity(fragments [][]byte) ([][]byte, error) {
+	length := 0
+	for _, fragment := range fragments {
+		if len(fragment) > length {
+			length = len(fragment)
+		}
+	}
+
+	length = length + FEC_LENGTH_SIZE
+	shards := make([][]byte, len(fragments)+this.parityShards)
+	for index := range shards {
+		shards[index] = make([]byte, length)
+		if index < len(fragments) {
+			copy(shards[index], encodeShort(uint16(len(fragments[index]))))
+			copy(shards[index][FEC_LENGTH_SIZE:], fragments[index])
+		}
+	}
+
+	encoder, err := this.encoder(len(fragments))
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.Encode(shards)
+	if err != nil {
+		return nil, err
+	}
+
+	return shards[len(fragments):], nil
+}
+
+// Rebuild the missing fragments of a group from the shards that have arrived.
+func (this *FECShaper) rebuild(group *fecGroup) ([][]byte, error) {
+	length := 0
+	for index := group.dataShards; index < len(group.shards); index++ {
+		if group.shards[index] != nil {
+			length = len(group.shards[index])
+			break
+		}
+	}
+
+	shards := make([][]byte, len(group.shards))
+	for index, shard := range group.shards {
+		if shard == nil {
+			continue
+		}
+
+		if index < group.dataShards {
+			if len(shard)+FEC_LENGTH_SIZE > length {
+				return nil, fmt.Errorf("%w: FEC data shard is longer than the parity", ErrMalformedPacket)
+			}
+
+			shards[index] = make([]byte, length)
+			copy(shards[index], encodeShort(uint16(len(shard))))
+			copy(shards[index][FEC_LENGTH_SIZE:], shard)
+		} else {
+			if len(shard) != length {
+				return nil, fmt.Errorf("%w: FEC parity shards differ in length", ErrMalformedPacket)
+			}
+
+			shards[index] = shard
+		}
+	}
+
+	encoder, err := this.encoder(group.dataShards)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.ReconstructData(shards)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	var rebuilt [][]byte
+	for index := 0; index < group.dataShards; index++ {
+		if group.shards[index] != nil {
+			continue
+		}
+
+		fragmentLength := int(decodeShort(shards[index][:FEC_LENGTH_SIZE]))
+		if fragmentLength > length-FEC_LENGTH_SIZE {
+			return nil, fmt.Errorf("%w: rebuilt FEC shard has an invalid length", ErrMalformedPacket)
+		}
+
+		rebuilt = append(rebuilt, shards[index][FEC_LENGTH_SIZE:FEC_LENGTH_SIZE+fragmentLength])
+	}
+
+	return rebuilt, nil
+}
+
+// Discard the groups that have expired by now.
+func (this *FECShaper) expire(now time.Time) {
+	for element := this.order.Front(); element != nil; element = this.order.Front() {
+		group := element.Value.(*fecGroup)
+		if now.Sub(group.arrived) < FEC_GROUP_TIMEOUT {
+			return
+		}
+
+		this.drop(group)
+	}
+}
+
+// Start the Timer for the oldest group to expire, if it is not already
+// running.
+func (this *FECShaper) startTimer(now time.Time) {
+	if this.timer != nil || this.disposed {
+		return
+	}
+
+	if front := this.order.Front(); front != nil {
+		due := front.Value.(*fecGroup).arrived.Add(FEC_GROUP_TIMEOUT)
+		this.timer = this.clock.AfterFunc(due.Sub(now), this.tick)
+	}
+}
+
+// Called by the Timer when a group is due to expire.
+func (this *FECShaper) tick() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	this.timer = nil
+	this.expire(now)
+	this.startTimer(now)
+}
+
+// Drop the oldest groups other than group until a shard of the given length
+// fits within FEC_MAX_BUFFERED_BYTES. If it still does not fit, group itself
+// is dropped and false returned.
+func (this *FECShaper) makeRoom(group *fecGroup, length int) bool {
+	for element := this.order.Front(); element != nil && this.bufferedBytes+length > FEC_MAX_BUFFERED_BYTES; {
+		next := element.Next()
+		if oldest := element.Value.(*fecGroup); oldest != group && !oldest.done {
+			this.drop(oldest)
+		}
+
+		element = next
+	}
+
+	if this.bufferedBytes+length > FEC_MAX_BUFFERED_BYTES {
+		this.drop(group)
+		return false
+	}
+
+	return true
+}
+
+// Stop tracking a group, counting any fragments that never arrived.
+func (this *FECShaper) drop(group *fecGroup) {
+	if !group.done {
+		this.stats.LostFragments = this.stats.LostFragments + uint64(group.dataShards-group.dataReceived)
+		this.bufferedBytes = this.bufferedBytes - group.bytes
+	}
+
+	delete(this.receiving, group.key)
+	this.order.Remove(group.element)
+}
+
+// Mark the group as complete and release its shards.
+func (this *FECShaper) finish(group *fecGroup) {
+	this.bufferedBytes = this.bufferedBytes - group.bytes
+	group.done = true
+	group.shards = nil
+	group.bytes = 0
+}
+
+// Make a random identifier for a group of shards.
+func makeGroupId() []byte {
+	id := make([]byte, FEC_GROUP_ID_SIZE)
+	rand.Read(id)
+	return id
+}
+
+// Serialize a shard so that it can be sent as a packet.
+func encodeShard(id []byte, index int, dataShards int, parityShards int, shard []byte) []byte {
+	result := make([]byte, 0, FEC_HEADER_SIZE+len(shard))
+	result = append(result, id...)
+	result = append(result, byte(index), byte(dataShards), byte(parityShards))
+	result = append(result, shard...)
+	return result
+}
@@ -0,0 +1,173 @@
+package protean
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Make a pair of shapers that fragment, add parity and encrypt, with 4 data
+// and 2 parity shards per group.
+func newFECShapers(t *testing.T, clock Clock) (*ProteanShaper, *ProteanShaper) {
+	config := sampleProteanConfig()
+	config.Fragmentation.MaxLength = 576
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_FEC},
+		{Name: STAGE_ENCRYPTION},
+	}}
+
+	var shapers [2]*ProteanShaper
+	for index := range shapers {
+		shapers[index] = &ProteanShaper{}
+		shapers[index].SetClock(clock)
+		err := shapers[index].ConfigureStruct(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return shapers[0], shapers[1]
+}
+
+// Restore the packets, except those at the dropped positions.
+func restoreWithLoss(t *testing.T, receiver *ProteanShaper, packets [][]byte, dropped ...int) [][]byte {
+	var restored [][]byte
+	for index, packet := range packets {
+		lost := false
+		for _, drop := range dropped {
+			lost = lost || drop == index
+		}
+
+		if lost {
+			continue
+		}
+
+		results, err := receiver.Restore(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored = append(restored, results...)
+	}
+
+	return restored
+}
+
+func TestFECRecoversLostFragments(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender, receiver := newFECShapers(t, clock)
+
+	// Six fragments, sent as a group of four with its parity followed by a
+	// group of two with its parity.
+	plain := randomPacket(2800)
+	packets, err := sender.Transform(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packets) != 6+4 {
+		t.Fatalf("expected 10 packets, got %d", len(packets))
+	}
+
+	// Lose two fragments of the first group and one of the second.
+	restored := restoreWithLoss(t, receiver, packets, 0, 2, 6)
+	if len(restored) != 1 || !bytes.Equal(restored[0], plain) {
+		t.Fatalf("packet was not rebuilt, restored %d packets", len(restored))
+	}
+
+	clock.Advance(FEC_GROUP_TIMEOUT)
+	stats := receiver.Stats().FEC
+	if stats.RecoveredFragments != 3 || stats.LostFragments != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFECCountsLostFragments(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender, receiver := newFECShapers(t, clock)
+
+	packets, err := sender.Transform(randomPacket(2800))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose three of the six packets of the first group.
+	restored := restoreWithLoss(t, receiver, packets, 0, 1, 4)
+	if len(restored) != 0 {
+		t.Fatalf("expected the packet to be lost, restored %d packets", len(restored))
+	}
+
+	if stats := receiver.Stats().FEC; stats.LostFragments != 0 {
+		t.Errorf("counted lost fragments before the group expired: %+v", stats)
+	}
+
+	clock.Advance(FEC_GROUP_TIMEOUT)
+	stats := receiver.Stats().FEC
+	if stats.RecoveredFragments != 0 || stats.LostFragments != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFECPipelineOrder(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_FEC},
+	}}
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected an FEC stage without fragmentation to be rejected")
+	}
+}
+
+// Groups that never complete are held within FEC_MAX_BUFFERED_BYTES, and are
+// expired by the Clock without waiting for another shard.
+func TestFECLimits(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	shaper := &FECShaper{clock: clock}
+	if err := shaper.ConfigureStruct(sampleFECConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first shard of groups of two, each of the largest size.
+	shard := randomPacket(MAX_DATAGRAM_SIZE - FEC_HEADER_SIZE)
+	groups := 2*FEC_MAX_BUFFERED_BYTES/len(shard) + 1
+	for index := 0; index < groups; index++ {
+		restored, err := shaper.Restore(encodeShard(makeGroupId(), 0, 2, 2, shard))
+		if err != nil || len(restored) != 1 || !bytes.Equal(restored[0], shard) {
+			t.Fatalf("group %d: restored %d fragments: %v", index, len(restored), err)
+		}
+
+		if shaper.bufferedBytes > FEC_MAX_BUFFERED_BYTES {
+			t.Fatalf("group %d: %d bytes buffered", index, shaper.bufferedBytes)
+		}
+	}
+
+	// Shards with counts the sender would not use make no group.
+	for _, counts := range [][2]int{{2, 1}, {2, 3}, {5, 2}} {
+		_, err := shaper.Restore(encodeShard(makeGroupId(), 0, counts[0], counts[1], shard))
+		if !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("%d data and %d parity shards: got %v", counts[0], counts[1], err)
+		}
+	}
+
+	if len(shaper.encoders) != 0 {
+		t.Errorf("%d encoders made for shards that were not rebuilt", len(shaper.encoders))
+	}
+
+	// Each group dropped to make room is missing a fragment.
+	held := FEC_MAX_BUFFERED_BYTES / len(shard)
+	if len(shaper.receiving) != held || shaper.stats.LostFragments != uint64(groups-held) {
+		t.Errorf("%d groups held, %d fragments lost", len(shaper.receiving), shaper.stats.LostFragments)
+	}
+
+	clock.Advance(FEC_GROUP_TIMEOUT)
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
+	if len(shaper.receiving) != 0 || shaper.bufferedBytes != 0 || shaper.stats.LostFragments != uint64(groups) {
+		t.Errorf("after expiry, %d groups and %d bytes held, %d fragments lost", len(shaper.receiving), shaper.bufferedBytes, shaper.stats.LostFragments)
+	}
+}
@@ -2,18 +2,18 @@ package protean
 
 import (
 	"crypto/rand"
-	"errors"
+	"fmt"
 )
 
 // Header size: length + id + fragment number + total number
-const HEADER_SIZE int = 2 + 32 + 1 + 1
+const HEADER_SIZE int = 2 + 32 + 2 + 2
 
 // A Fragment represents a piece of a packet when fragmentation has occurred.
 type Fragment struct {
 	Length  uint16
 	Id      []byte
-	Index   uint8
-	Count   uint8
+	Index   uint16
+	Count   uint16
 	Payload []byte
 	Padding []byte
 }
@@ -32,18 +32,28 @@ func makeRandomId() []byte {
 // The Fragment format is as follows:
 //   - length of the payload, 2 bytes
 //   - id, 32 bytes
-//   - fragment number, 1 byte
-//   - total number of fragments for this id, 1 byte
+//   - fragment number, 2 bytes
+//   - total number of fragments for this id, 2 bytes
 //   - payload, number of bytes specified by length field
 //   - padding, variable number of bytes, whatever is left after the payload
 func decodeFragment(buffer []byte) (*Fragment, error) {
+	if len(buffer) < HEADER_SIZE {
+		return nil, fmt.Errorf("%w: fragment of %d bytes is shorter than the fragment header", ErrTruncatedPacket, len(buffer))
+	}
+
 	lengthBytes := buffer[0:2]
 	fragmentId := buffer[2:34]
-	fragmentNumber := buffer[34:35]
-	totalNumber := buffer[35:36]
-	remaining := buffer[36:]
+	fragmentNumber := buffer[34:36]
+	totalNumber := buffer[36:38]
+	remaining := buffer[38:]
 
 	var length = decodeShort(lengthBytes)
+	var index = decodeShort(fragmentNumber)
+	var count = decodeShort(totalNumber)
+
+	if index >= count {
+		return nil, fmt.Errorf("%w: fragment number %d is not less than the total %d", ErrMalformedPacket, index, count)
+	}
 
 	var payload []byte
 	var padding []byte
@@ -51,32 +61,32 @@ func decodeFragment(buffer []byte) (*Fragment, error) {
 	if len(remaining) > int(length) {
 		payload = remaining[:length]
 		padding = remaining[length:]
-	} else if len(buffer) == int(length) {
+	} else if len(remaining) == int(length) {
 		payload = remaining
 		padding = []byte{}
 	} else {
 		// buffer.byteLength < length
-		return nil, errors.New("Fragment could not be decoded, shorter than length")
+		return nil, fmt.Errorf("%w: fragment could not be decoded, shorter than length", ErrTruncatedPacket)
 	}
 
-	return &Fragment{Length: length, Id: fragmentId, Index: decodeByte(fragmentNumber), Count: decodeByte(totalNumber), Payload: payload, Padding: padding}, nil
+	return &Fragment{Length: length, Id: fragmentId, Index: index, Count: count, Payload: payload, Padding: padding}, nil
 }
 
 // Serialize a Fragment object so that it can be sent as a packet
 // The Fragment format is as follows:
 //   - length of the payload, 2 bytes
 //   - id, 32 bytes
-//   - fragment number, 1 byte
-//   - total number of fragments for this id, 1 byte
+//   - fragment number, 2 bytes
+//   - total number of fragments for this id, 2 bytes
 //   - payload, number of bytes specified by length field
 //   - padding, variable number of bytes, whatever is left after the payload
 func encodeFragment(fragment Fragment) []byte {
-	var result []byte
+	var result = make([]byte, 0, HEADER_SIZE+len(fragment.Payload)+len(fragment.Padding))
 
 	result = append(result, encodeShort(fragment.Length)...)
 	result = append(result, fragment.Id...)
-	result = append(result, encodeByte(fragment.Index)...)
-	result = append(result, encodeByte(fragment.Count)...)
+	result = append(result, encodeShort(fragment.Index)...)
+	result = append(result, encodeShort(fragment.Count)...)
 	result = append(result, fragment.Payload...)
 	result = append(result, fragment.Padding...)
 
@@ -4,11 +4,21 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 )
 
 // Accepted in serialised form by Configure().
 type FragmentationConfig struct {
-	MaxLength uint16
+	// The maximum length of a fragment, including its headers and padding.
+	MaxLength uint16 `json:"maxLength"`
+
+	// Limits on the memory used to hold partial packets.
+	Limits DefragmenterLimits `json:"limits"`
+
+	// How long to wait for the rest of a packet after its first fragment
+	// arrives, in milliseconds. Zero selects CACHE_EXPIRATION_TIME.
+	ReassemblyTimeout uint32 `json:"reassemblyTimeout,omitempty"`
 }
 
 // Creates a sample (non-random) config, suitable for testing.
@@ -16,11 +26,48 @@ func sampleFragmentationConfig() FragmentationConfig {
 	return FragmentationConfig{MaxLength: 1440}
 }
 
+// Check the config, recording any problems under path.
+func (config FragmentationConfig) validate(path string, problems *ConfigErrors) {
+	// Each fragment must have room for the headers, padding and at least one
+	// byte of payload. The overhead of any following stages is checked when
+	// they are known.
+	if int(config.MaxLength) < fragmentSize(1) {
+		problems.add(fieldPath(path, "maxLength"), "%d is too small, must be at least %d", config.MaxLength, fragmentSize(1))
+	}
+
+	config.Limits.validate(fieldPath(path, "limits"), problems)
+}
+
 // A Transformer that enforces a maximum packet length.
+// Packets are split into as many fragments as are needed so that every
+// fragment, after it has been through the downstream stages, is no longer
+// than the maximum length. Transform returns ErrPacketTooLarge for a packet
+// that would need more fragments than the receiver accepts.
+//
+// Transform and Restore are safe for concurrent use, but Configure is not.
 type FragmentationShaper struct {
 	maxLength uint16
 
+	// The most fragments a packet may be split into, the limit the receiver
+	// applies.
+	maxFragments int
+
+	// The MTU of the ProteanConfig, zero if there is none. Fragments are
+	// sized for the smaller of this and maxLength.
+	mtu uint16
+
+	// The stages that follow this one in a pipeline, which expand each
+	// fragment after it has been made.
+	downstream []TransformerV2
+
 	fragmentBuffer *Defragmenter
+
+	// Used by the Defragmenter to expire partial packets, nil for SystemClock.
+	clock Clock
+
+	// Serializes adding a fragment and collecting the packets it completes,
+	// so that each packet is returned by the Restore that completed it.
+	restoreLock sync.Mutex
 }
 
 func NewFragmentationShaper() *FragmentationShaper {
@@ -31,30 +78,54 @@ func NewFragmentationShaper() *FragmentationShaper {
 		return nil
 	}
 
-	shaper.Configure(string(jsonConfig))
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return shaper
 }
 
 // This method is required to implement the Transformer API.
 // @param {[]byte} key Key to set, not used by this class.
-func (shaper *FragmentationShaper) SetKey(key []byte) {
+func (shaper *FragmentationShaper) SetKey(key []byte) error {
+	return nil
+}
+
+// Set the Clock used to expire partial packets.
+// This takes effect the next time the shaper is configured.
+func (shaper *FragmentationShaper) SetClock(clock Clock) {
+	shaper.clock = clock
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (shaper *FragmentationShaper) Configure(jsonConfig string) {
+func (shaper *FragmentationShaper) Configure(jsonConfig string) error {
 	var config FragmentationConfig
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
-		fmt.Println("Fragmentation shaper requires key parameter")
+		return fmt.Errorf("%w: fragmentation shaper requires maxLength parameter: %v", ErrMalformedConfig, err)
 	}
 
-	shaper.ConfigureStruct(config)
+	return shaper.ConfigureStruct(config)
 }
 
-func (shaper *FragmentationShaper) ConfigureStruct(config FragmentationConfig) {
+func (shaper *FragmentationShaper) ConfigureStruct(config FragmentationConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	if shaper.fragmentBuffer != nil {
+		shaper.fragmentBuffer.Dispose()
+	}
+
 	shaper.maxLength = config.MaxLength
-	shaper.fragmentBuffer = &Defragmenter{}
+	shaper.maxFragments = config.Limits.withDefaults().MaxFragmentsPerPacket
+	timeout := time.Duration(config.ReassemblyTimeout) * time.Millisecond
+	shaper.fragmentBuffer = NewDefragmenter(config.Limits, timeout, shaper.clock)
+	return nil
 }
 
 // Perform the following steps:
@@ -62,8 +133,12 @@ func (shaper *FragmentationShaper) ConfigureStruct(config FragmentationConfig) {
 // - Add fragment headers to each fragment
 // - Add fill if necessary to pad each fragment to a multiple of CHUNK_SIZE
 // - Encode fragments into new buffers
-func (this *FragmentationShaper) Transform(buffer []byte) [][]byte {
-	var fragmentList = this.makeFragments(buffer)
+func (this *FragmentationShaper) Transform(buffer []byte) ([][]byte, error) {
+	fragmentList, err := this.makeFragments(buffer)
+	if err != nil {
+		return nil, err
+	}
+
 	var results [][]byte
 
 	for _, fragment := range fragmentList {
@@ -71,7 +146,12 @@ func (this *FragmentationShaper) Transform(buffer []byte) [][]byte {
 		results = append(results, result)
 	}
 
-	return results
+	return results, nil
+}
+
+// Restore a fragment from an unknown source.
+func (this *FragmentationShaper) Restore(buffer []byte) ([][]byte, error) {
+	return this.RestoreFrom("", buffer)
 }
 
 // Perform the following steps:
@@ -79,69 +159,133 @@ func (this *FragmentationShaper) Transform(buffer []byte) [][]byte {
 // - Remove fill
 // - Remove fragment headers
 // - Attempt to defragment, yielding zero or more new buffers
-func (this *FragmentationShaper) Restore(buffer []byte) [][]byte {
+func (this *FragmentationShaper) RestoreFrom(source string, buffer []byte) ([][]byte, error) {
 	fragment, err := decodeFragment(buffer)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	this.fragmentBuffer.AddFragment(fragment)
+	this.restoreLock.Lock()
+	defer this.restoreLock.Unlock()
+
+	this.fragmentBuffer.AddFragmentFrom(source, fragment)
 	if this.fragmentBuffer.CompleteCount() > 0 {
 		var complete = this.fragmentBuffer.GetComplete()
-		return complete
+		return complete, nil
 	} else {
-		return [][]byte{}
+		return [][]byte{}, nil
 	}
 }
 
-// No-op (we have no state or any resources to Dispose).
+// Stop expiring partial packets.
 func (shaper *FragmentationShaper) Dispose() {
+	if shaper.fragmentBuffer != nil {
+		shaper.fragmentBuffer.Dispose()
+	}
+}
+
+// Returns the counts of fragments dropped by the Defragmenter.
+func (shaper *FragmentationShaper) Stats() DefragmenterStats {
+	return shaper.fragmentBuffer.Stats()
 }
 
 // Perform the following steps:
 // - Break buffer into one or more fragments
 // - Add fragment headers to each fragment
 // - Add fill if necessary to pad each fragment to a multiple of CHUNK_SIZE
-func (this *FragmentationShaper) makeFragments(buffer []byte) []Fragment {
-	payloadSize := len(buffer) + HEADER_SIZE + IV_SIZE
-	fillSize := CHUNK_SIZE - (payloadSize % CHUNK_SIZE)
-	packetSize := payloadSize + fillSize
-
-	if packetSize <= int(this.maxLength) {
-		var fill = make([]byte, fillSize)
-		if fillSize > 0 {
-			rand.Read(fill)
+func (this *FragmentationShaper) makeFragments(buffer []byte) ([]Fragment, error) {
+	payloadSize, err := this.payloadSize()
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty buffer still needs one fragment to carry it.
+	count := (len(buffer) + payloadSize - 1) / payloadSize
+	if count == 0 {
+		count = 1
+	}
+
+	// The receiver would drop the fragments of a packet split any further.
+	if count > this.maxFragments {
+		return nil, fmt.Errorf("%w: packet of %d bytes needs %d fragments, more than the maximum of %d", ErrPacketTooLarge, len(buffer), count, this.maxFragments)
+	}
+
+	id := makeRandomId()
+	fragmentList := make([]Fragment, count)
+	for index := range fragmentList {
+		start := index * payloadSize
+		end := start + payloadSize
+		if end > len(buffer) {
+			end = len(buffer)
 		}
 
-		// One fragment
-		fragment := Fragment{Length: uint16(len(buffer)), Id: makeRandomId(), Index: 0, Count: 1, Payload: buffer, Padding: fill}
+		payload := buffer[start:end]
+		fill := make([]byte, fillSize(HEADER_SIZE+len(payload)))
+		rand.Read(fill)
 
-		return []Fragment{fragment}
-	} else {
-		// Multiple fragments
-		firstLength := int(this.maxLength) - (HEADER_SIZE + IV_SIZE + fillSize)
-		//		restLength := len(buffer) - firstLength
-		first := this.makeFragments(buffer[:firstLength])
-		rest := this.makeFragments(buffer[:firstLength])
-		fragmentList := append(first, rest...)
+		fragmentList[index] = Fragment{Length: uint16(len(payload)), Id: id, Index: uint16(index), Count: uint16(count), Payload: payload, Padding: fill}
+	}
+
+	return fragmentList, nil
+}
 
-		return fixFragments(fragmentList)
+// The number of bytes of fill needed to pad length to a multiple of
+// CHUNK_SIZE.
+func fillSize(length int) int {
+	return (CHUNK_SIZE - length%CHUNK_SIZE) % CHUNK_SIZE
+}
+
+// The size of an encoded fragment with a payload of the given length.
+func fragmentSize(payloadLength int) int {
+	return HEADER_SIZE + payloadLength + fillSize(HEADER_SIZE+payloadLength)
+}
+
+// The length of a packet of the given length after it has been through all
+// of the given stages. Stages that are not OverheadReporters are taken to add
+// nothing.
+func wireLength(stages []TransformerV2, length int) int {
+	for _, stage := range stages {
+		length = length + reportedOverhead(stage, length)
 	}
+
+	return length
 }
 
-// Rewrite the fragments to impose the following constraints:
-// - All fragments have the same id
-// - Each fragment has a unique, incremental index
-// - All fragments have the same, correct count
-func fixFragments(fragmentList []Fragment) []Fragment {
-	var id = fragmentList[0].Id
-	var count = len(fragmentList)
+// The longest a fragment can be once it has been through the downstream
+// stages.
+func (this *FragmentationShaper) limit() int {
+	if this.mtu != 0 && this.mtu < this.maxLength {
+		return int(this.mtu)
+	}
 
-	for index, _ := range fragmentList {
-		fragmentList[index].Id = id
-		fragmentList[index].Index = uint8(index)
-		fragmentList[index].Count = uint8(count)
+	return int(this.maxLength)
+}
+
+// The largest payload that can be put in a fragment so that, once encoded
+// and passed through the downstream stages, it is no longer than the limit.
+func (this *FragmentationShaper) payloadSize() (int, error) {
+	// The wire length only grows with the payload length, so binary search for
+	// the largest payload length that fits.
+	limit := this.limit()
+	low, high := 0, limit
+	for low < high {
+		middle := (low + high + 1) / 2
+		if wireLength(this.downstream, fragmentSize(middle)) <= limit {
+			low = middle
+		} else {
+			high = middle - 1
+		}
+	}
+
+	if low == 0 {
+		return 0, fmt.Errorf("%w: a fragment of %d bytes leaves no room for payload after the overhead of the following stages", ErrMalformedConfig, limit)
 	}
 
-	return fragmentList
+	return low, nil
+}
+
+// The maximum number of bytes added to a packet of the given length, if it is
+// not split.
+func (this *FragmentationShaper) Overhead(length int) int {
+	return fragmentSize(length) - length
 }
@@ -0,0 +1,223 @@
+package protean
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	mathrand "math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// The largest packet size covered by the property tests.
+const maxTestPacketSize = 64 * 1024
+
+// Generates random packet sizes from 0 to maxTestPacketSize.
+func randomPacketSize(values []reflect.Value, random *mathrand.Rand) {
+	values[0] = reflect.ValueOf(random.Intn(maxTestPacketSize + 1))
+}
+
+// Packet sizes around the fragment boundaries, which random sizes rarely hit.
+func boundaryPacketSizes(payloadSize int) []int {
+	sizes := []int{0, 1, maxTestPacketSize - 1, maxTestPacketSize}
+	for _, multiple := range []int{1, 2, 3} {
+		sizes = append(sizes, multiple*payloadSize-1, multiple*payloadSize, multiple*payloadSize+1)
+	}
+
+	return sizes
+}
+
+func randomPacket(size int) []byte {
+	packet := make([]byte, size)
+	rand.Read(packet)
+	return packet
+}
+
+// Transform a packet, check the size of every wire packet, then restore the
+// wire packets in a random order.
+func fragmentRoundTrip(t *testing.T, transformer TransformerV2, maxLength int, plain []byte) bool {
+	transformed, err := transformer.Transform(plain)
+	if err != nil {
+		t.Errorf("%d bytes: %v", len(plain), err)
+		return false
+	}
+
+	for _, packet := range transformed {
+		if len(packet) > maxLength {
+			t.Errorf("%d bytes: wire packet of %d bytes exceeds %d", len(plain), len(packet), maxLength)
+			return false
+		}
+	}
+
+	mathrand.Shuffle(len(transformed), func(i, j int) {
+		transformed[i], transformed[j] = transformed[j], transformed[i]
+	})
+
+	var restored [][]byte
+	for _, packet := range transformed {
+		packets, err := transformer.Restore(packet)
+		if err != nil {
+			t.Errorf("%d bytes: %v", len(plain), err)
+			return false
+		}
+
+		restored = append(restored, packets...)
+	}
+
+	if len(restored) != 1 || !bytes.Equal(restored[0], plain) {
+		t.Errorf("%d bytes: restored %d packets that do not match", len(plain), len(restored))
+		return false
+	}
+
+	return true
+}
+
+func TestFragmentationRoundTrip(t *testing.T) {
+	shaper := NewFragmentationShaper()
+	maxLength := int(sampleFragmentationConfig().MaxLength)
+	payloadSize, err := shaper.payloadSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range boundaryPacketSizes(payloadSize) {
+		fragmentRoundTrip(t, shaper, maxLength, randomPacket(size))
+	}
+
+	property := func(size int) bool {
+		return fragmentRoundTrip(t, shaper, maxLength, randomPacket(size))
+	}
+
+	err = quick.Check(property, &quick.Config{MaxCount: 200, Values: randomPacketSize})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Fragments are sized to allow for the overhead of the stages after the
+// fragmentation stage, so no wire packet exceeds the maximum length.
+func TestFragmentationPipelineRoundTrip(t *testing.T) {
+	for _, mode := range []string{ENCRYPTION_MODE_AES_CBC, ENCRYPTION_MODE_CHACHA20_POLY1305} {
+		config := testPipelineConfig()
+		config.Encryption = EncryptionConfig{Key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", Mode: mode}
+		config.Fragmentation.MaxLength = 576
+		config.Injection = SequenceConfig{}
+
+		shaper := &ProteanShaper{}
+		err := shaper.ConfigureStruct(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payloadSize, err := shaper.stages[0].(*FragmentationShaper).payloadSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, size := range boundaryPacketSizes(payloadSize) {
+			fragmentRoundTrip(t, shaper, 576, randomPacket(size))
+		}
+
+		property := func(size int) bool {
+			return fragmentRoundTrip(t, shaper, 576, randomPacket(size))
+		}
+
+		err = quick.Check(property, &quick.Config{MaxCount: 50, Values: randomPacketSize})
+		if err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+}
+
+// With an MTU, fragments are sized for it rather than the maximum length,
+// allowing for a decompression stage that expands every fragment.
+func TestFragmentationMTU(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Decompression = DecompressionConfig{Frequencies: skewedFrequencies()}
+	config.Injection = SequenceConfig{}
+	config.MTU = 576
+
+	shaper := &ProteanShaper{}
+	err := shaper.ConfigureStruct(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragmenter := shaper.stages[0].(*FragmentationShaper)
+	payloadSize, err := fragmenter.payloadSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fragments expand by the factor of the decompression stage, so the
+	// payload is well under the MTU.
+	factor := shaper.stages[2].(*DecompressionShaper).ExpansionFactor()
+	if float64(payloadSize) > float64(config.MTU)/factor {
+		t.Errorf("payload size %d does not allow for expansion by %v", payloadSize, factor)
+	}
+
+	// A packet that fits in one fragment grows by no more than the overhead
+	// of the whole pipeline.
+	transformed, err := shaper.Transform(randomPacket(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transformed) != 1 || len(transformed[0]) > 100+shaper.Overhead(100) {
+		t.Errorf("a packet of 100 bytes became %d packets, the first of %d bytes, with an overhead of %d", len(transformed), len(transformed[0]), shaper.Overhead(100))
+	}
+
+	for _, size := range boundaryPacketSizes(payloadSize) {
+		fragmentRoundTrip(t, shaper, int(config.MTU), randomPacket(size))
+	}
+
+	property := func(size int) bool {
+		return fragmentRoundTrip(t, shaper, int(config.MTU), randomPacket(size))
+	}
+
+	err = quick.Check(property, &quick.Config{MaxCount: 20, Values: randomPacketSize})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A maximum length below the MTU still applies.
+	config.Fragmentation.MaxLength = 300
+	if err := shaper.ConfigureStruct(config); err != nil {
+		t.Fatal(err)
+	}
+
+	fragmentRoundTrip(t, shaper, 300, randomPacket(5000))
+}
+
+// At a small maximum length, packets that need more fragments than the
+// receiver accepts are refused rather than sent and dropped.
+func TestFragmentationLimit(t *testing.T) {
+	shaper := &FragmentationShaper{}
+	if err := shaper.ConfigureStruct(FragmentationConfig{MaxLength: 300}); err != nil {
+		t.Fatal(err)
+	}
+
+	payloadSize, err := shaper.payloadSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largest := DEFAULT_MAX_FRAGMENTS_PER_PACKET * payloadSize
+	fragmentRoundTrip(t, shaper, 300, randomPacket(largest))
+
+	if _, err := shaper.Transform(randomPacket(largest + 1)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("%d bytes: got %v, expected %v", largest+1, err, ErrPacketTooLarge)
+	}
+
+	// Raising the limit lets the largest packets through.
+	limits := DefragmenterLimits{MaxFragmentsPerPacket: 65535}
+	if err := shaper.ConfigureStruct(FragmentationConfig{MaxLength: 300, Limits: limits}); err != nil {
+		t.Fatal(err)
+	}
+
+	fragmentRoundTrip(t, shaper, 300, randomPacket(maxTestPacketSize))
+	if stats := shaper.Stats(); stats != (DefragmenterStats{}) {
+		t.Errorf("fragments dropped: %+v", stats)
+	}
+}
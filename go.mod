@@ -0,0 +1,22 @@
+module github.com/OperatorFoundation/protean
+
+go 1.25.0
+
+require (
+	github.com/google/gopacket v1.1.19
+	github.com/klauspost/reedsolomon v1.10.0
+	github.com/pion/dtls/v2 v2.2.7
+	github.com/pion/rtp v1.9.0
+	github.com/pion/stun v0.6.1
+	github.com/quic-go/quic-go v0.59.1
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.1.0 // indirect
+	github.com/pion/logging v0.2.3 // indirect
+	github.com/pion/randutil v0.1.0 // indirect
+	github.com/pion/transport/v2 v2.2.1 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+)
@@ -0,0 +1,730 @@
+package protean
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The first byte of every packet from the handshake stage gives its type.
+const (
+	HANDSHAKE_TYPE_DATA     = 0
+	HANDSHAKE_TYPE_INIT     = 1
+	HANDSHAKE_TYPE_RESPONSE = 2
+)
+
+// The size of an X25519 key.
+const HANDSHAKE_KEY_SIZE = 32
+
+// The init message consists of:
+//   - type, 1 byte
+//   - the client's ephemeral public key, 32 bytes
+//   - the client's timestamp, 8 bytes, sealed with a key only the server can
+//     derive
+const HANDSHAKE_INIT_SIZE = 1 + HANDSHAKE_KEY_SIZE + 8 + chacha20poly1305.Overhead
+
+// The response message consists of:
+//   - type, 1 byte
+//   - the server's ephemeral public key, 32 bytes
+//   - an empty payload sealed with a key only the client can derive
+const HANDSHAKE_RESPONSE_SIZE = 1 + HANDSHAKE_KEY_SIZE + chacha20poly1305.Overhead
+
+// HKDF labels for the keys derived during the handshake.
+const (
+	HANDSHAKE_LABEL_INIT     = "protean handshake init"
+	HANDSHAKE_LABEL_RESPONSE = "protean handshake response"
+	HANDSHAKE_LABEL_SESSION  = "protean handshake session"
+)
+
+// Defaults for the HandshakeConfig fields that are left as zero.
+const (
+	DEFAULT_HANDSHAKE_RETRANSMIT_INTERVAL time.Duration = time.Second
+	DEFAULT_HANDSHAKE_MAX_ATTEMPTS                      = 5
+)
+
+// The most times HandshakeConfig.MaxAttempts may have the init message sent.
+const MAX_HANDSHAKE_ATTEMPTS = 16
+
+// The longest the wait between init messages grows to by doubling, unless the
+// configured RetransmitInterval is longer to begin with.
+const MAX_HANDSHAKE_RETRANSMIT_INTERVAL = time.Minute
+
+// The number of packets the client holds while the handshake is in progress.
+// Beyond this the oldest are dropped.
+const HANDSHAKE_MAX_QUEUED = 16
+
+// The states of a HandshakeShaper.
+type HandshakeState int
+
+const (
+	// The client has not started a handshake, or the server has not received
+	// one.
+	HANDSHAKE_STATE_IDLE HandshakeState = iota
+
+	// The client has sent an init message and is waiting for the response.
+	HANDSHAKE_STATE_INITIATED
+
+	// Session keys have been established.
+	HANDSHAKE_STATE_ESTABLISHED
+
+	// The client sent the init message the maximum number of times without a
+	// response. The next packet sent starts a new handshake.
+	HANDSHAKE_STATE_FAILED
+)
+
+// Accepted in serialised form by Configure().
+type HandshakeConfig struct {
+	// ROLE_CLIENT or ROLE_SERVER.
+	Role string `json:"role"`
+
+	// The server's static X25519 private key encoded as a hex string.
+	// Only used by the server.
+	PrivateKey string `json:"privateKey,omitempty"`
+
+	// The server's static X25519 public key encoded as a hex string.
+	// Only used by the client.
+	ServerPublicKey string `json:"serverPublicKey,omitempty"`
+
+	// How long the client waits for a response before sending the init
+	// message again, in milliseconds. The wait doubles after each attempt,
+	// up to MAX_HANDSHAKE_RETRANSMIT_INTERVAL.
+	// Zero selects DEFAULT_HANDSHAKE_RETRANSMIT_INTERVAL.
+	RetransmitInterval uint32 `json:"retransmitInterval,omitempty"`
+
+	// The number of times the client sends the init message before giving up,
+	// at most MAX_HANDSHAKE_ATTEMPTS.
+	// Zero selects DEFAULT_HANDSHAKE_MAX_ATTEMPTS.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+// Creates a sample (non-random) config, suitable for testing.
+func sampleHandshakeConfig() HandshakeConfig {
+	privateKey, _ := ecdh.X25519().NewPrivateKey(make([]byte, HANDSHAKE_KEY_SIZE))
+	return HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: hex.EncodeToString(privateKey.PublicKey().Bytes())}
+}
+
+// Generate a static key pair for a server, encoded as hex strings for use in
+// HandshakeConfig.
+func GenerateHandshakeKey() (privateKey string, publicKey string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(key.Bytes()), hex.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// Check the config, recording any problems under path.
+func (config HandshakeConfig) validate(path string, problems *ConfigErrors) {
+	switch config.Role {
+	case ROLE_CLIENT:
+		if _, err := decodeHandshakeKey(config.ServerPublicKey); err != nil {
+			problems.add(fieldPath(path, "serverPublicKey"), "%v", err)
+		}
+	case ROLE_SERVER:
+		if _, err := decodeHandshakeKey(config.PrivateKey); err != nil {
+			problems.add(fieldPath(path, "privateKey"), "%v", err)
+		}
+	default:
+		problems.add(fieldPath(path, "role"), "unknown role %q, must be %q or %q", config.Role, ROLE_CLIENT, ROLE_SERVER)
+	}
+
+	if config.MaxAttempts < 0 {
+		problems.add(fieldPath(path, "maxAttempts"), "%d is negative", config.MaxAttempts)
+	}
+
+	if config.MaxAttempts > MAX_HANDSHAKE_ATTEMPTS {
+		problems.add(fieldPath(path, "maxAttempts"), "%d is more than %d", config.MaxAttempts, MAX_HANDSHAKE_ATTEMPTS)
+	}
+}
+
+// Decode a hex X25519 key.
+func decodeHandshakeKey(model string) ([]byte, error) {
+	key, err := hex.DecodeString(model)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %v", err)
+	}
+
+	if len(key) != HANDSHAKE_KEY_SIZE {
+		return nil, fmt.Errorf("key must be %d bytes, got %d bytes", HANDSHAKE_KEY_SIZE, len(key))
+	}
+
+	return key, nil
+}
+
+// Implemented by the ProteanShaper that a HandshakeShaper is a stage of.
+type handshakeOwner interface {
+	// Give the session secret to the stages before the handshake.
+	// Called with the handshake's lock held.
+	setSessionKey(secret []byte) error
+
+	// Send handshake messages through the stages after the handshake.
+	sendHandshake(messages [][]byte)
+
+	// Send the packets queued during the handshake through the whole
+	// pipeline.
+	sendQueued(packets [][]byte)
+}
+
+// A Transformer that establishes fresh session keys with an X25519 handshake
+// before any data is sent, so that traffic has forward secrecy.
+//
+// The handshake follows the Noise NK pattern: the client knows the server's
+// static public key in advance, and each side contributes an ephemeral key.
+// The client sends an init message with its ephemeral key and a timestamp, and
+// the server replies with its own ephemeral key. The session secret is derived
+// from both Diffie-Hellman results, and from the secret given to SetKey if
+// there is one, and is given to the stages before the handshake stage, such as
+// encryption. The handshake messages pass only through the stages after it,
+// such as header and byte sequence injection, which disguise them.
+//
+// The client queues packets while the handshake is in progress and sends them
+// once it completes. It resends the init message until it gets a response,
+// and the server resends its response whenever the same init message arrives
+// again. The server ignores init messages with a timestamp no newer than the
+// last one it accepted, so that they cannot be replayed.
+//
+// A HandshakeShaper can only be used as a stage of a ProteanShaper, which
+// sends the handshake messages with the function given to its SetOutput.
+type HandshakeShaper struct {
+	role string
+
+	// The server's static key.
+	static *ecdh.PrivateKey
+
+	// The server's static public key, as known to the client.
+	serverPublic *ecdh.PublicKey
+
+	retransmitInterval time.Duration
+	maxAttempts        int
+
+	// Used for retransmission and timestamps, nil for SystemClock.
+	clock Clock
+
+	owner handshakeOwner
+
+	// Guards all of the following fields.
+	lock sync.Mutex
+
+	// The secret given to SetKey, mixed into the session secret.
+	psk []byte
+
+	state HandshakeState
+
+	// The client's ephemeral key and the result of its exchange with the
+	// server's static key, while the handshake is in progress.
+	ephemeral *ecdh.PrivateKey
+	es        []byte
+
+	// The last init message sent by the client, or accepted by the server.
+	init []byte
+
+	// The response to the init message, sent by the server.
+	response []byte
+
+	// The timestamp of the init message, accepted by the server.
+	timestamp uint64
+
+	// The number of times the client has sent the init message.
+	attempts int
+
+	// Runs until the client next resends the init message.
+	timer Timer
+
+	// Packets the client is holding until the handshake completes.
+	queued [][]byte
+}
+
+func NewHandshakeShaper() *HandshakeShaper {
+	shaper := &HandshakeShaper{}
+	config := sampleHandshakeConfig()
+	jsonConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
+	return shaper
+}
+
+// Set a pre-shared secret, which is mixed into the session secret so that a
+// peer without it cannot complete the handshake.
+// @param {[]byte} key Pre-shared secret.
+func (shaper *HandshakeShaper) SetKey(key []byte) error {
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
+	shaper.psk = key
+	return nil
+}
+
+// Set the Clock used for retransmission and timestamps.
+// This takes effect the next time the shaper is configured.
+func (shaper *HandshakeShaper) SetClock(clock Clock) {
+	shaper.clock = clock
+}
+
+// Configure the Transformer with the role and keys.
+func (shaper *HandshakeShaper) Configure(jsonConfig string) error {
+	var config HandshakeConfig
+	err := json.Unmarshal([]byte(jsonConfig), &config)
+	if err != nil {
+		return fmt.Errorf("%w: handshake shaper requires role parameter: %v", ErrMalformedConfig, err)
+	}
+
+	return shaper.ConfigureStruct(config)
+}
+
+func (shaper *HandshakeShaper) ConfigureStruct(config HandshakeConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	var static *ecdh.PrivateKey
+	var serverPublic *ecdh.PublicKey
+	if config.Role == ROLE_SERVER {
+		key, _ := decodeHandshakeKey(config.PrivateKey)
+		private, err := ecdh.X25519().NewPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("%w: privateKey: %v", ErrMalformedConfig, err)
+		}
+
+		static = private
+	} else {
+		key, _ := decodeHandshakeKey(config.ServerPublicKey)
+		public, err := ecdh.X25519().NewPublicKey(key)
+		if err != nil {
+			return fmt.Errorf("%w: serverPublicKey: %v", ErrMalformedConfig, err)
+		}
+
+		serverPublic = public
+	}
+
+	retransmitInterval := time.Duration(config.RetransmitInterval) * time.Millisecond
+	if retransmitInterval == 0 {
+		retransmitInterval = DEFAULT_HANDSHAKE_RETRANSMIT_INTERVAL
+	}
+
+	maxAttempts := config.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = DEFAULT_HANDSHAKE_MAX_ATTEMPTS
+	}
+
+	if shaper.clock == nil {
+		shaper.clock = SystemClock
+	}
+
+	shaper.Dispose()
+
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
+	shaper.role = config.Role
+	shaper.static = static
+	shaper.serverPublic = serverPublic
+	shaper.retransmitInterval = retransmitInterval
+	shaper.maxAttempts = maxAttempts
+	shaper.reset(HANDSHAKE_STATE_IDLE)
+	return nil
+}
+
+// Returns the current state of the handshake.
+func (this *HandshakeShaper) State() HandshakeState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.state
+}
+
+// Mark a packet as data. Fails with ErrNoKey if the handshake has not
+// completed.
+func (this *HandshakeShaper) Transform(buffer []byte) ([][]byte, error) {
+	if this.State() != HANDSHAKE_STATE_ESTABLISHED {
+		return nil, ErrNoKey
+	}
+
+	result := make([]byte, 1+len(buffer))
+	result[0] = HANDSHAKE_TYPE_DATA
+	copy(result[1:], buffer)
+
+	return [][]byte{result}, nil
+}
+
+// Return the contents of a data packet, or handle a handshake message, which
+// yields nothing.
+func (this *HandshakeShaper) Restore(buffer []byte) ([][]byte, error) {
+	if len(buffer) == 0 {
+		return nil, fmt.Errorf("%w: empty handshake packet", ErrTruncatedPacket)
+	}
+
+	switch {
+	case buffer[0] == HANDSHAKE_TYPE_DATA:
+		if this.State() != HANDSHAKE_STATE_ESTABLISHED {
+			return nil, ErrNoKey
+		}
+
+		return [][]byte{buffer[1:]}, nil
+	case buffer[0] == HANDSHAKE_TYPE_INIT && this.role == ROLE_SERVER:
+		return [][]byte{}, this.receiveInit(buffer)
+	case buffer[0] == HANDSHAKE_TYPE_RESPONSE && this.role == ROLE_CLIENT:
+		return [][]byte{}, this.receiveResponse(buffer)
+	default:
+		return nil, fmt.Errorf("%w: unexpected handshake packet type %d", ErrMalformedPacket, buffer[0])
+	}
+}
+
+// Stop retransmitting.
+func (shaper *HandshakeShaper) Dispose() {
+	shaper.lock.Lock()
+	defer shaper.lock.Unlock()
+
+	shaper.stopTimer()
+}
+
+// Data packets are marked with their type.
+func (this *HandshakeShaper) Overhead(length int) int {
+	return 1
+}
+
+// Called by the ProteanShaper to send a packet before the handshake has
+// completed. Returns true if it has completed, and the packet should be sent
+// normally. Otherwise the client queues the packet and returns the init message
+// if it is starting a handshake.
+func (this *HandshakeShaper) prepare(buffer []byte) (bool, [][]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch this.state {
+	case HANDSHAKE_STATE_ESTABLISHED:
+		return true, nil, nil
+	case HANDSHAKE_STATE_INITIATED:
+		this.queue(buffer)
+		return false, nil, nil
+	}
+
+	// Only the client starts a handshake.
+	if this.role != ROLE_CLIENT {
+		return false, nil, ErrNoKey
+	}
+
+	init, err := this.start()
+	if err != nil {
+		return false, nil, err
+	}
+
+	this.queue(buffer)
+	return false, [][]byte{init}, nil
+}
+
+// Hold a packet until the handshake completes, dropping the oldest if there
+// are too many.
+func (this *HandshakeShaper) queue(buffer []byte) {
+	if len(this.queued) >= HANDSHAKE_MAX_QUEUED {
+		this.queued = this.queued[1:]
+	}
+
+	// The caller may reuse the buffer once Transform returns.
+	this.queued = append(this.queued, append([]byte{}, buffer...))
+}
+
+// Make a new ephemeral key and the init message carrying it, and start the
+// retransmission timer.
+func (this *HandshakeShaper) start() ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := ephemeral.ECDH(this.serverPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, uint64(this.clock.Now().UnixNano()))
+
+	key := deriveHandshakeKey(this.ikm(es), ephemeralPublic, HANDSHAKE_LABEL_INIT)
+	init := append([]byte{HANDSHAKE_TYPE_INIT}, ephemeralPublic...)
+	init = append(init, sealHandshake(key, timestamp, ephemeralPublic)...)
+
+	this.reset(HANDSHAKE_STATE_INITIATED)
+	this.ephemeral = ephemeral
+	this.es = es
+	this.init = init
+	this.attempts = 1
+	this.timer = this.clock.AfterFunc(this.retransmitInterval, this.retransmit)
+
+	return init, nil
+}
+
+// Called by the timer to send the init message again, or give up.
+func (this *HandshakeShaper) retransmit() {
+	this.lock.Lock()
+	if this.state != HANDSHAKE_STATE_INITIATED {
+		this.lock.Unlock()
+		return
+	}
+
+	if this.attempts >= this.maxAttempts {
+		this.reset(HANDSHAKE_STATE_FAILED)
+		this.lock.Unlock()
+		return
+	}
+
+	this.timer = this.clock.AfterFunc(this.backoff(), this.retransmit)
+	this.attempts++
+	init := this.init
+	owner := this.owner
+	this.lock.Unlock()
+
+	if owner != nil {
+		owner.sendHandshake([][]byte{init})
+	}
+}
+
+// The wait before the next retransmission, doubling with each attempt up to
+// MAX_HANDSHAKE_RETRANSMIT_INTERVAL. The caller must hold the lock.
+func (this *HandshakeShaper) backoff() time.Duration {
+	if this.retransmitInterval >= MAX_HANDSHAKE_RETRANSMIT_INTERVAL {
+		return this.retransmitInterval
+	}
+
+	// Compare before shifting, as the shifted interval could overflow.
+	if this.retransmitInterval > MAX_HANDSHAKE_RETRANSMIT_INTERVAL>>this.attempts {
+		return MAX_HANDSHAKE_RETRANSMIT_INTERVAL
+	}
+
+	return this.retransmitInterval << this.attempts
+}
+
+// Handle an init message on the server, establishing a new session and
+// sending the response.
+func (this *HandshakeShaper) receiveInit(message []byte) error {
+	if len(message) != HANDSHAKE_INIT_SIZE {
+		return fmt.Errorf("%w: handshake init of %d bytes", ErrMalformedPacket, len(message))
+	}
+
+	// Send after unlocking, as the owner transforms the response.
+	this.lock.Lock()
+	response, err := this.acceptInit(message)
+	this.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	this.send(response)
+	return nil
+}
+
+// Establish a new session from an init message, returning the response.
+// A retransmitted init message means that the response was lost, so the same
+// response is returned again.
+func (this *HandshakeShaper) acceptInit(message []byte) ([]byte, error) {
+	if this.init != nil && bytes.Equal(message, this.init) {
+		return this.response, nil
+	}
+
+	ephemeralPublic := message[1 : 1+HANDSHAKE_KEY_SIZE]
+	clientPublic, err := ecdh.X25519().NewPublicKey(ephemeralPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	es, err := this.static.ECDH(clientPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	key := deriveHandshakeKey(this.ikm(es), ephemeralPublic, HANDSHAKE_LABEL_INIT)
+	timestamp, err := openHandshake(key, message[1+HANDSHAKE_KEY_SIZE:], ephemeralPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint64(timestamp) <= this.timestamp {
+		return nil, fmt.Errorf("%w: replayed handshake init", ErrAuthenticationFailed)
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ee, err := ephemeral.ECDH(clientPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	serverEphemeralPublic := ephemeral.PublicKey().Bytes()
+	transcript := append(append([]byte{}, ephemeralPublic...), serverEphemeralPublic...)
+	ikm := this.ikm(es, ee)
+
+	response := append([]byte{HANDSHAKE_TYPE_RESPONSE}, serverEphemeralPublic...)
+	response = append(response, sealHandshake(deriveHandshakeKey(ikm, transcript, HANDSHAKE_LABEL_RESPONSE), nil, transcript)...)
+
+	err = this.establish(deriveHandshakeKey(ikm, transcript, HANDSHAKE_LABEL_SESSION))
+	if err != nil {
+		return nil, err
+	}
+
+	this.init = message
+	this.response = response
+	this.timestamp = binary.BigEndian.Uint64(timestamp)
+	return response, nil
+}
+
+// Handle a response message on the client, establishing the session and
+// sending the queued packets.
+func (this *HandshakeShaper) receiveResponse(message []byte) error {
+	if len(message) != HANDSHAKE_RESPONSE_SIZE {
+		return fmt.Errorf("%w: handshake response of %d bytes", ErrMalformedPacket, len(message))
+	}
+
+	this.lock.Lock()
+
+	// A late or duplicated response.
+	if this.state != HANDSHAKE_STATE_INITIATED {
+		this.lock.Unlock()
+		return nil
+	}
+
+	queued, err := this.completeHandshake(message)
+	owner := this.owner
+	this.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if owner != nil && len(queued) > 0 {
+		owner.sendQueued(queued)
+	}
+
+	return nil
+}
+
+// Derive the session secret from a response message, returning the packets
+// queued during the handshake.
+func (this *HandshakeShaper) completeHandshake(message []byte) ([][]byte, error) {
+	serverEphemeralPublic := message[1 : 1+HANDSHAKE_KEY_SIZE]
+	serverPublic, err := ecdh.X25519().NewPublicKey(serverEphemeralPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	ee, err := this.ephemeral.ECDH(serverPublic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+
+	transcript := append(this.ephemeral.PublicKey().Bytes(), serverEphemeralPublic...)
+	ikm := this.ikm(this.es, ee)
+
+	_, err = openHandshake(deriveHandshakeKey(ikm, transcript, HANDSHAKE_LABEL_RESPONSE), message[1+HANDSHAKE_KEY_SIZE:], transcript)
+	if err != nil {
+		return nil, err
+	}
+
+	queued := this.queued
+	err = this.establish(deriveHandshakeKey(ikm, transcript, HANDSHAKE_LABEL_SESSION))
+	if err != nil {
+		return nil, err
+	}
+
+	return queued, nil
+}
+
+// Give the session secret to the owner and enter the established state.
+func (this *HandshakeShaper) establish(secret []byte) error {
+	if this.owner != nil {
+		err := this.owner.setSessionKey(secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	this.reset(HANDSHAKE_STATE_ESTABLISHED)
+	return nil
+}
+
+// Enter a new state, discarding the state of any handshake in progress.
+// The server keeps the last init message, response and timestamp.
+func (this *HandshakeShaper) reset(state HandshakeState) {
+	this.stopTimer()
+	this.state = state
+	this.ephemeral = nil
+	this.es = nil
+	this.attempts = 0
+	this.queued = nil
+	if this.role == ROLE_CLIENT {
+		this.init = nil
+	}
+}
+
+func (this *HandshakeShaper) stopTimer() {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+}
+
+// Send a handshake message through the owner.
+func (this *HandshakeShaper) send(message []byte) {
+	if this.owner != nil {
+		this.owner.sendHandshake([][]byte{message})
+	}
+}
+
+// The input keying material for the handshake keys, which includes the
+// pre-shared secret if there is one.
+func (this *HandshakeShaper) ikm(results ...[]byte) []byte {
+	var ikm []byte
+	for _, result := range results {
+		ikm = append(ikm, result...)
+	}
+
+	return append(ikm, this.psk...)
+}
+
+// Derive a 32-byte key bound to the handshake transcript.
+func deriveHandshakeKey(ikm []byte, transcript []byte, label string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(hkdf.New(sha256.New, ikm, transcript, []byte(label)), key)
+	return key
+}
+
+// Seal a handshake payload. Each key is used only once, so the nonce is zero.
+func sealHandshake(key []byte, payload []byte, additional []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), payload, additional)
+}
+
+// Open a handshake payload sealed by sealHandshake().
+func openHandshake(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(key)
+	payload, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, additional)
+	if err != nil {
+		return nil, fmt.Errorf("%w: handshake message", ErrAuthenticationFailed)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,292 @@
+package protean
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// A ProteanShaper with a handshake stage, whose output is collected.
+type handshakePeer struct {
+	shaper *ProteanShaper
+	sent   [][]byte
+}
+
+// A pipeline that encrypts with the keys from the handshake, and disguises the
+// handshake messages with a header.
+func handshakeTestConfig(handshake HandshakeConfig) ProteanConfig {
+	config := sampleProteanConfig()
+	config.Encryption = EncryptionConfig{Mode: ENCRYPTION_MODE_CHACHA20_POLY1305, Role: handshake.Role}
+	config.Handshake = handshake
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_HANDSHAKE},
+		{Name: STAGE_HEADER_INJECTION},
+	}}
+
+	return config
+}
+
+func newHandshakePeer(t *testing.T, clock Clock, handshake HandshakeConfig) *handshakePeer {
+	peer := &handshakePeer{shaper: &ProteanShaper{}}
+	peer.shaper.SetClock(clock)
+	err := peer.shaper.ConfigureStruct(handshakeTestConfig(handshake))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer.shaper.SetOutput(func(packets [][]byte) {
+		peer.sent = append(peer.sent, packets...)
+	})
+
+	return peer
+}
+
+// Make a client and server that share the server's static key.
+func newHandshakePeers(t *testing.T, clock Clock) (*handshakePeer, *handshakePeer) {
+	privateKey, publicKey, err := GenerateHandshakeKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: publicKey})
+	server := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_SERVER, PrivateKey: privateKey})
+	return client, server
+}
+
+// Restore packets, returning the results and the packets the peer sent.
+func (this *handshakePeer) receive(t *testing.T, packets [][]byte) ([][]byte, [][]byte) {
+	var restored [][]byte
+	for _, packet := range packets {
+		results, err := this.shaper.Restore(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored = append(restored, results...)
+	}
+
+	sent := this.sent
+	this.sent = nil
+	return restored, sent
+}
+
+func TestHandshake(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	client, server := newHandshakePeers(t, clock)
+
+	if _, err := server.shaper.Transform([]byte("too soon")); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey from the server before the handshake, got %v", err)
+	}
+
+	init, err := client.shaper.Transform([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, response := server.receive(t, init)
+	if len(restored) != 0 || len(response) != 1 {
+		t.Fatalf("expected only a response, got %d packets and %d responses", len(restored), len(response))
+	}
+
+	_, queued := client.receive(t, response)
+	if client.shaper.handshake.State() != HANDSHAKE_STATE_ESTABLISHED {
+		t.Fatal("client did not establish the session")
+	}
+
+	restored, _ = server.receive(t, queued)
+	if len(restored) != 1 || !bytes.Equal(restored[0], []byte("hello")) {
+		t.Fatalf("queued packet was restored as %q", restored)
+	}
+
+	reply, err := server.shaper.Transform([]byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ = client.receive(t, reply)
+	if len(restored) != 1 || !bytes.Equal(restored[0], []byte("world")) {
+		t.Fatalf("reply was restored as %q", restored)
+	}
+
+	// A secret given once the session is established does not replace its
+	// keys.
+	for _, peer := range []*handshakePeer{client, server} {
+		encryption := peer.shaper.stages[1].(*EncryptionShaper)
+		sessionKey := encryption.keys.Load().sendKey
+		if err := peer.shaper.SetKey([]byte("late secret")); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(encryption.keys.Load().sendKey, sessionKey) {
+			t.Error("SetKey replaced the session keys")
+		}
+	}
+
+	reply, err = server.shaper.Transform([]byte("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ = client.receive(t, reply)
+	if len(restored) != 1 || !bytes.Equal(restored[0], []byte("again")) {
+		t.Fatalf("reply after SetKey was restored as %q", restored)
+	}
+}
+
+// Lost handshake messages are resent, and the server answers a resent init
+// message with the same response.
+func TestHandshakeRetransmission(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	client, server := newHandshakePeers(t, clock)
+
+	// The first init message is lost.
+	_, err := client.shaper.Transform([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(DEFAULT_HANDSHAKE_RETRANSMIT_INTERVAL)
+	if len(client.sent) != 1 {
+		t.Fatalf("expected the init message to be resent, got %d packets", len(client.sent))
+	}
+
+	init := client.sent
+	client.sent = nil
+
+	// The first response is lost too.
+	server.receive(t, init)
+	_, response := server.receive(t, init)
+	if len(response) != 1 {
+		t.Fatalf("expected the response to be resent, got %d packets", len(response))
+	}
+
+	_, queued := client.receive(t, response)
+	restored, _ := server.receive(t, queued)
+	if len(restored) != 1 || !bytes.Equal(restored[0], []byte("hello")) {
+		t.Fatalf("queued packet was restored as %q", restored)
+	}
+}
+
+// The client gives up after the maximum number of attempts, and starts again
+// when it next has a packet to send.
+func TestHandshakeFailure(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	client, _ := newHandshakePeers(t, clock)
+
+	_, err := client.shaper.Transform([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	if len(client.sent) != DEFAULT_HANDSHAKE_MAX_ATTEMPTS-1 {
+		t.Errorf("expected %d retransmissions, got %d", DEFAULT_HANDSHAKE_MAX_ATTEMPTS-1, len(client.sent))
+	}
+
+	if client.shaper.handshake.State() != HANDSHAKE_STATE_FAILED {
+		t.Errorf("expected the handshake to fail, state is %d", client.shaper.handshake.State())
+	}
+
+	init, err := client.shaper.Transform([]byte("again"))
+	if err != nil || len(init) != 1 {
+		t.Errorf("expected a new init message, got %d packets, %v", len(init), err)
+	}
+}
+
+// The number of attempts is limited, and the wait between them stops doubling
+// before it can overflow.
+func TestHandshakeLimits(t *testing.T) {
+	var problems ConfigErrors
+	config := HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: sampleHandshakeConfig().ServerPublicKey, MaxAttempts: MAX_HANDSHAKE_ATTEMPTS + 1}
+	config.validate("handshake", &problems)
+	if len(problems) != 1 || problems[0].Path != "handshake.maxAttempts" {
+		t.Errorf("too many attempts: got %v", problems)
+	}
+
+	shaper := &HandshakeShaper{retransmitInterval: time.Second}
+	for _, attempts := range []int{1, 3, 6, MAX_HANDSHAKE_ATTEMPTS, 100} {
+		shaper.attempts = attempts
+		expected := time.Second << attempts
+		if attempts >= 6 {
+			expected = MAX_HANDSHAKE_RETRANSMIT_INTERVAL
+		}
+
+		if wait := shaper.backoff(); wait != expected {
+			t.Errorf("after %d attempts waited %v, expected %v", attempts, wait, expected)
+		}
+	}
+
+	shaper = &HandshakeShaper{retransmitInterval: math.MaxUint32 * time.Millisecond, attempts: MAX_HANDSHAKE_ATTEMPTS}
+	if wait := shaper.backoff(); wait != shaper.retransmitInterval {
+		t.Errorf("longest interval waited %v", wait)
+	}
+}
+
+// The server only accepts init messages for its own key, and does not accept
+// an old init message once it has accepted a newer one.
+func TestHandshakeRejectsInit(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	privateKey, publicKey, _ := GenerateHandshakeKey()
+	server := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_SERVER, PrivateKey: privateKey})
+
+	_, otherPublicKey, _ := GenerateHandshakeKey()
+	stranger := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: otherPublicKey})
+	init, _ := stranger.shaper.Transform([]byte("hello"))
+	if _, err := server.shaper.Restore(init[0]); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed for the wrong server key, got %v", err)
+	}
+
+	client := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: publicKey})
+	old, _ := client.shaper.Transform([]byte("hello"))
+	server.receive(t, old)
+
+	// The client restarts and makes a new handshake later.
+	clock.Advance(time.Hour)
+	restarted := newHandshakePeer(t, clock, HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: publicKey})
+	init, _ = restarted.shaper.Transform([]byte("hello"))
+	server.receive(t, init)
+
+	if _, err := server.shaper.Restore(old[0]); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed for a replayed init message, got %v", err)
+	}
+}
+
+// The handshake messages are sent by the packet connections, so an
+// application only sees its own packets.
+func TestHandshakePacketConn(t *testing.T) {
+	privateKey, publicKey, _ := GenerateHandshakeKey()
+	client := newHandshakePeer(t, SystemClock, HandshakeConfig{Role: ROLE_CLIENT, ServerPublicKey: publicKey})
+
+	sessions, err := NewSessionManager(handshakeTestConfig(HandshakeConfig{Role: ROLE_SERVER, PrivateKey: privateKey}), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn := WrapPacketConn(listenLoopback(t), client.shaper)
+	serverConn := listenLoopback(t)
+	server := WrapSessionPacketConn(serverConn, sessions)
+
+	// The client must be reading to receive the response.
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	go clientConn.ReadFrom(make([]byte, MAX_DATAGRAM_SIZE))
+
+	_, err = clientConn.WriteTo([]byte("hello"), serverConn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	n, _, err := server.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buffer[:n], []byte("hello")) {
+		t.Errorf("read %q, expected %q", buffer[:n], "hello")
+	}
+}
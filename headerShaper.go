@@ -5,22 +5,39 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 )
 
 // Accepted in serialised form by Configure().
 type HeaderConfig struct {
 	// Header that should be added to the beginning of each outgoing packet.
-	AddHeader SerializedHeaderModel
+	AddHeader SerializedHeaderModel `json:"addHeader"`
 
 	// Header that should be removed from each incoming packet.
-	RemoveHeader SerializedHeaderModel
+	RemoveHeader SerializedHeaderModel `json:"removeHeader"`
 }
 
 // Header models where the headers have been encoded as strings.
 // This is used by the HeaderConfig argument passed to Configure().
+//
+// A header is either the same bytes in every packet, given as Header, or a
+// template given as Fields, whose counters, timestamps, random bytes, lengths
+// and checksums are filled in for each packet. Removing a template header
+// checks its fixed fields, lengths and checksums, and accepts any value in
+// the fields that vary from packet to packet.
 type SerializedHeaderModel struct {
 	// Header encoded as a string.
-	Header string
+	Header string `json:"header"`
+
+	// The fields of a template, in the order they appear in the header.
+	// Header must be empty if these are given.
+	Fields []HeaderField `json:"fields,omitempty"`
+
+	// Pad each packet with zeros to a multiple of this many bytes, as STUN
+	// pads its attributes to multiples of 4. Only a template can be padded,
+	// and it must have a length field that counts the payload, so that the
+	// padding can be removed. Zero or 1 leaves packets unpadded.
+	Align int `json:"align,omitempty"`
 }
 
 // Header models where the headers have been decoded as []bytes.
@@ -28,6 +45,9 @@ type SerializedHeaderModel struct {
 type HeaderModel struct {
 	// Header.
 	Header []byte
+
+	// The template, if the header was given as fields, nil otherwise.
+	template *headerTemplate
 }
 
 // Creates a sample (non-random) config, suitable for testing.
@@ -39,6 +59,31 @@ func sampleHeaderConfig() HeaderConfig {
 	return HeaderConfig{AddHeader: header, RemoveHeader: header}
 }
 
+// Check the config, recording any problems under path.
+func (config HeaderConfig) validate(path string, problems *ConfigErrors) {
+	config.AddHeader.validate(fieldPath(path, "addHeader"), problems)
+	config.RemoveHeader.validate(fieldPath(path, "removeHeader"), problems)
+}
+
+// Check the model, recording any problems under path.
+func (model SerializedHeaderModel) validate(path string, problems *ConfigErrors) {
+	if _, err := hex.DecodeString(model.Header); err != nil {
+		problems.add(fieldPath(path, "header"), "invalid hex: %v", err)
+	}
+
+	if len(model.Fields) > 0 && model.Header != "" {
+		problems.add(fieldPath(path, "header"), "a header cannot be given as both bytes and fields")
+	}
+
+	validateHeaderFields(fieldPath(path, "fields"), model.Fields, problems)
+
+	if model.Align < 0 || model.Align > MAX_HEADER_ALIGNMENT {
+		problems.add(fieldPath(path, "align"), "%d is out of range, must be from 0 to %d", model.Align, MAX_HEADER_ALIGNMENT)
+	} else if model.Align > 1 && payloadLengthField(model.Fields) < 0 {
+		problems.add(fieldPath(path, "align"), "padding requires a %s field with scope %s", HEADER_FIELD_LENGTH, HEADER_SCOPE_PAYLOAD)
+	}
+}
+
 // An obfuscator that injects headers.
 type HeaderShaper struct {
 	// Headers that should be added to the outgoing packet stream.
@@ -46,6 +91,13 @@ type HeaderShaper struct {
 
 	// Headers that should be removed from the incoming packet stream.
 	RemoveHeader HeaderModel
+
+	// The source of the timestamps in template headers.
+	clock Clock
+
+	// The start of the last packet restored, copied by the echo fields of
+	// the added header. Nil until a packet has been restored.
+	echo atomic.Pointer[[]byte]
 }
 
 func NewHeaderShaper() *HeaderShaper {
@@ -56,69 +108,173 @@ func NewHeaderShaper() *HeaderShaper {
 		return nil
 	}
 
-	headerShaper.Configure(string(jsonConfig))
+	err = headerShaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return headerShaper
 }
 
 // This method is required to implement the Transformer API.
 // @param {[]byte} key Key to set, not used by this class.
-func (headerShaper *HeaderShaper) SetKey(key []byte) {
+func (headerShaper *HeaderShaper) SetKey(key []byte) error {
+	return nil
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (headerShaper *HeaderShaper) Configure(jsonConfig string) {
+func (headerShaper *HeaderShaper) Configure(jsonConfig string) error {
 	var config HeaderConfig
 	err := json.Unmarshal([]byte(jsonConfig), &config)
 	if err != nil {
-		fmt.Println("Header shaper requires addHeader and removeHeader parameters")
+		return fmt.Errorf("%w: header shaper requires addHeader and removeHeader parameters: %v", ErrMalformedConfig, err)
+	}
+
+	return headerShaper.ConfigureStruct(config)
+}
+
+func (headerShaper *HeaderShaper) ConfigureStruct(config HeaderConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	addHeader, removeHeader, err := deserializeConfig(config)
+	if err != nil {
+		return err
 	}
 
-	headerShaper.ConfigureStruct(config)
+	if headerShaper.clock == nil {
+		headerShaper.clock = SystemClock
+	}
+
+	headerShaper.AddHeader, headerShaper.RemoveHeader = addHeader, removeHeader
+	headerShaper.echo.Store(nil)
+	return nil
 }
 
-func (headerShaper *HeaderShaper) ConfigureStruct(config HeaderConfig) {
-	headerShaper.AddHeader, headerShaper.RemoveHeader = deserializeConfig(config)
+// Set the Clock used for the timestamps in template headers.
+// This takes effect the next time the shaper is configured.
+func (headerShaper *HeaderShaper) SetClock(clock Clock) {
+	headerShaper.clock = clock
 }
 
 // Inject header.
-func (headerShaper *HeaderShaper) Transform(buffer []byte) [][]byte {
+func (headerShaper *HeaderShaper) Transform(buffer []byte) ([][]byte, error) {
 	//    log.debug('->', arraybuffers.arrayBufferToHexString(buffer))
 	//    log.debug('>>', arraybuffers.arrayBufferToHexString(
 	//      arraybuffers.concat([this.addHeader_.header, buffer])
 	//    ))
-	return [][]byte{append(headerShaper.AddHeader.Header, buffer...)}
+	if headerShaper.AddHeader.template != nil {
+		var echo []byte
+		if last := headerShaper.echo.Load(); last != nil {
+			echo = *last
+		}
+
+		result, err := headerShaper.AddHeader.template.write(buffer, headerShaper.clock.Now(), echo)
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{result}, nil
+	}
+
+	result := make([]byte, 0, len(headerShaper.AddHeader.Header)+len(buffer))
+	result = append(result, headerShaper.AddHeader.Header...)
+	result = append(result, buffer...)
+	return [][]byte{result}, nil
 }
 
 // Remove injected header.
-func (headerShaper *HeaderShaper) Restore(buffer []byte) [][]byte {
+func (headerShaper *HeaderShaper) Restore(buffer []byte) ([][]byte, error) {
 	//    log.debug('<-', arraybuffers.arrayBufferToHexString(buffer))
+	if headerShaper.RemoveHeader.template != nil {
+		payload, err := headerShaper.RemoveHeader.template.read(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		headerShaper.keepEcho(buffer)
+		return [][]byte{payload}, nil
+	}
+
 	headerLength := len(headerShaper.RemoveHeader.Header)
+	if len(buffer) < headerLength {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than the %d byte header", ErrTruncatedPacket, len(buffer), headerLength)
+	}
+
 	header := buffer[0:headerLength]
 	payload := buffer[headerLength:]
 
 	if bytes.Equal(header, headerShaper.RemoveHeader.Header) {
 		// Remove the injected header.
 		//      log.debug('<<', arraybuffers.arrayBufferToHexString(payload))
-		return [][]byte{payload}
+		headerShaper.keepEcho(buffer)
+		return [][]byte{payload}, nil
 	} else {
-		// Injected header not found, so return the unmodified packet.
+		// Injected header not found, so the packet is not one of ours.
 		//      log.debug('Header not found')
-		return [][]byte{buffer}
+		return nil, ErrUnknownHeader
 	}
 }
 
+// Keep the start of a restored packet for the echo fields of the added header,
+// if it has any.
+func (headerShaper *HeaderShaper) keepEcho(packet []byte) {
+	template := headerShaper.AddHeader.template
+	if template == nil || template.echoed == 0 {
+		return
+	}
+
+	echo := append([]byte(nil), packet[:min(len(packet), template.echoed)]...)
+	headerShaper.echo.Store(&echo)
+}
+
 // No-op (we have no state or any resources to Dispose).
 func (headerShaper *HeaderShaper) Dispose() {
 }
 
+// The maximum number of bytes added to a packet of the given length.
+func (headerShaper *HeaderShaper) Overhead(length int) int {
+	if headerShaper.AddHeader.template != nil {
+		return headerShaper.AddHeader.template.overhead()
+	}
+
+	return len(headerShaper.AddHeader.Header)
+}
+
 // Decode the headers from strings in the config information
-func deserializeConfig(config HeaderConfig) (HeaderModel, HeaderModel) {
-	return deserializeModel(config.AddHeader), deserializeModel(config.RemoveHeader)
+func deserializeConfig(config HeaderConfig) (HeaderModel, HeaderModel, error) {
+	addHeader, err := deserializeModel(config.AddHeader)
+	if err != nil {
+		return HeaderModel{}, HeaderModel{}, fmt.Errorf("%w: addHeader: %v", ErrMalformedConfig, err)
+	}
+
+	removeHeader, err := deserializeModel(config.RemoveHeader)
+	if err != nil {
+		return HeaderModel{}, HeaderModel{}, fmt.Errorf("%w: removeHeader: %v", ErrMalformedConfig, err)
+	}
+
+	return addHeader, removeHeader, nil
 }
 
 // Decode the header from a string in the header model
-func deserializeModel(model SerializedHeaderModel) HeaderModel {
-	config, _ := hex.DecodeString(string(model.Header))
-	return HeaderModel{Header: config}
+func deserializeModel(model SerializedHeaderModel) (HeaderModel, error) {
+	if len(model.Fields) > 0 {
+		template, err := newHeaderTemplate(model.Fields, model.Align)
+		if err != nil {
+			return HeaderModel{}, err
+		}
+
+		return HeaderModel{template: template}, nil
+	}
+
+	config, err := hex.DecodeString(string(model.Header))
+	if err != nil {
+		return HeaderModel{}, err
+	}
+
+	return HeaderModel{Header: config}, nil
 }
@@ -0,0 +1,300 @@
+package protean
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+)
+
+// A header like RTP's, followed by a length and a checksum.
+func templateHeaderConfig() HeaderConfig {
+	header := SerializedHeaderModel{Fields: []HeaderField{
+		{Type: HEADER_FIELD_FIXED, Value: "8060"},
+		{Type: HEADER_FIELD_COUNTER, Width: 2, Start: 0xFFFE},
+		{Type: HEADER_FIELD_TIMESTAMP, Width: 4, Rate: 90000},
+		{Type: HEADER_FIELD_RANDOM, Width: 4, PerSession: true},
+		{Type: HEADER_FIELD_RANDOM, Width: 2},
+		{Type: HEADER_FIELD_LENGTH, Width: 2, Endian: ENDIAN_LITTLE, Scope: HEADER_SCOPE_PAYLOAD},
+		{Type: HEADER_FIELD_CHECKSUM, Algorithm: CHECKSUM_INTERNET},
+	}}
+
+	return HeaderConfig{AddHeader: header, RemoveHeader: header}
+}
+
+func newTemplateHeaderShaper(t *testing.T, config HeaderConfig, clock Clock) *HeaderShaper {
+	shaper := &HeaderShaper{clock: clock}
+	if err := shaper.ConfigureStruct(config); err != nil {
+		t.Fatal(err)
+	}
+
+	return shaper
+}
+
+func TestHeaderTemplate(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 500000000))
+	shaper := newTemplateHeaderShaper(t, templateHeaderConfig(), clock)
+	if overhead := shaper.Overhead(100); overhead != 18 {
+		t.Fatalf("overhead %d, expected 18", overhead)
+	}
+
+	var session []byte
+	for index := 0; index < 3; index++ {
+		payload := bytes.Repeat([]byte{byte(index)}, 10+index)
+		transformed, err := shaper.Transform(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet := transformed[0]
+		if len(packet) != 18+len(payload) || !bytes.Equal(packet[:2], []byte{0x80, 0x60}) || !bytes.Equal(packet[18:], payload) {
+			t.Fatalf("packet %x", packet)
+		}
+
+		// The counter wraps around at its width.
+		if counter := binary.BigEndian.Uint16(packet[2:]); counter != uint16(0xFFFE+index) {
+			t.Errorf("packet %d: counter %#x", index, counter)
+		}
+
+		if timestamp := binary.BigEndian.Uint32(packet[4:]); timestamp != uint32(1000*90000+45000+index*90) {
+			t.Errorf("packet %d: timestamp %d", index, timestamp)
+		}
+
+		if session == nil {
+			session = packet[8:12]
+		} else if !bytes.Equal(packet[8:12], session) {
+			t.Errorf("packet %d: session bytes changed from %x to %x", index, session, packet[8:12])
+		}
+
+		if length := binary.LittleEndian.Uint16(packet[14:]); int(length) != len(payload) {
+			t.Errorf("packet %d: length %d", index, length)
+		}
+
+		// A correct checksum sums to zero over the whole packet.
+		if sum := internetChecksum(packet); sum != 0 {
+			t.Errorf("packet %d: checksum leaves %#x", index, sum)
+		}
+
+		restored, err := shaper.Restore(packet)
+		if err != nil {
+			t.Fatalf("packet %d: %v", index, err)
+		}
+
+		if len(restored) != 1 || !bytes.Equal(restored[0], payload) {
+			t.Fatalf("packet %d: restored %x", index, restored)
+		}
+
+		clock.Advance(time.Millisecond)
+	}
+}
+
+// The fields that vary are accepted with any value, but the others are checked.
+func TestHeaderTemplateRestore(t *testing.T) {
+	shaper := newTemplateHeaderShaper(t, templateHeaderConfig(), nil)
+	transformed, err := shaper.Transform([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := transformed[0]
+
+	// A different session, counter, timestamp and random bytes, with the
+	// checksum corrected to match.
+	other := append([]byte(nil), packet...)
+	for index := 2; index < 14; index++ {
+		other[index] = other[index] ^ 0x5A
+	}
+
+	other[16], other[17] = 0, 0
+	binary.BigEndian.PutUint16(other[16:], internetChecksum(other))
+	if _, err := shaper.Restore(other); err != nil {
+		t.Errorf("varying fields rejected: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		offset   int
+		expected error
+	}{
+		{"fixed", 1, ErrUnknownHeader},
+		{"length", 14, ErrMalformedPacket},
+		{"checksum", 17, ErrAuthenticationFailed},
+		{"payload", 19, ErrAuthenticationFailed},
+	}
+
+	for _, test := range tests {
+		corrupted := append([]byte(nil), packet...)
+		corrupted[test.offset] = corrupted[test.offset] ^ 0x01
+		if _, err := shaper.Restore(corrupted); !errors.Is(err, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.expected)
+		}
+	}
+
+	if _, err := shaper.Restore(packet[:17]); !errors.Is(err, ErrTruncatedPacket) {
+		t.Errorf("short packet: got %v", err)
+	}
+}
+
+// Checksums that cover the whole packet include the fields before them, and
+// a length field too narrow for the packet is reported.
+func TestHeaderTemplateChecksums(t *testing.T) {
+	header := SerializedHeaderModel{Fields: []HeaderField{
+		{Type: HEADER_FIELD_LENGTH, Width: 1},
+		{Type: HEADER_FIELD_CHECKSUM, Algorithm: CHECKSUM_CRC32, Scope: HEADER_SCOPE_PAYLOAD},
+		{Type: HEADER_FIELD_CHECKSUM, Algorithm: CHECKSUM_CRC32C, Endian: ENDIAN_LITTLE},
+	}}
+	shaper := newTemplateHeaderShaper(t, HeaderConfig{AddHeader: header, RemoveHeader: header}, nil)
+
+	payload := []byte("some bytes")
+	transformed, err := shaper.Transform(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := transformed[0]
+	if packet[0] != byte(len(packet)) {
+		t.Errorf("length %d, expected %d", packet[0], len(packet))
+	}
+
+	if sum := binary.BigEndian.Uint32(packet[1:]); sum != crc32.ChecksumIEEE(payload) {
+		t.Errorf("payload checksum %#x", sum)
+	}
+
+	zeroed := append([]byte(nil), packet...)
+	copy(zeroed[5:9], []byte{0, 0, 0, 0})
+	if sum := binary.LittleEndian.Uint32(packet[5:]); sum != crc32.Checksum(zeroed, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("packet checksum %#x", sum)
+	}
+
+	if restored, err := shaper.Restore(packet); err != nil || !bytes.Equal(restored[0], payload) {
+		t.Errorf("restored %x: %v", restored, err)
+	}
+
+	if _, err := shaper.Transform(make([]byte, 250)); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("oversized packet: got %v", err)
+	}
+}
+
+func TestInternetChecksum(t *testing.T) {
+	// The example from RFC 1071, section 3.
+	if sum := internetChecksum([]byte{0x00, 0x01, 0xF2, 0x03, 0xF4, 0xF5, 0xF6, 0xF7}); sum != 0x220D {
+		t.Errorf("checksum %#x, expected 0x220d", sum)
+	}
+
+	if sum := internetChecksum([]byte{0x01}); sum != 0xFEFF {
+		t.Errorf("odd length: checksum %#x, expected 0xfeff", sum)
+	}
+}
+
+func TestHeaderTemplateConfig(t *testing.T) {
+	tests := map[string]HeaderField{
+		"addHeader.fields[0].type":      {Type: "crc"},
+		"addHeader.fields[0].value":     {Type: HEADER_FIELD_FIXED, Value: "xy"},
+		"addHeader.fields[0].width":     {Type: HEADER_FIELD_COUNTER, Width: 9},
+		"addHeader.fields[0].rate":      {Type: HEADER_FIELD_TIMESTAMP, Width: 4, Rate: 2 * MAX_TIMESTAMP_RATE},
+		"addHeader.fields[0].endian":    {Type: HEADER_FIELD_LENGTH, Width: 2, Endian: "middle"},
+		"addHeader.fields[0].scope":     {Type: HEADER_FIELD_LENGTH, Width: 2, Scope: "header"},
+		"addHeader.fields[0].algorithm": {Type: HEADER_FIELD_CHECKSUM, Algorithm: "md5"},
+	}
+
+	for path, field := range tests {
+		config := HeaderConfig{AddHeader: SerializedHeaderModel{Fields: []HeaderField{field}}}
+		err := (&HeaderShaper{}).ConfigureStruct(config)
+		var problems ConfigErrors
+		if !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != path {
+			t.Errorf("%s: got %v", path, err)
+		}
+	}
+
+	both := HeaderConfig{AddHeader: SerializedHeaderModel{Header: "41", Fields: []HeaderField{{Type: HEADER_FIELD_RANDOM, Width: 1}}}}
+	if err := (&HeaderShaper{}).ConfigureStruct(both); !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("header and fields: got %v", err)
+	}
+
+	// A plain header still works alongside a template in the other direction.
+	mixed := templateHeaderConfig()
+	mixed.RemoveHeader = sampleHeaderConfig().RemoveHeader
+	shaper := newTemplateHeaderShaper(t, mixed, nil)
+	if restored, err := shaper.Restore([]byte("\x41\x02data")); err != nil || string(restored[0]) != "data" {
+		t.Errorf("restored %q: %v", restored, err)
+	}
+}
+
+// Padded packets are a multiple of the alignment, and the padding is removed
+// using the payload length.
+func TestHeaderTemplatePadding(t *testing.T) {
+	header := SerializedHeaderModel{Fields: []HeaderField{
+		{Type: HEADER_FIELD_FIXED, Value: "01"},
+		{Type: HEADER_FIELD_LENGTH, Width: 2, Adjust: -3},
+		{Type: HEADER_FIELD_LENGTH, Width: 1, Scope: HEADER_SCOPE_PAYLOAD},
+	}, Align: 4}
+	shaper := newTemplateHeaderShaper(t, HeaderConfig{AddHeader: header, RemoveHeader: header}, nil)
+
+	for length := 0; length < 10; length++ {
+		payload := bytes.Repeat([]byte{0xFF}, length)
+		transformed, err := shaper.Transform(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packet := transformed[0]
+		if len(packet)%4 != 0 || len(packet)-4-length >= 4 || len(packet)-length > shaper.Overhead(length) {
+			t.Fatalf("%d bytes padded to %d", length, len(packet))
+		}
+
+		if int(binary.BigEndian.Uint16(packet[1:])) != len(packet)-3 || int(packet[3]) != length {
+			t.Errorf("%d bytes: lengths in %x", length, packet[:4])
+		}
+
+		restored, err := shaper.Restore(packet)
+		if err != nil || !bytes.Equal(restored[0], payload) {
+			t.Fatalf("%d bytes: restored %x: %v", length, restored, err)
+		}
+	}
+
+	// The padding must fill the packet to the next multiple, and no further.
+	for _, packet := range [][]byte{{0x01, 0x00, 0x09, 0x01, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, {0x01, 0x00, 0x02, 0x04, 0xFF}} {
+		if _, err := shaper.Restore(packet); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("%x: got %v", packet, err)
+		}
+	}
+
+	header.Fields = header.Fields[:2]
+	if err := (&HeaderShaper{}).ConfigureStruct(HeaderConfig{AddHeader: header}); !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("padding without a payload length: got %v", err)
+	}
+}
+
+// An echo field repeats the bytes at its place in the last packet restored.
+func TestHeaderTemplateEcho(t *testing.T) {
+	request := SerializedHeaderModel{Fields: []HeaderField{{Type: HEADER_FIELD_RANDOM, Width: 2}, {Type: HEADER_FIELD_FIXED, Value: "01"}}}
+	response := SerializedHeaderModel{Fields: []HeaderField{{Type: HEADER_FIELD_ECHO, Width: 2}, {Type: HEADER_FIELD_FIXED, Value: "81"}}}
+	client := newTemplateHeaderShaper(t, HeaderConfig{AddHeader: request, RemoveHeader: response}, nil)
+	server := newTemplateHeaderShaper(t, HeaderConfig{AddHeader: response, RemoveHeader: request}, nil)
+
+	for index := 0; index < 3; index++ {
+		query, err := client.Transform([]byte("query"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := server.Restore(query[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		answer, err := server.Transform([]byte("answer"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(answer[0][:2], query[0][:2]) || answer[0][2] != 0x81 {
+			t.Errorf("answer %x to query %x", answer[0], query[0])
+		}
+
+		if restored, err := client.Restore(answer[0]); err != nil || string(restored[0]) != "answer" {
+			t.Errorf("restored %q: %v", restored, err)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package protean
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of field accepted in HeaderField.Type.
+const (
+	// Bytes that are the same in every packet.
+	HEADER_FIELD_FIXED = "fixed"
+
+	// An integer that increases by one with each packet, wrapping around at
+	// the width of the field.
+	HEADER_FIELD_COUNTER = "counter"
+
+	// The time the packet was sent, in ticks of the field's rate since the
+	// Unix epoch, wrapping around at the width of the field.
+	HEADER_FIELD_TIMESTAMP = "timestamp"
+
+	// Random bytes, chosen for each packet or once per session.
+	HEADER_FIELD_RANDOM = "random"
+
+	// The length in bytes of the packet or of its payload.
+	HEADER_FIELD_LENGTH = "length"
+
+	// A checksum of the packet or of its payload.
+	HEADER_FIELD_CHECKSUM = "checksum"
+
+	// Bytes copied from the same place in the last packet the shaper
+	// restored, as for a response that repeats the ID of its request. Random
+	// until a packet has been restored.
+	HEADER_FIELD_ECHO = "echo"
+)
+
+// Byte orders accepted in HeaderField.Endian.
+const (
+	ENDIAN_BIG    = "big"
+	ENDIAN_LITTLE = "little"
+)
+
+// What a length or checksum field covers, accepted in HeaderField.Scope.
+const (
+	// The whole packet, header included. A checksum is computed with the
+	// checksum fields that have not been filled in yet set to zero.
+	HEADER_SCOPE_PACKET = "packet"
+
+	// The bytes after the header.
+	HEADER_SCOPE_PAYLOAD = "payload"
+)
+
+// Checksum algorithms accepted in HeaderField.Algorithm.
+const (
+	// The 2-byte ones' complement sum of RFC 1071, as in IP, UDP and TCP.
+	CHECKSUM_INTERNET = "internet"
+
+	// The 4-byte CRC-32 of IEEE 802.3, as in Ethernet and gzip.
+	CHECKSUM_CRC32 = "crc32"
+
+	// The 4-byte CRC-32C of Castagnoli, as in SCTP and iSCSI.
+	CHECKSUM_CRC32C = "crc32c"
+)
+
+// The widest integer field of a header template.
+const MAX_HEADER_FIELD_WIDTH = 8
+
+// The longest header a template may describe.
+const MAX_HEADER_TEMPLATE_SIZE = 1024
+
+// The fastest rate accepted for a timestamp field, one tick per nanosecond.
+const MAX_TIMESTAMP_RATE = 1000000000
+
+// The largest alignment a template may pad its packets to.
+const MAX_HEADER_ALIGNMENT = 64
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A single field of a header template.
+// Only the settings that apply to the field's Type are used.
+type HeaderField struct {
+	// One of the HEADER_FIELD constants.
+	Type string `json:"type"`
+
+	// For a fixed field, the bytes encoded as a hex string.
+	Value string `json:"value,omitempty"`
+
+	// The size of the field in bytes. Counter, timestamp and length fields
+	// are from 1 to MAX_HEADER_FIELD_WIDTH bytes wide. A checksum field may
+	// leave this as zero, since its width is that of its algorithm.
+	Width int `json:"width,omitempty"`
+
+	// ENDIAN_BIG or ENDIAN_LITTLE, for the integer fields.
+	// The empty string selects ENDIAN_BIG.
+	Endian string `json:"endian,omitempty"`
+
+	// For a counter, the value in the first packet.
+	Start uint64 `json:"start,omitempty"`
+
+	// For a counter, start from a random value instead of Start.
+	RandomStart bool `json:"randomStart,omitempty"`
+
+	// For a timestamp, the number of ticks per second. Zero selects 1, so
+	// that the timestamp is in seconds.
+	Rate uint64 `json:"rate,omitempty"`
+
+	// For random bytes, choose them once when the shaper is configured rather
+	// than for each packet, as for an RTP SSRC.
+	PerSession bool `json:"perSession,omitempty"`
+
+	// For a length or checksum, one of the HEADER_SCOPE constants.
+	// The empty string selects HEADER_SCOPE_PACKET.
+	Scope string `json:"scope,omitempty"`
+
+	// For a length, a number added to the length, which may be negative.
+	// This allows for lengths that leave out part of the header, as in STUN,
+	// or that include bytes after the field, as in a DNS record holding an
+	// option.
+	Adjust int `json:"adjust,omitempty"`
+
+	// For a checksum, one of the CHECKSUM constants.
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// Check the field, recording any problems under path.
+func (field HeaderField) validate(path string, problems *ConfigErrors) {
+	switch field.Endian {
+	case "", ENDIAN_BIG, ENDIAN_LITTLE:
+	default:
+		problems.add(fieldPath(path, "endian"), "unknown byte order %q", field.Endian)
+	}
+
+	switch field.Type {
+	case HEADER_FIELD_FIXED:
+		value, err := hex.DecodeString(field.Value)
+		if err != nil {
+			problems.add(fieldPath(path, "value"), "invalid hex: %v", err)
+		} else if len(value) == 0 {
+			problems.add(fieldPath(path, "value"), "a fixed field must have at least one byte")
+		}
+	case HEADER_FIELD_COUNTER, HEADER_FIELD_LENGTH:
+		field.validateWidth(path, problems)
+	case HEADER_FIELD_TIMESTAMP:
+		field.validateWidth(path, problems)
+		if field.Rate > MAX_TIMESTAMP_RATE {
+			problems.add(fieldPath(path, "rate"), "%d is more than the %d ticks per second allowed", field.Rate, MAX_TIMESTAMP_RATE)
+		}
+	case HEADER_FIELD_RANDOM, HEADER_FIELD_ECHO:
+		if field.Width < 1 || field.Width > MAX_HEADER_TEMPLATE_SIZE {
+			problems.add(fieldPath(path, "width"), "%d is out of range, must be from 1 to %d", field.Width, MAX_HEADER_TEMPLATE_SIZE)
+		}
+	case HEADER_FIELD_CHECKSUM:
+		width := checksumWidth(field.Algorithm)
+		if width == 0 {
+			problems.add(fieldPath(path, "algorithm"), "unknown checksum algorithm %q", field.Algorithm)
+		} else if field.Width != 0 && field.Width != width {
+			problems.add(fieldPath(path, "width"), "a %s checksum is %d bytes, not %d", field.Algorithm, width, field.Width)
+		}
+	default:
+		problems.add(fieldPath(path, "type"), "unknown field type %q", field.Type)
+	}
+
+	if field.Type == HEADER_FIELD_LENGTH || field.Type == HEADER_FIELD_CHECKSUM {
+		switch field.Scope {
+		case "", HEADER_SCOPE_PACKET, HEADER_SCOPE_PAYLOAD:
+		default:
+			problems.add(fieldPath(path, "scope"), "unknown scope %q", field.Scope)
+		}
+	}
+}
+
+func (field HeaderField) validateWidth(path string, problems *ConfigErrors) {
+	if field.Width < 1 || field.Width > MAX_HEADER_FIELD_WIDTH {
+		problems.add(fieldPath(path, "width"), "%d is out of range, must be from 1 to %d", field.Width, MAX_HEADER_FIELD_WIDTH)
+	}
+}
+
+// The number of bytes the field occupies, for a valid field.
+func (field HeaderField) size() int {
+	switch field.Type {
+	case HEADER_FIELD_FIXED:
+		return len(field.Value) / 2
+	case HEADER_FIELD_CHECKSUM:
+		return checksumWidth(field.Algorithm)
+	default:
+		return field.Width
+	}
+}
+
+// The width of the checksums of an algorithm, zero for an unknown algorithm.
+func checksumWidth(algorithm string) int {
+	switch algorithm {
+	case CHECKSUM_INTERNET:
+		return 2
+	case CHECKSUM_CRC32, CHECKSUM_CRC32C:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Check a list of fields, recording any problems under path.
+func validateHeaderFields(path string, fields []HeaderField, problems *ConfigErrors) {
+	size := 0
+	for index, field := range fields {
+		field.validate(fmt.Sprintf("%s[%d]", path, index), problems)
+		size = size + field.size()
+	}
+
+	if size > MAX_HEADER_TEMPLATE_SIZE {
+		problems.add(path, "the header is %d bytes, more than the %d allowed", size, MAX_HEADER_TEMPLATE_SIZE)
+	}
+}
+
+// The index of the first length field that counts the payload, or -1 if
+// there is none.
+func payloadLengthField(fields []HeaderField) int {
+	for index, field := range fields {
+		if field.Type == HEADER_FIELD_LENGTH && field.Scope == HEADER_SCOPE_PAYLOAD {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// A header whose fields are filled in for each packet, made from a list of
+// HeaderFields that has been validated.
+type headerTemplate struct {
+	fields []templateField
+
+	// The total size of the fields.
+	size int
+
+	// The multiple the packets are padded to, or 1 if they are not padded.
+	align int
+
+	// The field that gives the length of the payload without the padding,
+	// when the packets are padded.
+	payloadLength int
+
+	// Whether any field is a checksum.
+	checksummed bool
+
+	// How much of the last packet restored the echo fields copy from, zero if
+	// there are none.
+	echoed int
+}
+
+type templateField struct {
+	HeaderField
+
+	// Where the field starts in the header, and its size.
+	offset int
+	width  int
+
+	littleEndian bool
+
+	// The bytes of a fixed field, or of a random field chosen once per session.
+	value []byte
+
+	// The value for the next packet, for a counter.
+	counter *atomic.Uint64
+}
+
+// Lay out the fields, choosing the random values that are fixed for the session.
+// Packets are padded with zeros to a multiple of align bytes, if it is more
+// than 1.
+func newHeaderTemplate(fields []HeaderField, align int) (*headerTemplate, error) {
+	template := &headerTemplate{align: 1, payloadLength: payloadLengthField(fields)}
+	if align > 1 {
+		template.align = align
+	}
+
+	for _, field := range fields {
+		compiled := templateField{HeaderField: field, offset: template.size, width: field.size(), littleEndian: field.Endian == ENDIAN_LITTLE}
+
+		switch field.Type {
+		case HEADER_FIELD_FIXED:
+			value, err := hex.DecodeString(field.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid hex: %v", ErrMalformedConfig, err)
+			}
+
+			compiled.value = value
+		case HEADER_FIELD_RANDOM:
+			if field.PerSession {
+				compiled.value = make([]byte, compiled.width)
+				if _, err := rand.Read(compiled.value); err != nil {
+					return nil, err
+				}
+			}
+		case HEADER_FIELD_COUNTER:
+			start := field.Start
+			if field.RandomStart {
+				var random [8]byte
+				if _, err := rand.Read(random[:]); err != nil {
+					return nil, err
+				}
+
+				start = binary.BigEndian.Uint64(random[:])
+			}
+
+			compiled.counter = &atomic.Uint64{}
+			compiled.counter.Store(start)
+		case HEADER_FIELD_CHECKSUM:
+			template.checksummed = true
+		case HEADER_FIELD_ECHO:
+			template.echoed = compiled.offset + compiled.width
+		}
+
+		template.fields = append(template.fields, compiled)
+		template.size = template.size + compiled.width
+	}
+
+	return template, nil
+}
+
+// The most bytes the template adds to a packet.
+func (template *headerTemplate) overhead() int {
+	return template.size + template.align - 1
+}
+
+// Make a packet from the header, filled in for payload at the time now,
+// followed by the payload and any padding. The echo fields are copied from
+// echo, the start of the last packet restored, where it is long enough.
+func (template *headerTemplate) write(payload []byte, now time.Time, echo []byte) ([]byte, error) {
+	end := template.size + len(payload)
+	packet := make([]byte, template.size, end+template.align-1)
+	packet = append(packet, payload...)
+	if padding := end % template.align; padding != 0 {
+		packet = packet[:end+template.align-padding]
+	}
+
+	for _, field := range template.fields {
+		target := packet[field.offset : field.offset+field.width]
+		switch field.Type {
+		case HEADER_FIELD_FIXED:
+			copy(target, field.value)
+		case HEADER_FIELD_RANDOM:
+			if field.PerSession {
+				copy(target, field.value)
+			} else if _, err := rand.Read(target); err != nil {
+				return nil, err
+			}
+		case HEADER_FIELD_ECHO:
+			if len(echo) >= field.offset+field.width {
+				copy(target, echo[field.offset:])
+			} else if _, err := rand.Read(target); err != nil {
+				return nil, err
+			}
+		case HEADER_FIELD_COUNTER:
+			putHeaderInteger(target, field.counter.Add(1)-1, field.littleEndian)
+		case HEADER_FIELD_TIMESTAMP:
+			putHeaderInteger(target, timestampTicks(now, field.Rate), field.littleEndian)
+		case HEADER_FIELD_LENGTH:
+			length := len(field.covered(packet, template.size, end)) + field.Adjust
+			if length < 0 || (field.width < MAX_HEADER_FIELD_WIDTH && uint64(length) >= 1<<(8*field.width)) {
+				return nil, fmt.Errorf("%w: length %d does not fit in a %d byte field", ErrMalformedPacket, length, field.width)
+			}
+
+			putHeaderInteger(target, uint64(length), field.littleEndian)
+		}
+	}
+
+	// The checksums come last, so that they cover the other fields.
+	if template.checksummed {
+		for _, field := range template.fields {
+			if field.Type == HEADER_FIELD_CHECKSUM {
+				putHeaderInteger(packet[field.offset:field.offset+field.width], field.checksum(packet, template.size, end), field.littleEndian)
+			}
+		}
+	}
+
+	return packet, nil
+}
+
+// Check the header at the start of packet and return the payload after it,
+// without any padding. The fixed fields, lengths and checksums are checked,
+// while the counters, timestamps, random and echoed bytes, which vary from
+// packet to packet, are not.
+func (template *headerTemplate) read(packet []byte) ([]byte, error) {
+	if len(packet) < template.size {
+		return nil, fmt.Errorf("%w: %d bytes is shorter than the %d byte header", ErrTruncatedPacket, len(packet), template.size)
+	}
+
+	end := len(packet)
+	if template.align > 1 {
+		field := template.fields[template.payloadLength]
+		length := int(headerInteger(packet[field.offset:field.offset+field.width], field.littleEndian)) - field.Adjust
+		end = template.size + length
+		if length < 0 || end > len(packet) || len(packet)-end >= template.align || len(packet)%template.align != 0 {
+			return nil, fmt.Errorf("%w: a payload of %d bytes does not fill the %d byte packet", ErrMalformedPacket, length, len(packet))
+		}
+	}
+
+	for _, field := range template.fields {
+		source := packet[field.offset : field.offset+field.width]
+		switch field.Type {
+		case HEADER_FIELD_FIXED:
+			if !bytes.Equal(source, field.value) {
+				return nil, ErrUnknownHeader
+			}
+		case HEADER_FIELD_LENGTH:
+			length := uint64(len(field.covered(packet, template.size, end)) + field.Adjust)
+			if value := headerInteger(source, field.littleEndian); value != length {
+				return nil, fmt.Errorf("%w: length field is %d, expected %d", ErrMalformedPacket, value, length)
+			}
+		}
+	}
+
+	if template.checksummed {
+		// Recompute the checksums in the order they were written, on a copy
+		// with those not yet written set to zero.
+		scratch := append([]byte(nil), packet...)
+		for _, field := range template.fields {
+			if field.Type == HEADER_FIELD_CHECKSUM {
+				clear(scratch[field.offset : field.offset+field.width])
+			}
+		}
+
+		for _, field := range template.fields {
+			if field.Type != HEADER_FIELD_CHECKSUM {
+				continue
+			}
+
+			source := packet[field.offset : field.offset+field.width]
+			if field.checksum(scratch, template.size, end) != headerInteger(source, field.littleEndian) {
+				return nil, fmt.Errorf("%w: %s checksum does not match", ErrAuthenticationFailed, field.Algorithm)
+			}
+
+			copy(scratch[field.offset:], source)
+		}
+	}
+
+	return packet[template.size:end], nil
+}
+
+// The part of packet that a length or checksum field covers, where the
+// payload runs from the end of the header to end.
+func (field templateField) covered(packet []byte, headerSize int, end int) []byte {
+	if field.Scope == HEADER_SCOPE_PAYLOAD {
+		return packet[headerSize:end]
+	}
+
+	return packet
+}
+
+func (field templateField) checksum(packet []byte, headerSize int, end int) uint64 {
+	covered := field.covered(packet, headerSize, end)
+	switch field.Algorithm {
+	case CHECKSUM_INTERNET:
+		return uint64(internetChecksum(covered))
+	case CHECKSUM_CRC32:
+		return uint64(crc32.ChecksumIEEE(covered))
+	default:
+		return uint64(crc32.Checksum(covered, castagnoliTable))
+	}
+}
+
+// The ones' complement of the ones' complement sum of the big-endian 16-bit
+// words of data, padded with a zero byte if its length is odd (RFC 1071).
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for len(data) >= 2 {
+		sum = sum + uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+
+	if len(data) == 1 {
+		sum = sum + uint32(data[0])<<8
+	}
+
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+
+	return ^uint16(sum)
+}
+
+// The ticks at rate per second since the Unix epoch.
+func timestampTicks(now time.Time, rate uint64) uint64 {
+	if rate == 0 {
+		rate = 1
+	}
+
+	return uint64(now.Unix())*rate + uint64(now.Nanosecond())*rate/1000000000
+}
+
+// Write the low bytes of value into all of target.
+func putHeaderInteger(target []byte, value uint64, littleEndian bool) {
+	for index := range target {
+		if littleEndian {
+			target[index] = byte(value)
+		} else {
+			target[len(target)-1-index] = byte(value)
+		}
+
+		value = value >> 8
+	}
+}
+
+// Read the integer in all of source.
+func headerInteger(source []byte, littleEndian bool) uint64 {
+	var value uint64
+	for index := range source {
+		if littleEndian {
+			value = value<<8 | uint64(source[len(source)-1-index])
+		} else {
+			value = value<<8 | uint64(source[index])
+		}
+	}
+
+	return value
+}
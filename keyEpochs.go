@@ -0,0 +1,162 @@
+package protean
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The size of the key epoch carried in each packet when keys are rotated.
+const EPOCH_SIZE = 4
+
+// The furthest ahead of the current epoch a received packet may be. A packet
+// from a later epoch means that many packets were lost, or that it is forged.
+// The receiver keeps the keys it derives for the epochs ahead, so forged
+// packets cost it at most this many derivations for each epoch it moves to.
+const MAX_EPOCH_SKIP = 8
+
+// The default time for which packets from the previous epoch are still
+// accepted after a new epoch begins.
+const DEFAULT_REKEY_GRACE_PERIOD time.Duration = 10 * time.Second
+
+// HKDF label for deriving the key for the next epoch from the current one.
+const KEY_LABEL_EPOCH = "protean epoch"
+
+// A key and the epoch it belongs to.
+type epochKey struct {
+	epoch uint32
+	key   []byte
+	aead  cipher.AEAD
+}
+
+// Derive the key for the next epoch. Each key is derived from the one before
+// it, so that the key for an epoch does not reveal the keys for earlier ones.
+func (this epochKey) next(mode string) (epochKey, error) {
+	key, err := DeriveKey(this.key, KEY_LABEL_EPOCH, len(this.key))
+	if err != nil {
+		return epochKey{}, err
+	}
+
+	aead, err := makeAEAD(mode, key)
+	if err != nil {
+		return epochKey{}, err
+	}
+
+	return epochKey{epoch: this.epoch + 1, key: key, aead: aead}, nil
+}
+
+// The epochs used for sending, which move on after a number of packets or a
+// length of time.
+type sendEpochs struct {
+	lock sync.Mutex
+
+	current epochKey
+
+	// The number of packets sent in the current epoch.
+	packets uint64
+
+	// When the current epoch began.
+	started time.Time
+}
+
+// Returns the key to send the next packet with, moving to a new epoch first if
+// the current one has been used for too many packets or too long. A limit of
+// zero is not applied.
+func (this *sendEpochs) next(mode string, now time.Time, maxPackets uint64, maxAge time.Duration) (epochKey, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	expired := (maxPackets > 0 && this.packets >= maxPackets) || (maxAge > 0 && now.Sub(this.started) >= maxAge)
+	if expired && this.current.epoch < math.MaxUint32 {
+		next, err := this.current.next(mode)
+		if err != nil {
+			return epochKey{}, err
+		}
+
+		this.current = next
+		this.packets = 0
+		this.started = now
+	}
+
+	this.packets++
+	return this.current, nil
+}
+
+// The epochs accepted when receiving: the current one, and the previous one
+// for a grace period after the current one began.
+type receiveEpochs struct {
+	lock sync.Mutex
+
+	current epochKey
+
+	// The keys derived so far for the epochs after the current one, in order.
+	// Packets that claim a later epoch are checked against these, so that
+	// the keys are not derived again for each one.
+	ahead []epochKey
+
+	// The previous epoch, and when it stops being accepted.
+	previous        *epochKey
+	previousExpires time.Time
+}
+
+// Authenticate and decrypt a packet from the given epoch.
+// A packet from a later epoch moves the receiver on to it, once the packet has
+// been authenticated.
+func (this *receiveEpochs) open(mode string, epoch uint32, sealed []byte, now time.Time, gracePeriod time.Duration) ([]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	switch {
+	case epoch == this.current.epoch:
+		return open(this.current.aead, sealed)
+	case epoch+1 == this.current.epoch && this.previous != nil && now.Before(this.previousExpires):
+		return open(this.previous.aead, sealed)
+	case epoch > this.current.epoch && epoch-this.current.epoch <= MAX_EPOCH_SKIP:
+		skipped := epoch - this.current.epoch
+		err := this.deriveAhead(mode, skipped)
+		if err != nil {
+			return nil, err
+		}
+
+		plaintext, err := open(this.ahead[skipped-1].aead, sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		// Move on to the packet's epoch, remembering the one before.
+		previous := this.current
+		if skipped > 1 {
+			previous = this.ahead[skipped-2]
+		}
+
+		this.previous = &previous
+		this.previousExpires = now.Add(gracePeriod)
+		this.current = this.ahead[skipped-1]
+		this.ahead = this.ahead[skipped:]
+		return plaintext, nil
+	default:
+		return nil, fmt.Errorf("%w: key epoch %d is not accepted in epoch %d", ErrAuthenticationFailed, epoch, this.current.epoch)
+	}
+}
+
+// Derive the keys for the given number of epochs after the current one, if
+// they have not been already. The caller must hold the lock.
+func (this *receiveEpochs) deriveAhead(mode string, count uint32) error {
+	for uint32(len(this.ahead)) < count {
+		last := this.current
+		if len(this.ahead) > 0 {
+			last = this.ahead[len(this.ahead)-1]
+		}
+
+		next, err := last.next(mode)
+		if err != nil {
+			return err
+		}
+
+		this.ahead = append(this.ahead, next)
+	}
+
+	return nil
+}
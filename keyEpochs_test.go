@@ -0,0 +1,170 @@
+package protean
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Make a sender and receiver that rotate keys, timed by clock.
+func newRotatingPair(t *testing.T, config EncryptionConfig, clock Clock) (*EncryptionShaper, *EncryptionShaper) {
+	config.Key = hex.EncodeToString(make([]byte, 32))
+	config.Mode = ENCRYPTION_MODE_CHACHA20_POLY1305
+
+	var pair [2]*EncryptionShaper
+	for index := range pair {
+		pair[index] = &EncryptionShaper{clock: clock}
+		err := pair[index].ConfigureStruct(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return pair[0], pair[1]
+}
+
+// Transform a packet, checking that it was sealed in the expected epoch.
+func sendInEpoch(t *testing.T, sender *EncryptionShaper, plain []byte, epoch uint32) []byte {
+	t.Helper()
+
+	transformed, err := sender.Transform(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := binary.BigEndian.Uint32(transformed[0]); got != epoch {
+		t.Fatalf("packet sealed in epoch %d, expected %d", got, epoch)
+	}
+
+	return transformed[0]
+}
+
+func restoreFromEpoch(t *testing.T, receiver *EncryptionShaper, packet []byte, plain []byte) {
+	t.Helper()
+
+	restored, err := receiver.Restore(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(restored[0], plain) {
+		t.Fatalf("restored %q, expected %q", restored[0], plain)
+	}
+}
+
+// The sender moves to a new epoch after the configured number of packets, and
+// packets from the previous epoch are accepted until the grace period ends.
+func TestKeyRotationByPackets(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender, receiver := newRotatingPair(t, EncryptionConfig{RekeyAfterPackets: 3, RekeyGracePeriod: 1000}, clock)
+	plain := []byte("attack at dawn")
+
+	for index := 0; index < 6; index++ {
+		packet := sendInEpoch(t, sender, plain, uint32(index/3))
+		restoreFromEpoch(t, receiver, packet, plain)
+	}
+
+	// A packet delayed across the rotation to epoch 2 is still accepted.
+	delayed := sendInEpoch(t, sender, plain, 2)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 2), plain)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 2), plain)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 3), plain)
+	restoreFromEpoch(t, receiver, delayed, plain)
+
+	// Once the grace period is over, it is not.
+	clock.Advance(time.Second)
+	_, err := receiver.Restore(delayed)
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed after the grace period, got %v", err)
+	}
+
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 3), plain)
+}
+
+// The sender moves to a new epoch after the configured interval.
+func TestKeyRotationByTime(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender, receiver := newRotatingPair(t, EncryptionConfig{RekeyInterval: 60000}, clock)
+	plain := []byte("attack at dawn")
+
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 0), plain)
+	clock.Advance(59 * time.Second)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 0), plain)
+	clock.Advance(time.Second)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 1), plain)
+	clock.Advance(2 * time.Minute)
+	restoreFromEpoch(t, receiver, sendInEpoch(t, sender, plain, 2), plain)
+}
+
+// A receiver catches up with a sender whose packets from several epochs were
+// lost, but does not move on for a forged epoch.
+func TestKeyRotationSkipsEpochs(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender, receiver := newRotatingPair(t, EncryptionConfig{RekeyAfterPackets: 1}, clock)
+	plain := []byte("attack at dawn")
+
+	first := sendInEpoch(t, sender, plain, 0)
+	restoreFromEpoch(t, receiver, first, plain)
+	for epoch := uint32(1); epoch < 5; epoch++ {
+		sendInEpoch(t, sender, plain, epoch)
+	}
+
+	current := sendInEpoch(t, sender, plain, 5)
+
+	forged := append([]byte{}, current...)
+	binary.BigEndian.PutUint32(forged, 6)
+	if _, err := receiver.Restore(forged); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed for a forged epoch, got %v", err)
+	}
+
+	binary.BigEndian.PutUint32(forged, MAX_EPOCH_SKIP+1)
+	if _, err := receiver.Restore(forged); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed for a distant epoch, got %v", err)
+	}
+
+	// Forged packets for the furthest epoch accepted derive its key once,
+	// and do not move the receiver on.
+	epochs := receiver.keys.Load().receiveEpochs
+	binary.BigEndian.PutUint32(forged, MAX_EPOCH_SKIP)
+	var furthest cipher.AEAD
+	for attempt := 0; attempt < 3; attempt++ {
+		if _, err := receiver.Restore(forged); !errors.Is(err, ErrAuthenticationFailed) {
+			t.Errorf("expected ErrAuthenticationFailed for a forged epoch, got %v", err)
+		}
+
+		if len(epochs.ahead) != MAX_EPOCH_SKIP || epochs.current.epoch != 0 {
+			t.Fatalf("%d keys derived ahead of epoch %d", len(epochs.ahead), epochs.current.epoch)
+		}
+
+		if furthest == nil {
+			furthest = epochs.ahead[MAX_EPOCH_SKIP-1].aead
+		} else if epochs.ahead[MAX_EPOCH_SKIP-1].aead != furthest {
+			t.Error("the key for a forged epoch was derived again")
+		}
+	}
+
+	restoreFromEpoch(t, receiver, current, plain)
+	if len(epochs.ahead) != MAX_EPOCH_SKIP-5 || epochs.ahead[len(epochs.ahead)-1].aead != furthest {
+		t.Errorf("the keys derived ahead were not kept, %d remain", len(epochs.ahead))
+	}
+
+	// Epoch 0 is now more than one epoch behind.
+	if _, err := receiver.Restore(first); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("expected ErrAuthenticationFailed for an old epoch, got %v", err)
+	}
+}
+
+// Key rotation is only available in the authenticated modes.
+func TestKeyRotationRequiresAuthentication(t *testing.T) {
+	shaper := &EncryptionShaper{}
+	config := sampleEncryptionConfig()
+	config.RekeyAfterPackets = 100
+	err := shaper.ConfigureStruct(config)
+	if !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("expected ErrMalformedConfig, got %v", err)
+	}
+}
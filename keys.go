@@ -0,0 +1,69 @@
+package protean
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Roles accepted in EncryptionConfig.Role. The keys a client sends with are
+// the keys a server receives with, and the other way around.
+const (
+	ROLE_CLIENT = "client"
+	ROLE_SERVER = "server"
+)
+
+// HKDF labels for the keys derived from a shared secret by SetKey.
+// Each key is derived with a distinct label, so that no two uses share a key.
+const (
+	// Encrypts packets sent by the client.
+	KEY_LABEL_CLIENT_TO_SERVER = "protean encryption client to server"
+
+	// Encrypts packets sent by the server.
+	KEY_LABEL_SERVER_TO_CLIENT = "protean encryption server to client"
+)
+
+// Derive a key of the given size from a shared secret using HKDF-SHA256.
+// The label identifies the purpose of the key, so that keys derived from the
+// same secret with different labels are independent.
+func DeriveKey(secret []byte, label string, size int) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%w: empty secret", ErrMalformedConfig)
+	}
+
+	key := make([]byte, size)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(label)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Derive the keys for sending and receiving in the given role.
+// The two keys always differ, so a role is required.
+func deriveDirectionKeys(secret []byte, role string, size int) (sendKey []byte, receiveKey []byte, err error) {
+	var sendLabel, receiveLabel string
+	switch role {
+	case ROLE_CLIENT:
+		sendLabel, receiveLabel = KEY_LABEL_CLIENT_TO_SERVER, KEY_LABEL_SERVER_TO_CLIENT
+	case ROLE_SERVER:
+		sendLabel, receiveLabel = KEY_LABEL_SERVER_TO_CLIENT, KEY_LABEL_CLIENT_TO_SERVER
+	default:
+		return nil, nil, fmt.Errorf("%w: a role of %q or %q is required to derive keys from a secret", ErrMalformedConfig, ROLE_CLIENT, ROLE_SERVER)
+	}
+
+	sendKey, err = DeriveKey(secret, sendLabel, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	receiveKey, err = DeriveKey(secret, receiveLabel, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sendKey, receiveKey, nil
+}
@@ -0,0 +1,182 @@
+package protean
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// The largest datagram that can be read from the underlying connection.
+const MAX_DATAGRAM_SIZE = 65535
+
+// A restored packet waiting to be returned by ReadFrom, along with the
+// address of the peer that sent it.
+type pendingPacket struct {
+	payload []byte
+	addr    net.Addr
+}
+
+// A net.PacketConn that applies a Transformer to every datagram.
+// Outgoing datagrams are transformed into one or more wire packets, and
+// incoming wire packets are restored. ReadFrom only returns once a complete
+// packet has been restored, so fragments and injected packets are consumed
+// transparently. Wire packets that fail to restore are dropped.
+//
+// The Transformer used for each datagram is chosen by the address of the
+// peer, so that peers can have independent state.
+type transformedPacketConn struct {
+	net.PacketConn
+
+	// Returns the Transformer for the given peer.
+	transformerFor func(addr net.Addr) (TransformerV2, error)
+
+	// Serializes readers, and guards pending and buffer.
+	readLock sync.Mutex
+
+	// Restored packets that have not yet been returned by ReadFrom.
+	// A single wire packet can restore to more than one packet.
+	pending []pendingPacket
+
+	// Buffer for reading wire packets from the underlying connection.
+	buffer []byte
+
+	// Serializes writers.
+	writeLock sync.Mutex
+
+	// The peer most recently written to or read from, which is sent the
+	// packets a shared Transformer sends of its own accord.
+	peer atomic.Pointer[net.Addr]
+}
+
+// Wrap a net.PacketConn so that every datagram written to it is transformed
+// and every datagram read from it is restored by the given Transformer.
+// The deadline and Close methods are those of the wrapped connection.
+//
+// A single Transformer is shared by all peers, so its state (such as partially
+// defragmented packets) is shared as well. Use WrapSessionPacketConn when
+// serving more than one peer. If the Transformer is a PacketEmitter, the
+// packets it sends of its own accord go to the peer most recently written to
+// or read from.
+func WrapPacketConn(conn net.PacketConn, transformer TransformerV2) net.PacketConn {
+	transformerFor := func(addr net.Addr) (TransformerV2, error) {
+		return transformer, nil
+	}
+
+	wrapped := &transformedPacketConn{PacketConn: conn, transformerFor: transformerFor, buffer: make([]byte, MAX_DATAGRAM_SIZE)}
+	if emitter, ok := transformer.(PacketEmitter); ok {
+		emitter.SetOutput(func(packets [][]byte) {
+			if peer := wrapped.peer.Load(); peer != nil {
+				wrapped.writePackets(packets, *peer)
+			}
+		})
+	}
+
+	return wrapped
+}
+
+// Wrap a net.PacketConn like WrapPacketConn, but with a separate session for
+// every peer, keyed by the peer's address.
+func WrapSessionPacketConn(conn net.PacketConn, sessions *SessionManager) net.PacketConn {
+	wrapped := &transformedPacketConn{PacketConn: conn, buffer: make([]byte, MAX_DATAGRAM_SIZE)}
+	wrapped.transformerFor = func(addr net.Addr) (TransformerV2, error) {
+		// Packets a new session sends of its own accord go to its peer.
+		session, err := sessions.get(addr.String(), func(session *Session) {
+			session.SetOutput(func(packets [][]byte) {
+				wrapped.writePackets(packets, addr)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return session, nil
+	}
+
+	return wrapped
+}
+
+// Read the next restored packet into p.
+// As with UDP, if p is too small the packet is truncated.
+func (this *transformedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	this.readLock.Lock()
+	defer this.readLock.Unlock()
+
+	for len(this.pending) == 0 {
+		// The read deadline of the underlying connection applies here, so a
+		// stream of packets that restore to nothing cannot block past it.
+		n, addr, err := this.PacketConn.ReadFrom(this.buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// Copy the wire packet as restored packets may refer to it.
+		wire := make([]byte, n)
+		copy(wire, this.buffer[:n])
+
+		transformer, err := this.transformerFor(addr)
+		if err != nil {
+			continue
+		}
+
+		this.peer.Store(&addr)
+
+		var restored [][]byte
+		if restorer, ok := transformer.(SourceRestorer); ok {
+			restored, err = restorer.RestoreFrom(addr.String(), wire)
+		} else {
+			restored, err = transformer.Restore(wire)
+		}
+
+		if err != nil {
+			// Not a valid packet, so drop it.
+			continue
+		}
+
+		for _, payload := range restored {
+			this.pending = append(this.pending, pendingPacket{payload: payload, addr: addr})
+		}
+	}
+
+	next := this.pending[0]
+	this.pending = this.pending[1:]
+
+	return copy(p, next.payload), next.addr, nil
+}
+
+// Transform p and write the resulting wire packets to addr.
+// Returns len(p) if all of the wire packets were written.
+func (this *transformedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	transformer, err := this.transformerFor(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	this.peer.Store(&addr)
+
+	packets, err := transformer.Transform(p)
+	if err != nil {
+		return 0, err
+	}
+
+	err = this.writePackets(packets, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Write wire packets to addr.
+func (this *transformedPacketConn) writePackets(packets [][]byte, addr net.Addr) error {
+	for _, packet := range packets {
+		_, err := this.PacketConn.WriteTo(packet, addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package protean
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// A pipeline without decompression, for tests that need to round trip.
+func testPipelineConfig() ProteanConfig {
+	config := sampleProteanConfig()
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_HEADER_INJECTION},
+		{Name: STAGE_INJECTION},
+	}}
+
+	return config
+}
+
+func newTestShaper(t *testing.T) *ProteanShaper {
+	shaper := &ProteanShaper{}
+	err := shaper.ConfigureStruct(testPipelineConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return shaper
+}
+
+func listenLoopback(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWrapPacketConn(t *testing.T) {
+	client := WrapPacketConn(listenLoopback(t), newTestShaper(t))
+	serverConn := listenLoopback(t)
+	server := WrapPacketConn(serverConn, newTestShaper(t))
+
+	messages := [][]byte{[]byte("first"), []byte("second")}
+	for _, message := range messages {
+		_, err := client.WriteTo(message, serverConn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The injected packet is consumed by the server, so only the real
+	// messages are returned.
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, MAX_DATAGRAM_SIZE)
+	for _, message := range messages {
+		n, addr, err := server.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buffer[:n], message) {
+			t.Errorf("read %q, expected %q", buffer[:n], message)
+		}
+
+		if addr.String() != client.LocalAddr().String() {
+			t.Errorf("read from %v, expected %v", addr, client.LocalAddr())
+		}
+	}
+}
+
+// Packets that cannot be restored are dropped, and the read deadline still
+// applies.
+func TestWrapPacketConnDropsInvalid(t *testing.T) {
+	client := listenLoopback(t)
+	serverConn := listenLoopback(t)
+	server := WrapPacketConn(serverConn, newTestShaper(t))
+
+	_, err := client.WriteTo([]byte("not a protean packet"), serverConn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = server.ReadFrom(make([]byte, MAX_DATAGRAM_SIZE))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
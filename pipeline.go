@@ -0,0 +1,279 @@
+package protean
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Names of the stages accepted in a PipelineStage.
+// These match the names of the corresponding fields of ProteanConfig.
+const (
+	STAGE_FRAGMENTATION    = "fragmentation"
+	STAGE_ENCRYPTION       = "encryption"
+	STAGE_DECOMPRESSION    = "decompression"
+	STAGE_HEADER_INJECTION = "headerInjection"
+	STAGE_INJECTION        = "injection"
+	STAGE_FEC              = "fec"
+	STAGE_REPLAY           = "replay"
+	STAGE_HANDSHAKE        = "handshake"
+)
+
+// The ordered list of Transformers composed by a ProteanShaper.
+// Transform runs the stages in order and Restore runs them in reverse order.
+// Any subset of stages may be used, in any order, and a stage may appear more
+// than once.
+type PipelineConfig struct {
+	Stages []PipelineStage `json:"stages,omitempty"`
+}
+
+// A single stage in the pipeline.
+type PipelineStage struct {
+	// One of the STAGE constants.
+	Name string `json:"name"`
+
+	// Optional configuration for this stage, in the form accepted by the
+	// Configure() method of its Transformer. If omitted, the stage is
+	// configured from the field of ProteanConfig with the same name.
+	// This allows a repeated stage, such as a second header layer, to be
+	// configured differently from the first.
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// The pipeline used when none is configured.
+// This is the fixed order used by earlier versions of ProteanShaper:
+// fragment, encrypt, decompress, inject headers, inject packets.
+func defaultPipelineConfig() PipelineConfig {
+	return PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_DECOMPRESSION},
+		{Name: STAGE_HEADER_INJECTION},
+		{Name: STAGE_INJECTION},
+	}}
+}
+
+// Check the config, recording any problems under path.
+// Stages with their own configuration have it checked as well. Encryption
+// stages without their own configuration use the shared encryption config.
+func (config PipelineConfig) validate(path string, encryption EncryptionConfig, problems *ConfigErrors) {
+	for index, stage := range config.Stages {
+		stagePath := fmt.Sprintf("%s[%d]", fieldPath(path, "stages"), index)
+		stage.validate(stagePath, problems)
+
+		// The FEC stage groups fragments using their headers.
+		if stage.Name == STAGE_FEC && (index == 0 || config.Stages[index-1].Name != STAGE_FRAGMENTATION) {
+			problems.add(fieldPath(stagePath, "name"), "%s stage must directly follow a %s stage", STAGE_FEC, STAGE_FRAGMENTATION)
+		}
+
+		// The sequence number can only be trusted if changes to it are
+		// detected. CBC would let the sequence number in the first block be
+		// changed through the IV.
+		if stage.Name == STAGE_REPLAY && !config.authenticatedAfter(index, encryption) {
+			problems.add(fieldPath(stagePath, "name"), "%s stage must be followed by an %s stage with an authenticated mode", STAGE_REPLAY, STAGE_ENCRYPTION)
+		}
+
+		// The session keys are given to the stages before the handshake.
+		if stage.Name == STAGE_HANDSHAKE {
+			if config.hasBefore(index, STAGE_HANDSHAKE) {
+				problems.add(fieldPath(stagePath, "name"), "only one %s stage is allowed", STAGE_HANDSHAKE)
+			}
+
+			if !config.hasBefore(index, STAGE_ENCRYPTION) {
+				problems.add(fieldPath(stagePath, "name"), "%s stage must follow an %s stage", STAGE_HANDSHAKE, STAGE_ENCRYPTION)
+			}
+		}
+	}
+}
+
+// Check whether there is a stage with the given name.
+func (config PipelineConfig) has(name string) bool {
+	for _, stage := range config.Stages {
+		if stage.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether a stage with the given name comes before the given index.
+func (config PipelineConfig) hasBefore(index int, name string) bool {
+	for _, stage := range config.Stages[:index] {
+		if stage.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether an encryption stage with an authenticated mode comes after
+// the given index, using the shared config for stages without their own.
+func (config PipelineConfig) authenticatedAfter(index int, shared EncryptionConfig) bool {
+	for _, stage := range config.Stages[index+1:] {
+		if stage.Name != STAGE_ENCRYPTION {
+			continue
+		}
+
+		encryption := shared
+		if stage.hasConfig() {
+			// A config that does not parse is reported by the stage itself.
+			encryption = EncryptionConfig{}
+			if err := json.Unmarshal(stage.Config, &encryption); err != nil {
+				return true
+			}
+		}
+
+		if isAuthenticatedMode(encryption.Mode) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether any stage with the given name is configured from the shared
+// config rather than its own.
+func (config PipelineConfig) usesShared(name string) bool {
+	for _, stage := range config.Stages {
+		if stage.Name == name && !stage.hasConfig() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether the last stage, apart from injection, is a header injection
+// stage configured from the shared config.
+func (config PipelineConfig) headerOutermost() bool {
+	for index := len(config.Stages) - 1; index >= 0; index-- {
+		stage := config.Stages[index]
+		if stage.Name != STAGE_INJECTION {
+			return stage.Name == STAGE_HEADER_INJECTION && !stage.hasConfig()
+		}
+	}
+
+	return false
+}
+
+// Check the stage, recording any problems under path.
+func (stage PipelineStage) validate(path string, problems *ConfigErrors) {
+	var validator interface {
+		validate(path string, problems *ConfigErrors)
+	}
+
+	switch stage.Name {
+	case STAGE_FRAGMENTATION:
+		validator = &FragmentationConfig{}
+	case STAGE_ENCRYPTION:
+		validator = &EncryptionConfig{}
+	case STAGE_DECOMPRESSION:
+		validator = &DecompressionConfig{}
+	case STAGE_HEADER_INJECTION:
+		validator = &HeaderConfig{}
+	case STAGE_INJECTION:
+		validator = &SequenceConfig{}
+	case STAGE_FEC:
+		validator = &FECConfig{}
+	case STAGE_REPLAY:
+		validator = &ReplayConfig{}
+	case STAGE_HANDSHAKE:
+		validator = &HandshakeConfig{}
+	default:
+		problems.add(fieldPath(path, "name"), "unknown stage %q", stage.Name)
+		return
+	}
+
+	if !stage.hasConfig() {
+		return
+	}
+
+	configPath := fieldPath(path, "config")
+	err := json.Unmarshal(stage.Config, validator)
+	if err != nil {
+		problems.add(configPath, "%v", err)
+		return
+	}
+
+	validator.validate(configPath, problems)
+}
+
+// Check whether a stage has its own configuration.
+func (stage PipelineStage) hasConfig() bool {
+	return len(stage.Config) > 0 && string(stage.Config) != "null"
+}
+
+// Make and configure the Transformer for a stage.
+func makeStage(stage PipelineStage, config ProteanConfig, clock Clock) (TransformerV2, error) {
+	switch stage.Name {
+	case STAGE_FRAGMENTATION:
+		shaper := &FragmentationShaper{clock: clock}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Fragmentation) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_ENCRYPTION:
+		shaper := &EncryptionShaper{clock: clock}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Encryption) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_DECOMPRESSION:
+		shaper := &DecompressionShaper{}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Decompression) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_HEADER_INJECTION:
+		shaper := &HeaderShaper{clock: clock}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.HeaderInjection) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_INJECTION:
+		shaper := &ByteSequenceShaper{}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Injection) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_FEC:
+		shaper := &FECShaper{clock: clock}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.FEC) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_REPLAY:
+		shaper := &ReplayShaper{}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Replay) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	case STAGE_HANDSHAKE:
+		shaper := &HandshakeShaper{clock: clock}
+		if err := configureStage(shaper, stage, func() error { return shaper.ConfigureStruct(config.Handshake) }); err != nil {
+			return nil, err
+		}
+
+		return shaper, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown stage %q", ErrMalformedConfig, stage.Name)
+	}
+}
+
+// Configure a stage from its own configuration if it has one, otherwise
+// from the shared configuration.
+func configureStage(shaper TransformerV2, stage PipelineStage, configureShared func() error) error {
+	if stage.hasConfig() {
+		return shaper.Configure(string(stage.Config))
+	}
+
+	return configureShared()
+}
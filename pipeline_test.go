@@ -0,0 +1,88 @@
+package protean
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func roundTrip(t *testing.T, shaper *ProteanShaper, plain []byte) {
+	roundTripBetween(t, shaper, shaper, plain)
+}
+
+// Transform with the sender and check that the receiver restores the packet.
+func roundTripBetween(t *testing.T, sender *ProteanShaper, receiver *ProteanShaper, plain []byte) {
+	transformed, err := sender.Transform(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored [][]byte
+	for _, packet := range transformed {
+		packets, err := receiver.Restore(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored = append(restored, packets...)
+	}
+
+	if len(restored) != 1 || !bytes.Equal(restored[0], plain) {
+		t.Fatalf("restored %x, expected %x", restored, plain)
+	}
+}
+
+// A pipeline that skips decompression and adds a second, different header.
+func TestPipelineCustomOrder(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_HEADER_INJECTION},
+		{Name: STAGE_HEADER_INJECTION, Config: []byte(`{"addHeader":{"header":"cafe"},"removeHeader":{"header":"cafe"}}`)},
+		{Name: STAGE_INJECTION},
+	}}
+
+	shaper := &ProteanShaper{}
+	err := shaper.ConfigureStruct(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformed, err := shaper.Transform([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The injected packet comes first, then the real packet with the outer
+	// header in front of the inner one.
+	if len(transformed) != 2 || !bytes.HasPrefix(transformed[1], []byte("\xca\xfe\x41\x02")) {
+		t.Fatalf("unexpected packets %x", transformed)
+	}
+
+	roundTrip(t, shaper, []byte("hello again"))
+}
+
+// The default pipeline, with its decompression stage, restores packets of
+// every length.
+func TestPipelineDefault(t *testing.T) {
+	shaper := &ProteanShaper{}
+	err := shaper.ConfigureStruct(sampleProteanConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, length := range []int{0, 1, 2, 100, 1400} {
+		roundTrip(t, shaper, bytes.Repeat([]byte{0x5A}, length))
+	}
+}
+
+func TestPipelineUnknownStage(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{{Name: "compression"}}}
+
+	err := (&ProteanShaper{}).ConfigureStruct(config)
+	if !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("expected ErrMalformedConfig, got %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package protean
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Names of the built-in profiles accepted in ProfileConfig.Name.
+const (
+	// RTP carrying G.711 audio sampled at 8000 Hz, in packets of up to 172
+	// bytes, the size of 20 ms of audio.
+	PROFILE_RTP_AUDIO = "rtp-audio"
+
+	// RTP carrying video with a dynamic payload type and a 90000 Hz clock.
+	PROFILE_RTP_VIDEO = "rtp-video"
+
+	// STUN Binding requests from the client and Binding success responses
+	// from the server, with the payload in a PADDING attribute (RFC 5780).
+	// Each response has the transaction ID of the last request received, and
+	// a mapped address chosen at random for the session.
+	PROFILE_STUN = "stun"
+
+	// DNS queries from the client and responses from the server, with the
+	// payload in an EDNS(0) padding option (RFC 7830). The queries are for
+	// the A record of ProfileConfig.Domain, and each response has the ID of
+	// the last query received and an address chosen at random for the
+	// session.
+	PROFILE_DNS = "dns"
+
+	// QUIC version 1, starting with an Initial packet with a long header and
+	// continuing with 1-RTT packets with short headers, addressed to the
+	// connection ID the peer gave in its Initial. The connection IDs are
+	// those of the ProfileConfig, so they are the same in every session of a
+	// deployment. The Initial packets are not encrypted as real ones are, so
+	// an observer who derives the Initial keys can tell them apart.
+	PROFILE_QUIC = "quic"
+
+	// DTLS 1.2 application data records.
+	PROFILE_DTLS = "dtls"
+)
+
+// Selects a built-in profile, which configures the header injection, packet
+// injection and fragmentation stages so that the packets pass as another
+// protocol. The profile replaces the headerInjection and injection sections
+// of the ProteanConfig, and the maxLength of the fragmentation section, so
+// these need not be given. An mtu still applies if it is smaller.
+//
+// The packets only parse as the protocol if the header injection stage is the
+// last in the pipeline apart from packet injection, as it is by default.
+type ProfileConfig struct {
+	// One of the PROFILE constants, or empty for none.
+	Name string `json:"name,omitempty"`
+
+	// ROLE_CLIENT or ROLE_SERVER. Where the two directions of the protocol
+	// differ, such as DNS queries and responses, each end sends its own
+	// side and expects the other. The empty string selects ROLE_CLIENT.
+	Role string `json:"role,omitempty"`
+
+	// For PROFILE_DNS, the name to query, such as "www.example.com".
+	// Required, as a name shared by every deployment would be easy to block.
+	Domain string `json:"domain,omitempty"`
+
+	// For PROFILE_QUIC, the connection IDs the client and the server give in
+	// their Initial packets, each from 1 to 20 bytes encoded as a hex
+	// string. Required, and should be chosen at random for each deployment,
+	// as IDs shared by every deployment would be easy to block.
+	ClientConnectionID string `json:"clientConnectionId,omitempty"`
+	ServerConnectionID string `json:"serverConnectionId,omitempty"`
+}
+
+// Check the config, recording any problems under path.
+func (config ProfileConfig) validate(path string, problems *ConfigErrors) {
+	if config.Name == "" {
+		return
+	}
+
+	if _, ok := lookupProfile(config); !ok {
+		problems.add(fieldPath(path, "name"), "unknown profile %q", config.Name)
+	}
+
+	switch config.Name {
+	case PROFILE_DNS:
+		if _, err := dnsName(config.Domain); err != nil {
+			problems.add(fieldPath(path, "domain"), "%v", err)
+		}
+	case PROFILE_QUIC:
+		if err := checkQUICConnectionID(config.ClientConnectionID); err != nil {
+			problems.add(fieldPath(path, "clientConnectionId"), "%v", err)
+		}
+
+		if err := checkQUICConnectionID(config.ServerConnectionID); err != nil {
+			problems.add(fieldPath(path, "serverConnectionId"), "%v", err)
+		}
+	}
+
+	switch config.Role {
+	case "", ROLE_CLIENT, ROLE_SERVER:
+	default:
+		problems.add(fieldPath(path, "role"), "unknown role %q", config.Role)
+	}
+}
+
+// The configuration a profile gives the stages it covers.
+type profileStages struct {
+	// The headers of the packets sent by the client and by the server.
+	clientHeader SerializedHeaderModel
+	serverHeader SerializedHeaderModel
+
+	// The packets injected by the client and by the server.
+	clientInjection []SerializedSequenceModel
+	serverInjection []SerializedSequenceModel
+
+	// The longest packets sent by the client and by the server.
+	clientLength uint16
+	serverLength uint16
+}
+
+// The stages for the profile the config names, if there is one. The settings
+// of the config are assumed to be valid.
+func lookupProfile(config ProfileConfig) (profileStages, bool) {
+	switch config.Name {
+	case PROFILE_RTP_AUDIO:
+		// Payload type 0 is G.711 mu-law.
+		header := rtpHeader("00", 8000)
+		return profileStages{clientHeader: header, serverHeader: header, clientLength: 172, serverLength: 172}, true
+	case PROFILE_RTP_VIDEO:
+		// Payload type 96 is the first dynamic type, as commonly used for
+		// H.264 and VP8.
+		header := rtpHeader("60", 90000)
+		return profileStages{clientHeader: header, serverHeader: header, clientLength: 1200, serverLength: 1200}, true
+	case PROFILE_STUN:
+		// The XOR-MAPPED-ADDRESS of the response is an IPv4 address, with
+		// the port and address chosen for the session.
+		request := stunHeader(HEADER_FIELD_RANDOM, "0001", nil)
+		response := stunHeader(HEADER_FIELD_ECHO, "0101", []HeaderField{
+			{Type: HEADER_FIELD_FIXED, Value: "0020" + "0008" + "0001"},
+			{Type: HEADER_FIELD_RANDOM, Width: 6, PerSession: true},
+		})
+
+		// Binding messages over UDP should fit in 576 byte datagrams.
+		return profileStages{clientHeader: request, serverHeader: response, clientLength: 548, serverLength: 548}, true
+	case PROFILE_DNS:
+		// A query for the A record of the domain, and a response giving an
+		// address chosen for the session, for 300 seconds.
+		name, _ := dnsName(config.Domain)
+		question := name + "0001" + "0001"
+		query := dnsHeader(HEADER_FIELD_RANDOM, "0100", "0001"+"0000"+"0000"+"0001", []HeaderField{
+			{Type: HEADER_FIELD_FIXED, Value: question},
+		})
+		response := dnsHeader(HEADER_FIELD_ECHO, "8180", "0001"+"0001"+"0000"+"0001", []HeaderField{
+			{Type: HEADER_FIELD_FIXED, Value: question + "c00c" + "0001" + "0001" + "0000012c" + "0004"},
+			{Type: HEADER_FIELD_RANDOM, Width: 4, PerSession: true},
+		})
+
+		// Queries are kept to the classic limit, and responses to the size
+		// recommended for EDNS(0) to avoid IP fragmentation.
+		return profileStages{clientHeader: query, serverHeader: response, clientLength: 512, serverLength: 1232}, true
+	case PROFILE_QUIC:
+		// Each side announces its connection ID as the source of its Initial,
+		// and the other sends its short header packets to it.
+		clientID, serverID := strings.ToLower(config.ClientConnectionID), strings.ToLower(config.ServerConnectionID)
+		clientInitial := quicInitial(serverID, clientID)
+		serverInitial := quicInitial(clientID, serverID)
+		return profileStages{
+			clientHeader:    quicShortHeader(serverID),
+			serverHeader:    quicShortHeader(clientID),
+			clientInjection: []SerializedSequenceModel{clientInitial},
+			serverInjection: []SerializedSequenceModel{serverInitial},
+			clientLength:    1200,
+			serverLength:    1200,
+		}, true
+	case PROFILE_DTLS:
+		// An application data record in epoch 1, after the handshake.
+		header := SerializedHeaderModel{Fields: []HeaderField{
+			{Type: HEADER_FIELD_FIXED, Value: "17" + "fefd" + "0001"},
+			{Type: HEADER_FIELD_COUNTER, Width: 6, Start: 1},
+			{Type: HEADER_FIELD_LENGTH, Width: 2, Scope: HEADER_SCOPE_PAYLOAD},
+		}}
+
+		return profileStages{clientHeader: header, serverHeader: header, clientLength: 1200, serverLength: 1200}, true
+	default:
+		return profileStages{}, false
+	}
+}
+
+// An RTP header (RFC 3550) with the given payload type, encoded as hex, and
+// timestamps at the given rate.
+func rtpHeader(payloadType string, rate uint64) SerializedHeaderModel {
+	return SerializedHeaderModel{Fields: []HeaderField{
+		// Version 2, with no padding, extension or contributing sources.
+		{Type: HEADER_FIELD_FIXED, Value: "80"},
+
+		// No marker, and the payload type.
+		{Type: HEADER_FIELD_FIXED, Value: payloadType},
+
+		// The sequence number, which starts at a random value.
+		{Type: HEADER_FIELD_COUNTER, Width: 2, RandomStart: true},
+
+		{Type: HEADER_FIELD_TIMESTAMP, Width: 4, Rate: rate},
+
+		// The synchronization source.
+		{Type: HEADER_FIELD_RANDOM, Width: 4, PerSession: true},
+	}}
+}
+
+// A STUN message (RFC 5389) with a transaction ID field of the given type, the
+// given message type encoded as hex, and the fields of the given attributes
+// before the PADDING attribute that holds the payload.
+func stunHeader(id string, messageType string, attributes []HeaderField) SerializedHeaderModel {
+	fields := []HeaderField{
+		{Type: HEADER_FIELD_FIXED, Value: messageType},
+
+		// The message length leaves out the 20 byte header.
+		{Type: HEADER_FIELD_LENGTH, Width: 2, Adjust: -20},
+
+		// The magic cookie and the transaction ID, which a response repeats
+		// from its request.
+		{Type: HEADER_FIELD_FIXED, Value: "2112a442"},
+		{Type: id, Width: 12},
+	}
+
+	fields = append(fields, attributes...)
+
+	// The PADDING attribute's length leaves out the padding after it.
+	fields = append(fields,
+		HeaderField{Type: HEADER_FIELD_FIXED, Value: "0026"},
+		HeaderField{Type: HEADER_FIELD_LENGTH, Width: 2, Scope: HEADER_SCOPE_PAYLOAD},
+	)
+
+	return SerializedHeaderModel{Fields: fields, Align: 4}
+}
+
+// A DNS message (RFC 1035) with an ID field of the given type, the given flags
+// and counts encoded as hex, and the fields of the given question and answer
+// records, followed by an OPT record (RFC 6891) holding the payload.
+func dnsHeader(id string, flags string, counts string, records []HeaderField) SerializedHeaderModel {
+	fields := []HeaderField{
+		// The ID, which a response repeats from its query.
+		{Type: id, Width: 2},
+
+		{Type: HEADER_FIELD_FIXED, Value: flags + counts},
+	}
+
+	fields = append(fields, records...)
+
+	// The OPT record for the root, advertising a 4096 byte UDP payload, with
+	// no extended code or flags. Its data holds the code and length of the
+	// padding option, then the payload.
+	fields = append(fields,
+		HeaderField{Type: HEADER_FIELD_FIXED, Value: "00" + "0029" + "1000" + "00000000"},
+		HeaderField{Type: HEADER_FIELD_LENGTH, Width: 2, Scope: HEADER_SCOPE_PAYLOAD, Adjust: 4},
+		HeaderField{Type: HEADER_FIELD_FIXED, Value: "000c"},
+		HeaderField{Type: HEADER_FIELD_LENGTH, Width: 2, Scope: HEADER_SCOPE_PAYLOAD},
+	)
+
+	return SerializedHeaderModel{Fields: fields}
+}
+
+// Encode a domain name as the labels of a DNS message, as hex, checking that
+// it is a valid host name.
+func dnsName(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return "", fmt.Errorf("a domain is required by the %s profile", PROFILE_DNS)
+	}
+
+	// Each label takes a length byte, and the name ends with an empty label.
+	if len(domain) > 253 {
+		return "", fmt.Errorf("domain of %d characters is longer than 253", len(domain))
+	}
+
+	var name []byte
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("invalid label %q in domain %q", label, domain)
+		}
+
+		for _, character := range []byte(label) {
+			if !('a' <= character && character <= 'z' || 'A' <= character && character <= 'Z' || '0' <= character && character <= '9' || character == '-') {
+				return "", fmt.Errorf("invalid label %q in domain %q", label, domain)
+			}
+		}
+
+		name = append(name, byte(len(label)))
+		name = append(name, label...)
+	}
+
+	return hex.EncodeToString(append(name, 0)), nil
+}
+
+// Check a QUIC connection ID given as hex.
+func checkQUICConnectionID(id string) error {
+	if id == "" {
+		return fmt.Errorf("a connection ID is required by the %s profile", PROFILE_QUIC)
+	}
+
+	decoded, err := hex.DecodeString(id)
+	if err != nil {
+		return fmt.Errorf("invalid hex: %v", err)
+	}
+
+	if len(decoded) > 20 {
+		return fmt.Errorf("connection ID of %d bytes is longer than 20", len(decoded))
+	}
+
+	return nil
+}
+
+// A QUIC 1-RTT packet header (RFC 9000) with the given destination connection
+// ID, encoded as hex.
+func quicShortHeader(destination string) SerializedHeaderModel {
+	return SerializedHeaderModel{Fields: []HeaderField{
+		// A short header with the fixed bit set and a 2-byte packet number.
+		{Type: HEADER_FIELD_FIXED, Value: "41"},
+		{Type: HEADER_FIELD_FIXED, Value: destination},
+		{Type: HEADER_FIELD_COUNTER, Width: 2},
+	}}
+}
+
+// A QUIC version 1 Initial packet (RFC 9000) of 1200 bytes with the given
+// connection IDs, encoded as hex. The packet number and payload after the
+// header are random.
+func quicInitial(destination string, source string) SerializedSequenceModel {
+	// A long header with the fixed bit set and a 2-byte packet number, the
+	// version, the connection IDs and no token. The length of the rest of
+	// the packet is a 2-byte variable-length integer.
+	header := "c1" + "00000001" + fmt.Sprintf("%02x", len(destination)/2) + destination + fmt.Sprintf("%02x", len(source)/2) + source + "00"
+	rest := 1200 - len(header)/2 - 2
+	header += fmt.Sprintf("%04x", 0x4000|rest)
+	return SerializedSequenceModel{Index: 0, Offset: 0, Sequence: header, Length: 1200}
+}
+
+// The config with the sections the profile covers replaced by those it gives
+// for the configured role. The config is returned as it is if it has no
+// profile.
+func (config ProteanConfig) withProfile() ProteanConfig {
+	stages, ok := lookupProfile(config.Profile)
+	if !ok {
+		return config
+	}
+
+	send, receive := stages.clientHeader, stages.serverHeader
+	inject, remove := stages.clientInjection, stages.serverInjection
+	length := stages.clientLength
+	if config.Profile.Role == ROLE_SERVER {
+		send, receive = receive, send
+		inject, remove = remove, inject
+		length = stages.serverLength
+	}
+
+	config.HeaderInjection = HeaderConfig{AddHeader: send, RemoveHeader: receive}
+	config.Injection = SequenceConfig{AddSequences: inject, RemoveSequences: remove}
+	config.Fragmentation.MaxLength = length
+	return config
+}
@@ -0,0 +1,433 @@
+package protean
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/rtp"
+	"github.com/pion/stun"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// The profile with the given name and role, with the settings it requires.
+func testProfile(name string, role string) ProfileConfig {
+	return ProfileConfig{Name: name, Role: role, Domain: "updates.example.net", ClientConnectionID: "5b1c7d0e9fa2b384", ServerConnectionID: "C6E1F20A3B4D"}
+}
+
+// Parses a packet sent in a role, failing the test if it is not a valid
+// packet of the protocol.
+type profileParser func(t *testing.T, role string, packet []byte)
+
+func parseRTP(payloadType uint8) profileParser {
+	return func(t *testing.T, role string, packet []byte) {
+		var parsed rtp.Packet
+		if err := parsed.Unmarshal(packet); err != nil {
+			t.Fatalf("%x: %v", packet, err)
+		}
+
+		if parsed.Version != 2 || parsed.PayloadType != payloadType || parsed.Padding || parsed.Extension || len(parsed.CSRC) != 0 {
+			t.Fatalf("unexpected RTP header %+v", parsed.Header)
+		}
+	}
+}
+
+// Responses have the transaction ID of the last request, which the peer has
+// restored, and the same mapped address throughout the session.
+func parseSTUN() profileParser {
+	var request [stun.TransactionIDSize]byte
+	var mapped *stun.XORMappedAddress
+	return func(t *testing.T, role string, packet []byte) {
+		message := &stun.Message{Raw: append([]byte(nil), packet...)}
+		if err := message.Decode(); err != nil {
+			t.Fatalf("%x: %v", packet, err)
+		}
+
+		if role == ROLE_CLIENT {
+			request = message.TransactionID
+		} else if message.TransactionID != request {
+			t.Fatalf("response transaction ID %x, expected %x from the request", message.TransactionID, request)
+		}
+
+		if role == ROLE_SERVER {
+			var address stun.XORMappedAddress
+			if err := address.GetFrom(message); err != nil || address.IP.To4() == nil {
+				t.Fatalf("unexpected mapped address %v: %v", address, err)
+			}
+
+			if mapped == nil {
+				mapped = &address
+			} else if !address.IP.Equal(mapped.IP) || address.Port != mapped.Port {
+				t.Fatalf("mapped address %v, expected %v from earlier in the session", address, mapped)
+			}
+		}
+
+		checkSTUN(t, role, message)
+	}
+}
+
+func checkSTUN(t *testing.T, role string, message *stun.Message) {
+	expected := stun.BindingRequest
+	if role == ROLE_SERVER {
+		expected = stun.BindingSuccess
+	}
+
+	if message.Type != expected {
+		t.Fatalf("message type %v, expected %v", message.Type, expected)
+	}
+
+	if _, err := message.Get(stun.AttrPadding); err != nil {
+		t.Fatalf("no PADDING attribute: %v", err)
+	}
+}
+
+// Responses have the ID of the last query, which the peer has restored, and
+// the same answer throughout the session.
+func parseDNS() profileParser {
+	var query uint16
+	var answer net.IP
+	return func(t *testing.T, role string, packet []byte) {
+		var message layers.DNS
+		if err := message.DecodeFromBytes(packet, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("%x: %v", packet, err)
+		}
+
+		if role == ROLE_CLIENT {
+			query = message.ID
+		} else if message.ID != query {
+			t.Fatalf("response ID %#x, expected %#x from the query", message.ID, query)
+		}
+
+		checkDNS(t, role, message)
+
+		if role == ROLE_SERVER {
+			if answer == nil {
+				answer = message.Answers[0].IP
+			} else if !message.Answers[0].IP.Equal(answer) {
+				t.Fatalf("answer %v, expected %v from earlier in the session", message.Answers[0].IP, answer)
+			}
+		}
+	}
+}
+
+func checkDNS(t *testing.T, role string, message layers.DNS) {
+
+	if message.QR != (role == ROLE_SERVER) || message.OpCode != layers.DNSOpCodeQuery || !message.RD {
+		t.Fatalf("unexpected flags in %+v", message)
+	}
+
+	if len(message.Questions) != 1 || string(message.Questions[0].Name) != "updates.example.net" || message.Questions[0].Type != layers.DNSTypeA {
+		t.Fatalf("unexpected questions %+v", message.Questions)
+	}
+
+	if role == ROLE_SERVER && (len(message.Answers) != 1 || message.Answers[0].Type != layers.DNSTypeA || message.Answers[0].IP.To4() == nil) {
+		t.Fatalf("unexpected answers %+v", message.Answers)
+	}
+
+	if len(message.Additionals) != 1 || message.Additionals[0].Type != layers.DNSTypeOPT {
+		t.Fatalf("unexpected additional records %+v", message.Additionals)
+	}
+
+	options := message.Additionals[0].OPT
+	if len(options) != 1 || options[0].Code != layers.DNSOptionCodePadding {
+		t.Fatalf("unexpected options %+v", options)
+	}
+}
+
+// The datagram holds a single record, found by its length.
+func parseDTLS(t *testing.T, role string, packet []byte) {
+	records, err := recordlayer.UnpackDatagram(packet)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("%x: %d records: %v", packet, len(records), err)
+	}
+
+	var record recordlayer.RecordLayer
+	if err := record.Unmarshal(records[0]); err != nil {
+		t.Fatalf("%x: %v", packet, err)
+	}
+
+	if record.Header.ContentType != protocol.ContentTypeApplicationData || record.Header.Version != protocol.Version1_2 || record.Header.Epoch != 1 {
+		t.Fatalf("unexpected record header %+v", record.Header)
+	}
+}
+
+// The parts of a QUIC packet header (RFC 9000, section 17).
+type quicHeader struct {
+	long        bool
+	packetType  byte
+	version     uint32
+	destination []byte
+	source      []byte
+}
+
+// Parse the header of a QUIC version 1 packet, checking that the lengths it
+// gives are consistent with the packet. A short header does not give the
+// length of its connection ID, so it must be known.
+func parseQUICHeader(packet []byte, shortIDLength int) (quicHeader, error) {
+	var header quicHeader
+	if len(packet) < 1 || packet[0]&0x40 == 0 {
+		return header, errors.New("the fixed bit is clear")
+	}
+
+	// Header protection samples 16 bytes from 4 bytes after the start of the
+	// packet number.
+	packetNumberLength := int(packet[0]&0x03) + 1
+	if packet[0]&0x80 == 0 {
+		if len(packet) < 1+shortIDLength+4+16 {
+			return header, fmt.Errorf("a short header packet of %d bytes is too short to protect", len(packet))
+		}
+
+		header.destination = packet[1 : 1+shortIDLength]
+		return header, nil
+	}
+
+	header.long = true
+	header.packetType = packet[0] >> 4 & 0x03
+	rest := packet[1:]
+	if len(rest) < 5 {
+		return header, errors.New("truncated version")
+	}
+
+	header.version = binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	for _, id := range []*[]byte{&header.destination, &header.source} {
+		if len(rest) < 1 || rest[0] > 20 || len(rest) < 1+int(rest[0]) {
+			return header, errors.New("invalid connection ID")
+		}
+
+		*id = rest[1 : 1+rest[0]]
+		rest = rest[1+rest[0]:]
+	}
+
+	if header.packetType != 0 {
+		return header, fmt.Errorf("packet type %d is not Initial", header.packetType)
+	}
+
+	token, size, err := quicvarint.Parse(rest)
+	if err != nil || uint64(len(rest)-size) < token {
+		return header, fmt.Errorf("invalid token length: %v", err)
+	}
+
+	rest = rest[size+int(token):]
+	length, size, err := quicvarint.Parse(rest)
+	if err != nil || int(length) != len(rest)-size || int(length) < packetNumberLength+4+16 {
+		return header, fmt.Errorf("length %d for %d bytes: %v", length, len(rest)-size, err)
+	}
+
+	return header, nil
+}
+
+// Short header packets are sent to the connection ID that the peer announced
+// as the source of its Initial packet.
+func parseQUIC(t *testing.T) profileParser {
+	stages, _ := lookupProfile(testProfile(PROFILE_QUIC, ""))
+	announced := make(map[string][]byte)
+	for role, injection := range map[string]SerializedSequenceModel{ROLE_CLIENT: stages.clientInjection[0], ROLE_SERVER: stages.serverInjection[0]} {
+		initial, err := hex.DecodeString(injection.Sequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := parseQUICHeader(append(initial, make([]byte, int(injection.Length)-len(initial))...), 0)
+		if err != nil {
+			t.Fatalf("%s Initial: %v", role, err)
+		}
+
+		announced[role] = header.source
+	}
+
+	return func(t *testing.T, role string, packet []byte) {
+		peer := ROLE_SERVER
+		if role == ROLE_SERVER {
+			peer = ROLE_CLIENT
+		}
+
+		header, err := parseQUICHeader(packet, len(announced[peer]))
+		if err != nil {
+			t.Fatalf("%x: %v", packet[:min(len(packet), 32)], err)
+		}
+
+		if header.long && (header.version != 1 || !bytes.Equal(header.source, announced[role])) {
+			t.Fatalf("unexpected Initial header %+v", header)
+		}
+
+		if !bytes.Equal(header.destination, announced[peer]) {
+			t.Fatalf("sent to connection ID %x, expected %x", header.destination, announced[peer])
+		}
+	}
+}
+
+// Packets sent with each profile parse as the protocol, stay within its
+// lengths, and are restored by the peer.
+func TestProfiles(t *testing.T) {
+	parsers := map[string]profileParser{
+		PROFILE_RTP_AUDIO: parseRTP(0),
+		PROFILE_RTP_VIDEO: parseRTP(96),
+		PROFILE_STUN:      parseSTUN(),
+		PROFILE_DNS:       parseDNS(),
+		PROFILE_QUIC:      parseQUIC(t),
+		PROFILE_DTLS:      parseDTLS,
+	}
+
+	for name, parse := range parsers {
+		stages, _ := lookupProfile(testProfile(name, ""))
+		shapers := make(map[string]*ProteanShaper)
+		for _, role := range []string{ROLE_CLIENT, ROLE_SERVER} {
+			config := sampleProteanConfig()
+			config.Profile = testProfile(name, role)
+			shapers[role] = &ProteanShaper{}
+			if err := shapers[role].ConfigureStruct(config); err != nil {
+				t.Fatalf("%s %s: %v", name, role, err)
+			}
+		}
+
+		for _, role := range []string{ROLE_CLIENT, ROLE_SERVER} {
+			sender, receiver := shapers[ROLE_CLIENT], shapers[ROLE_SERVER]
+			limit := int(stages.clientLength)
+			if role == ROLE_SERVER {
+				sender, receiver = receiver, sender
+				limit = int(stages.serverLength)
+			}
+
+			for _, length := range []int{0, 1, 3, 100, 1000, 3000} {
+				plain := randomPacket(length)
+				transformed, err := sender.Transform(plain)
+				if err != nil {
+					t.Fatalf("%s %s, %d bytes: %v", name, role, length, err)
+				}
+
+				var restored [][]byte
+				for _, packet := range transformed {
+					// Injected packets have a length of their own.
+					if len(packet) > limit && !(name == PROFILE_QUIC && len(packet) == 1200) {
+						t.Errorf("%s %s: %d byte packet is longer than %d", name, role, len(packet), limit)
+					}
+
+					parse(t, role, packet)
+
+					packets, err := receiver.Restore(packet)
+					if err != nil {
+						t.Fatalf("%s %s, %d bytes: %v", name, role, length, err)
+					}
+
+					restored = append(restored, packets...)
+				}
+
+				if len(restored) != 1 || !bytes.Equal(restored[0], plain) {
+					t.Fatalf("%s %s: restored %d packets, expected %d bytes", name, role, len(restored), length)
+				}
+			}
+		}
+	}
+}
+
+func TestProfileConfig(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Profile = ProfileConfig{Name: "ssh", Role: "peer"}
+
+	var problems ConfigErrors
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 2 || problems[0].Path != "profile.name" || problems[1].Path != "profile.role" {
+		t.Errorf("unknown profile and role: got %v", err)
+	}
+
+	// Without the header on the outside, the packets would not parse.
+	config.Profile = testProfile(PROFILE_DNS, "")
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{{Name: STAGE_HEADER_INJECTION}, {Name: STAGE_ENCRYPTION}}}
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != "profile.name" {
+		t.Errorf("header injection before encryption: got %v", err)
+	}
+
+	// Profiles that would otherwise send the same names and IDs in every
+	// deployment require them to be given.
+	config = sampleProteanConfig()
+	config.Profile = ProfileConfig{Name: PROFILE_DNS, Domain: "-bad.example"}
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != "profile.domain" {
+		t.Errorf("invalid domain: got %v", err)
+	}
+
+	config.Profile = ProfileConfig{Name: PROFILE_QUIC, ServerConnectionID: "00112233445566778899aabbccddeeff0011223344"}
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 2 || problems[0].Path != "profile.clientConnectionId" || problems[1].Path != "profile.serverConnectionId" {
+		t.Errorf("missing and long connection IDs: got %v", err)
+	}
+
+	// The sections the profile replaces need not be valid.
+	config = sampleProteanConfig()
+	config.Profile = testProfile(PROFILE_STUN, ROLE_SERVER)
+	config.HeaderInjection.AddHeader.Header = "not hex"
+	config.Fragmentation.MaxLength = 0
+	if err := config.Validate(); err != nil {
+		t.Errorf("replaced sections: %v", err)
+	}
+
+	// An mtu below the profile's lengths still applies.
+	config.MTU = 300
+	shaper := &ProteanShaper{}
+	if err := shaper.ConfigureStruct(config); err != nil {
+		t.Fatal(err)
+	}
+
+	transformed, err := shaper.Transform(randomPacket(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, packet := range transformed {
+		if len(packet) > 300 {
+			t.Errorf("%d byte packet is longer than the mtu", len(packet))
+		}
+	}
+}
+
+// The addresses in STUN and DNS responses are chosen for each session rather
+// than being the same in every deployment.
+func TestProfileSessions(t *testing.T) {
+	for _, name := range []string{PROFILE_STUN, PROFILE_DNS} {
+		addresses := make(map[string]bool)
+		for session := 0; session < 2; session++ {
+			config := sampleProteanConfig()
+			config.Profile = testProfile(name, ROLE_SERVER)
+			shaper := &ProteanShaper{}
+			if err := shaper.ConfigureStruct(config); err != nil {
+				t.Fatal(err)
+			}
+
+			transformed, err := shaper.Transform(randomPacket(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var address net.IP
+			if name == PROFILE_STUN {
+				message := &stun.Message{Raw: transformed[0]}
+				var mapped stun.XORMappedAddress
+				if err := message.Decode(); err != nil || mapped.GetFrom(message) != nil {
+					t.Fatalf("%x: %v", transformed[0], err)
+				}
+
+				address = mapped.IP
+			} else {
+				var message layers.DNS
+				if err := message.DecodeFromBytes(transformed[0], gopacket.NilDecodeFeedback); err != nil || len(message.Answers) != 1 {
+					t.Fatalf("%x: %v", transformed[0], err)
+				}
+
+				address = message.Answers[0].IP
+			}
+
+			addresses[address.String()] = true
+		}
+
+		if len(addresses) != 2 {
+			t.Errorf("%s: two sessions gave the same address %v", name, addresses)
+		}
+	}
+}
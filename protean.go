@@ -3,26 +3,150 @@ package protean
 import (
 	"encoding/json"
 	"fmt"
+	"sync/atomic"
 )
 
+// The version of the ProteanConfig schema implemented by this package.
+// It is incremented whenever a change to the schema would cause an existing
+// config to be interpreted differently.
+const PROTEAN_CONFIG_VERSION = 1
+
 // Accepted in serialised form by Configure().
 type ProteanConfig struct {
-	decompression   DecompressionConfig
-	encryption      EncryptionConfig
-	fragmentation   FragmentationConfig
-	injection       SequenceConfig
-	headerInjection HeaderConfig
+	// Version of the schema. Zero is treated as PROTEAN_CONFIG_VERSION.
+	Version int `json:"version"`
+
+	Decompression DecompressionConfig `json:"decompression"`
+
+	Encryption EncryptionConfig `json:"encryption"`
+
+	Fragmentation FragmentationConfig `json:"fragmentation"`
+
+	Injection SequenceConfig `json:"injection"`
+
+	HeaderInjection HeaderConfig `json:"headerInjection"`
+
+	// Only used if the pipeline has an FEC stage.
+	FEC FECConfig `json:"fec"`
+
+	// Only used if the pipeline has a replay stage.
+	Replay ReplayConfig `json:"replay"`
+
+	// Only used if the pipeline has a handshake stage.
+	Handshake HandshakeConfig `json:"handshake"`
+
+	// The stages to apply. If empty, the default pipeline is used.
+	Pipeline PipelineConfig `json:"pipeline"`
+
+	// The longest packet to send, in bytes, such as the MTU of the path less
+	// the IP and UDP headers. Each fragmentation stage sizes its fragments
+	// for the smaller of this and its own maxLength, allowing for the
+	// overhead of the stages after it. Zero leaves the limit to the
+	// fragmentation stages.
+	MTU uint16 `json:"mtu,omitempty"`
+
+	// A built-in profile that configures the header injection, injection
+	// and fragmentation stages to mimic another protocol.
+	Profile ProfileConfig `json:"profile"`
 }
 
 // Creates a sample (non-random) config, suitable for testing.
 func sampleProteanConfig() ProteanConfig {
-	return ProteanConfig{decompression: sampleDecompressionConfig(), encryption: sampleEncryptionConfig(), fragmentation: sampleFragmentationConfig(), injection: sampleSequenceConfig(), headerInjection: sampleHeaderConfig()}
+	return ProteanConfig{Version: PROTEAN_CONFIG_VERSION, Decompression: sampleDecompressionConfig(), Encryption: sampleEncryptionConfig(), Fragmentation: sampleFragmentationConfig(), Injection: sampleSequenceConfig(), HeaderInjection: sampleHeaderConfig(), FEC: sampleFECConfig(), Replay: sampleReplayConfig(), Handshake: sampleHandshakeConfig()}
+}
+
+// Check the config, reporting every problem found.
+// The returned error is a ConfigErrors which lists the path to each offending
+// field, and wraps ErrMalformedConfig. Returns nil if the config is valid.
+//
+// Only the parts of the config used by the pipeline are checked, so, for
+// example, the decompression table need not be valid if the pipeline has no
+// decompression stage.
+func (config ProteanConfig) Validate() error {
+	var problems ConfigErrors
+
+	if config.Version < 0 || config.Version > PROTEAN_CONFIG_VERSION {
+		problems.add("version", "unsupported version %d, expected at most %d", config.Version, PROTEAN_CONFIG_VERSION)
+	}
+
+	config.Pipeline.validate("pipeline", config.Encryption, &problems)
+
+	pipeline := config.Pipeline
+	if len(pipeline.Stages) == 0 {
+		pipeline = defaultPipelineConfig()
+	}
+
+	// The profile's header must be the outermost, apart from injected
+	// packets, for the packets to parse as the protocol. The sections it
+	// replaces are checked as the profile gives them, unless the profile has
+	// problems of its own, as the sections need not be valid as given.
+	known := len(problems)
+	config.Profile.validate("profile", &problems)
+	profileValid := len(problems) == known
+	if config.Profile.Name != "" {
+		if !pipeline.headerOutermost() {
+			problems.add("profile.name", "requires the last stage apart from %s to be a %s stage without its own config", STAGE_INJECTION, STAGE_HEADER_INJECTION)
+		}
+
+		config = config.withProfile()
+	}
+
+	// Only fragmentation can keep packets within the MTU.
+	if config.MTU != 0 {
+		if !pipeline.has(STAGE_FRAGMENTATION) {
+			problems.add("mtu", "requires a %s stage in the pipeline", STAGE_FRAGMENTATION)
+		}
+
+		if int(config.MTU) < fragmentSize(1) {
+			problems.add("mtu", "%d is too small, must be at least %d", config.MTU, fragmentSize(1))
+		}
+	}
+
+	if pipeline.usesShared(STAGE_DECOMPRESSION) {
+		config.Decompression.validate("decompression", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_ENCRYPTION) {
+		config.Encryption.validate("encryption", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_FRAGMENTATION) && profileValid {
+		config.Fragmentation.validate("fragmentation", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_INJECTION) && profileValid {
+		config.Injection.validate("injection", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_HEADER_INJECTION) && profileValid {
+		config.HeaderInjection.validate("headerInjection", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_FEC) {
+		config.FEC.validate("fec", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_REPLAY) {
+		config.Replay.validate("replay", &problems)
+	}
+
+	if pipeline.usesShared(STAGE_HANDSHAKE) {
+		config.Handshake.validate("handshake", &problems)
+	}
+
+	return problems.err()
 }
 
-func flatMap(input [][]byte, mappedFunction func([]byte) [][]byte) [][]byte {
+// Applies mappedFunction to every item and concatenates the results.
+// Stops at the first error, which is returned along with no results.
+func flatMap(input [][]byte, mappedFunction func([]byte) ([][]byte, error)) ([][]byte, error) {
 	var accum [][]byte
 	for _, item := range input {
-		mapped := mappedFunction(item)
+		mapped, err := mappedFunction(item)
+		if err != nil {
+			return nil, err
+		}
+
 		if accum == nil {
 			accum = mapped
 		} else {
@@ -30,30 +154,45 @@ func flatMap(input [][]byte, mappedFunction func([]byte) [][]byte) [][]byte {
 		}
 	}
 
-	return accum
+	return accum, nil
 }
 
 // A packet shaper that composes multiple Transformers.
-// The following Transformers are composed:
+// The following Transformers are composed by default:
 // - Fragmentation based on MTU and chunk size
-// - AES encryption
+// - Encryption with AES CBC, AES GCM or ChaCha20-Poly1305
 // - decompression using arithmetic coding
+// - header injection
 // - byte sequence injection
+// The stages and their order can be changed with a PipelineConfig.
+//
+// If the pipeline has a handshake stage, packets are held until the handshake
+// has completed, and the handshake messages are sent with the function given
+// to SetOutput.
+//
+// Transform and Restore are safe for concurrent use, but Configure is not.
 type ProteanShaper struct {
-	// Fragmentation Transformer
-	fragmenter *FragmentationShaper
+	// The Transformers in the order they are applied by Transform.
+	stages []TransformerV2
 
-	// Encryption Transformer
-	encrypter *EncryptionShaper
+	// The handshake stage and its index in stages, if there is one.
+	handshake      *HandshakeShaper
+	handshakeIndex int
 
-	// Decompression Transformer
-	decompressor *DecompressionShaper
+	// Sends the packets the shaper sends of its own accord.
+	output atomic.Pointer[func(packets [][]byte)]
 
-	// Byte sequence injecter Transformer
-	injecter *ByteSequenceShaper
+	// Passed to the stages that keep time, nil for SystemClock.
+	clock Clock
 
-	// Byte sequence injecter Transformer
-	headerinjecter *HeaderShaper
+	// The shared secret given to SetKey, nil if there has been none.
+	secret []byte
+}
+
+// Returns the sample config that NewProteanShaper uses. Its keys are not
+// random, so it is only suitable for testing.
+func SampleProteanConfig() ProteanConfig {
+	return sampleProteanConfig()
 }
 
 func NewProteanShaper() *ProteanShaper {
@@ -64,85 +203,317 @@ func NewProteanShaper() *ProteanShaper {
 		return nil
 	}
 
-	shaper.Configure(string(jsonConfig))
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
 	return shaper
 }
 
-// This method is required to implement the Transformer API.
-// @param {[]byte} key Key to set, not used by this class.
-func (shaper *ProteanShaper) SetKey(key []byte) {
+// Give a shared secret to every stage, from which each derives its own keys.
+// The secret is kept, so it is also given to the stages made when the shaper
+// is reconfigured.
+//
+// With a handshake stage, the stages before it are keyed by the handshake
+// instead, so they are not given the secret, which would replace the session
+// keys. The handshake stage mixes the secret into the sessions it establishes.
+// @param {[]byte} key Shared secret to derive the keys from.
+func (shaper *ProteanShaper) SetKey(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty secret", ErrMalformedConfig)
+	}
+
+	start := 0
+	if shaper.handshake != nil {
+		start = shaper.handshakeIndex
+	}
+
+	for index := start; index < len(shaper.stages); index++ {
+		err := shaper.stages[index].SetKey(key)
+		if err != nil {
+			return fmt.Errorf("pipeline stage %d: %w", index, err)
+		}
+	}
+
+	shaper.secret = key
+	return nil
+}
+
+// Set the Clock used by the stages that keep time, such as fragmentation to
+// expire partial packets, encryption to rotate keys and header injection to
+// fill in timestamps.
+// This takes effect the next time the shaper is configured.
+func (shaper *ProteanShaper) SetClock(clock Clock) {
+	shaper.clock = clock
 }
 
 // Configure the Transformer with the headers to inject and the headers
 // to remove.
-func (this *ProteanShaper) Configure(jsonConfig string) {
+func (this *ProteanShaper) Configure(jsonConfig string) error {
 	var proteanConfig ProteanConfig
 	err := json.Unmarshal([]byte(jsonConfig), &proteanConfig)
 	if err != nil {
-		fmt.Println("Encryption shaper requires key parameter")
+		return fmt.Errorf("%w: %v", ErrMalformedConfig, err)
+	}
+
+	return this.ConfigureStruct(proteanConfig)
+}
+
+func (this *ProteanShaper) ConfigureStruct(proteanConfig ProteanConfig) error {
+	err := proteanConfig.Validate()
+	if err != nil {
+		return err
 	}
 
-	// Required parameters:
+	proteanConfig = proteanConfig.withProfile()
+
+	// Each stage is configured from the field of the same name:
 	// - decompression
 	// - encryption
 	// - fragmentation
 	// - injection
 	// - headerInjection
+	// - fec
+	// - replay
+	// - handshake
+	pipeline := proteanConfig.Pipeline
+	if len(pipeline.Stages) == 0 {
+		pipeline = defaultPipelineConfig()
+	}
+
+	// As in SetKey, the stages before a handshake stage are not given the
+	// secret.
+	keyed := 0
+	for index, stage := range pipeline.Stages {
+		if stage.Name == STAGE_HANDSHAKE {
+			keyed = index
+		}
+	}
 
-	this.decompressor = NewDecompressionShaper()
-	this.encrypter = NewEncryptionShaper()
-	this.injecter = NewByteSequenceShaper()
-	this.headerinjecter = NewHeaderShaper()
-	this.fragmenter = NewFragmentationShaper()
+	stages := make([]TransformerV2, len(pipeline.Stages))
+	for index, stage := range pipeline.Stages {
+		transformer, err := makeStage(stage, proteanConfig, this.clock)
+		if err != nil {
+			return fmt.Errorf("pipeline stage %d (%s): %w", index, stage.Name, err)
+		}
+
+		if this.secret != nil && index >= keyed {
+			err = transformer.SetKey(this.secret)
+			if err != nil {
+				return fmt.Errorf("pipeline stage %d (%s): %w", index, stage.Name, err)
+			}
+		}
+
+		stages[index] = transformer
+	}
+
+	// Each fragmentation stage sizes its fragments to allow for the stages
+	// after it.
+	for index, stage := range stages {
+		if fragmenter, ok := stage.(*FragmentationShaper); ok {
+			fragmenter.downstream = stages[index+1:]
+			fragmenter.mtu = proteanConfig.MTU
+			if _, err := fragmenter.payloadSize(); err != nil {
+				return fmt.Errorf("pipeline stage %d (%s): %w", index, pipeline.Stages[index].Name, err)
+			}
+		}
+	}
+
+	// Injected packets are not fragmented, so must fit in the MTU as they
+	// are.
+	if proteanConfig.MTU != 0 {
+		for index, stage := range stages {
+			injector, ok := stage.(*ByteSequenceShaper)
+			if !ok {
+				continue
+			}
+
+			for _, sequence := range injector.AddSequences {
+				length := int(sequence.Offset) + len(sequence.Sequence)
+				if int(sequence.Length) > length {
+					length = int(sequence.Length)
+				}
+
+				if wire := wireLength(stages[index+1:], length); wire > int(proteanConfig.MTU) {
+					return fmt.Errorf("pipeline stage %d (%s): %w: injected packet %d is %d bytes on the wire, more than the mtu %d", index, pipeline.Stages[index].Name, ErrMalformedConfig, sequence.Index, wire, proteanConfig.MTU)
+				}
+			}
+		}
+	}
+
+	// Stop the timers of the stages being replaced.
+	this.Dispose()
+
+	this.stages = stages
+	this.handshake = nil
+	for index, stage := range stages {
+		if handshake, ok := stage.(*HandshakeShaper); ok {
+			handshake.owner = this
+			this.handshake = handshake
+			this.handshakeIndex = index
+		}
+	}
+
+	return nil
+}
+
+// The maximum number of bytes the stages together add to a packet of the
+// given length, if it is not fragmented.
+func (this *ProteanShaper) Overhead(length int) int {
+	return wireLength(this.stages, length) - length
+}
+
+// Set the function used to send packets of the shaper's own accord, such as
+// handshake messages and their retransmissions.
+func (this *ProteanShaper) SetOutput(output func(packets [][]byte)) {
+	this.output.Store(&output)
+}
+
+// Give the session secret from the handshake to the stages before it.
+func (this *ProteanShaper) setSessionKey(secret []byte) error {
+	for index, stage := range this.stages[:this.handshakeIndex] {
+		err := stage.SetKey(secret)
+		if err != nil {
+			return fmt.Errorf("pipeline stage %d: %w", index, err)
+		}
+	}
+
+	return nil
+}
+
+// Send handshake messages through the stages after the handshake stage.
+func (this *ProteanShaper) sendHandshake(messages [][]byte) {
+	packets, err := transformStages(this.stages[this.handshakeIndex+1:], messages)
+	if err != nil {
+		return
+	}
+
+	this.emit(packets)
+}
+
+// Send the packets queued during the handshake through the whole pipeline.
+func (this *ProteanShaper) sendQueued(queued [][]byte) {
+	packets, err := transformStages(this.stages, queued)
+	if err != nil {
+		return
+	}
 
-	this.decompressor.ConfigureStruct(proteanConfig.decompression)
-	this.encrypter.ConfigureStruct(proteanConfig.encryption)
-	this.injecter.ConfigureStruct(proteanConfig.injection)
-	this.headerinjecter.ConfigureStruct(proteanConfig.headerInjection)
-	this.fragmenter.ConfigureStruct(proteanConfig.fragmentation)
+	this.emit(packets)
 }
 
-// Apply the following Transformations:
+// Send packets with the output function, if there is one.
+func (this *ProteanShaper) emit(packets [][]byte) {
+	if output := this.output.Load(); output != nil && len(packets) > 0 {
+		(*output)(packets)
+	}
+}
+
+// Apply each of the stages in order.
+func transformStages(stages []TransformerV2, buffers [][]byte) ([][]byte, error) {
+	results := buffers
+	for _, stage := range stages {
+		var err error
+		results, err = flatMap(results, stage.Transform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// Apply each stage of the pipeline in order.
+// With the default pipeline, these Transformations are:
 // - Fragment based on MTU and chunk size
 // - Encrypt using AES
 // - Decompress using arithmetic coding
 // - Inject headers into packets
 // - Inject packets with byte sequences
-func (this *ProteanShaper) Transform(buffer []byte) [][]byte {
-	// This Transform performs the following steps:
-	// - Generate a new random CHUNK_SIZE-byte IV for every packet
-	// - Encrypt the packet contents with the random IV and symmetric key
-	// - Concatenate the IV and encrypted packet contents
-	source := [][]byte{buffer}
-	fragmented := flatMap(source, this.fragmenter.Transform)
-	encrypted := flatMap(fragmented, this.encrypter.Transform)
-	decompressed := flatMap(encrypted, this.decompressor.Transform)
-	headerInjected := flatMap(decompressed, this.headerinjecter.Transform)
-	injected := flatMap(headerInjected, this.injecter.Transform)
-	return injected
-}
-
-// Apply the following Transformations:
+//
+// Until the handshake, if any, has completed, the packet is queued instead, and
+// the result is the handshake message if one is to be sent.
+func (this *ProteanShaper) Transform(buffer []byte) ([][]byte, error) {
+	if this.handshake != nil {
+		ready, messages, err := this.handshake.prepare(buffer)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ready {
+			return transformStages(this.stages[this.handshakeIndex+1:], messages)
+		}
+	}
+
+	return transformStages(this.stages, [][]byte{buffer})
+}
+
+// Apply each stage of the pipeline in reverse order.
+// With the default pipeline, these Transformations are:
 // - Discard injected packets
 // - Discard injected headers
-// - Decrypt with AES
 // - Compress with arithmetic coding
+// - Decrypt with AES
 // - Attempt defragmentation
-func (this *ProteanShaper) Restore(buffer []byte) [][]byte {
-	// This Restore performs the following steps:
-	// - Split the first CHUNK_SIZE bytes from the rest of the packet
-	//     The two parts are the IV and the encrypted packet contents
-	// - Decrypt the encrypted packet contents with the IV and symmetric key
-	// - Return the decrypted packet contents
-	source := [][]byte{buffer}
-	extracted := flatMap(source, this.injecter.Restore)
-	headerExtracted := flatMap(extracted, this.headerinjecter.Restore)
-	decompressed := flatMap(headerExtracted, this.decompressor.Restore)
-	decrypted := flatMap(decompressed, this.encrypter.Restore)
-	defragmented := flatMap(decrypted, this.fragmenter.Restore)
-	return defragmented
-}
-
-// No-op (we have no state or any resources to Dispose).
+func (this *ProteanShaper) Restore(buffer []byte) ([][]byte, error) {
+	return this.RestoreFrom("", buffer)
+}
+
+// Apply each stage of the pipeline in reverse order, as Restore does.
+// The source identifies the peer that sent the packet, and is passed on to the
+// stages that implement SourceRestorer.
+func (this *ProteanShaper) RestoreFrom(source string, buffer []byte) ([][]byte, error) {
+	results := [][]byte{buffer}
+	for index := len(this.stages) - 1; index >= 0; index-- {
+		restore := this.stages[index].Restore
+		if restorer, ok := this.stages[index].(SourceRestorer); ok {
+			restore = func(buffer []byte) ([][]byte, error) {
+				return restorer.RestoreFrom(source, buffer)
+			}
+		}
+
+		var err error
+		results, err = flatMap(results, restore)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// Counts of the packets dropped by the stages of a ProteanShaper.
+type ProteanStats struct {
+	// Summed over all of the fragmentation stages.
+	Defragmenter DefragmenterStats
+
+	// Summed over all of the FEC stages.
+	FEC FECStats
+
+	// Summed over all of the replay stages.
+	Replay ReplayStats
+}
+
+// Returns the counts of packets dropped so far.
+func (this *ProteanShaper) Stats() ProteanStats {
+	var stats ProteanStats
+	for _, stage := range this.stages {
+		switch shaper := stage.(type) {
+		case *FragmentationShaper:
+			stats.Defragmenter = stats.Defragmenter.add(shaper.Stats())
+		case *FECShaper:
+			stats.FEC = stats.FEC.add(shaper.Stats())
+		case *ReplayShaper:
+			stats.Replay = stats.Replay.add(shaper.Stats())
+		}
+	}
+
+	return stats
+}
+
+// Dispose of each stage of the pipeline.
 func (shaper *ProteanShaper) Dispose() {
+	for _, stage := range shaper.stages {
+		stage.Dispose()
+	}
 }
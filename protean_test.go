@@ -0,0 +1,229 @@
+package protean
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// The sample config survives a round trip through JSON, using the stable
+// field names.
+func TestProteanConfigRoundTrip(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Encryption.Mode = ENCRYPTION_MODE_AES_128_GCM
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_ENCRYPTION},
+		{Name: STAGE_HEADER_INJECTION, Config: json.RawMessage(`{"addHeader":{"header":"cafe"},"removeHeader":{"header":"cafe"}}`)},
+	}}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"version", "decompression", "encryption", "fragmentation", "injection", "headerInjection", "fec", "replay", "handshake", "pipeline", "profile"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("serialized config has no %q field: %s", name, data)
+		}
+	}
+
+	var decoded ProteanConfig
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, config) {
+		t.Errorf("decoded %+v, expected %+v", decoded, config)
+	}
+
+	err = (&ProteanShaper{}).Configure(string(data))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewProteanShaper(t *testing.T) {
+	if NewProteanShaper() == nil {
+		t.Error("could not configure the sample ProteanShaper")
+	}
+}
+
+// Every problem is reported, each with the path to the offending field.
+func TestProteanConfigValidate(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Decompression.Frequencies = nil
+	config.Encryption.Key = "00ff"
+	config.Fragmentation.MaxLength = 10
+	config.Injection.AddSequences[0].Sequence = "not hex"
+	config.Injection.RemoveSequences[0].Offset = 300
+	config.HeaderInjection.AddHeader.Header = "zz"
+
+	err := config.Validate()
+	if !errors.Is(err, ErrMalformedConfig) {
+		t.Fatalf("expected ErrMalformedConfig, got %v", err)
+	}
+
+	var problems ConfigErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected ConfigErrors, got %T", err)
+	}
+
+	paths := map[string]bool{}
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+
+	expected := []string{
+		"decompression.frequencies",
+		"encryption.key",
+		"fragmentation.maxLength",
+		"injection.addSequences[0].sequence",
+		"injection.removeSequences[0].offset",
+		"headerInjection.addHeader.header",
+	}
+	for _, path := range expected {
+		if !paths[path] {
+			t.Errorf("no problem reported for %s in %v", path, err)
+		}
+	}
+
+	if len(problems) != len(expected) {
+		t.Errorf("expected %d problems, got %v", len(expected), err)
+	}
+}
+
+// Problems in a stage's own config are reported under the stage, and the
+// shared config for stages not in the pipeline is not checked.
+func TestProteanConfigValidatePipeline(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Decompression.Frequencies = nil
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_ENCRYPTION, Config: json.RawMessage(`{"key":"00","mode":"rot13"}`)},
+		{Name: "compression"},
+	}}
+
+	var problems ConfigErrors
+	if !errors.As(config.Validate(), &problems) {
+		t.Fatal("expected ConfigErrors")
+	}
+
+	paths := map[string]bool{}
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+
+	for _, path := range []string{"pipeline.stages[0].config.mode", "pipeline.stages[1].name"} {
+		if !paths[path] {
+			t.Errorf("no problem reported for %s in %v", path, problems)
+		}
+	}
+
+	if paths["decompression.frequencies"] {
+		t.Error("unused decompression config was checked")
+	}
+}
+
+// An MTU needs a fragmentation stage to enforce it, and injected packets must
+// fit in it as they are not fragmented.
+func TestProteanConfigMTU(t *testing.T) {
+	config := sampleProteanConfig()
+	config.MTU = 100
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{{Name: STAGE_ENCRYPTION}}}
+
+	var problems ConfigErrors
+	if !errors.As(config.Validate(), &problems) || len(problems) != 1 || problems[0].Path != "mtu" {
+		t.Errorf("expected a problem with the mtu, got %v", problems)
+	}
+
+	// The sample injects a packet of 256 bytes.
+	config.Pipeline = PipelineConfig{}
+	err := (&ProteanShaper{}).ConfigureStruct(config)
+	if !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("expected ErrMalformedConfig for an injected packet over the mtu, got %v", err)
+	}
+
+	config.MTU = 1400
+	if err := (&ProteanShaper{}).ConfigureStruct(config); err != nil {
+		t.Error(err)
+	}
+}
+
+// Several goroutines send packets through one shaper while several others
+// restore them with another. Run with -race to check the stages' state.
+func TestProteanShaperConcurrentUse(t *testing.T) {
+	sender := newTestShaper(t)
+	receiver := newTestShaper(t)
+
+	const senders, packets = 4, 32
+	wire := make(chan []byte, 64)
+	restored := make(chan []byte, senders*packets)
+
+	var sending sync.WaitGroup
+	for index := 0; index < senders; index++ {
+		sending.Add(1)
+		go func(index int) {
+			defer sending.Done()
+			for packet := 0; packet < packets; packet++ {
+				// Large enough to be split into several fragments.
+				plain := bytes.Repeat([]byte{byte(index), byte(packet)}, 1000)
+				transformed, err := sender.Transform(plain)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for _, item := range transformed {
+					wire <- item
+				}
+			}
+		}(index)
+	}
+
+	var receiving sync.WaitGroup
+	for index := 0; index < senders; index++ {
+		receiving.Add(1)
+		go func() {
+			defer receiving.Done()
+			for item := range wire {
+				results, err := receiver.RestoreFrom("sender", item)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				for _, result := range results {
+					restored <- result
+				}
+			}
+		}()
+	}
+
+	sending.Wait()
+	close(wire)
+	receiving.Wait()
+	close(restored)
+
+	seen := make(map[[2]byte]bool)
+	for result := range restored {
+		if len(result) != 2000 || !bytes.Equal(result, bytes.Repeat(result[:2], 1000)) {
+			t.Fatalf("restored a corrupt packet of %d bytes", len(result))
+		}
+
+		seen[[2]byte{result[0], result[1]}] = true
+	}
+
+	if len(seen) != senders*packets {
+		t.Errorf("expected %d packets, restored %d", senders*packets, len(seen))
+	}
+}
@@ -0,0 +1,236 @@
+package protean
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// The size of the sequence number added to each packet.
+const REPLAY_SEQUENCE_SIZE = 8
+
+// The largest window accepted in ReplayConfig.
+const MAX_REPLAY_WINDOW = 4096
+
+// Accepted in serialised form by Configure().
+type ReplayConfig struct {
+	// The number of sequence numbers, counting back from the highest received,
+	// for which packets are still accepted. Packets that arrive out of order
+	// by more than this are dropped as too old.
+	WindowSize int `json:"windowSize"`
+}
+
+// Creates a sample (non-random) config, suitable for testing.
+func sampleReplayConfig() ReplayConfig {
+	return ReplayConfig{WindowSize: 64}
+}
+
+// Check the config, recording any problems under path.
+func (config ReplayConfig) validate(path string, problems *ConfigErrors) {
+	if config.WindowSize < 1 || config.WindowSize > MAX_REPLAY_WINDOW {
+		problems.add(fieldPath(path, "windowSize"), "%d is out of range, must be from 1 to %d", config.WindowSize, MAX_REPLAY_WINDOW)
+	}
+}
+
+// Counts of the packets dropped by a ReplayShaper, by reason.
+type ReplayStats struct {
+	// Packets dropped because a packet with the same sequence number had
+	// already been received.
+	ReplayedPackets uint64
+
+	// Packets dropped because their sequence number was too far behind the
+	// highest received to tell whether they had been seen before.
+	StalePackets uint64
+}
+
+// Sum two sets of counts.
+func (this ReplayStats) add(other ReplayStats) ReplayStats {
+	return ReplayStats{
+		ReplayedPackets: this.ReplayedPackets + other.ReplayedPackets,
+		StalePackets:    this.StalePackets + other.StalePackets,
+	}
+}
+
+// A Transformer that protects against replayed packets.
+// Transform prefixes each packet with a sequence number, and Restore drops
+// packets whose sequence number has already been seen, using a sliding window
+// as in IPsec and DTLS.
+//
+// The sequence number is only protected if changes to it are detected, so this
+// stage must be followed by an encryption stage with an authenticated mode
+// (GCM or ChaCha20-Poly1305) in the pipeline. Each ProteanShaper has
+// one sequence and one window, so a receiver with several peers should use a
+// SessionManager to give each its own.
+//
+// Transform and Restore are safe for concurrent use, but Configure is not.
+type ReplayShaper struct {
+	// The sequence number of the last packet sent.
+	sent atomic.Uint64
+
+	// Guards the window and stats.
+	lock sync.Mutex
+
+	windowSize uint64
+
+	// The highest sequence number received, zero if there has been none.
+	highest uint64
+
+	// A ring of bits, one for each sequence number in the window, set for
+	// those that have been received. The bit for a sequence number is at its
+	// remainder modulo the size of the ring.
+	window []uint64
+
+	stats ReplayStats
+}
+
+func NewReplayShaper() *ReplayShaper {
+	shaper := &ReplayShaper{}
+	config := sampleReplayConfig()
+	jsonConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil
+	}
+
+	err = shaper.Configure(string(jsonConfig))
+	if err != nil {
+		return nil
+	}
+
+	return shaper
+}
+
+// This method is required to implement the Transformer API.
+// @param {[]byte} key Key to set, not used by this class.
+func (shaper *ReplayShaper) SetKey(key []byte) error {
+	return nil
+}
+
+// Configure the Transformer with the size of the window.
+// This also resets the sequence number and the window.
+func (shaper *ReplayShaper) Configure(jsonConfig string) error {
+	var config ReplayConfig
+	err := json.Unmarshal([]byte(jsonConfig), &config)
+	if err != nil {
+		return fmt.Errorf("%w: replay shaper requires windowSize parameter: %v", ErrMalformedConfig, err)
+	}
+
+	return shaper.ConfigureStruct(config)
+}
+
+func (shaper *ReplayShaper) ConfigureStruct(config ReplayConfig) error {
+	var problems ConfigErrors
+	config.validate("", &problems)
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	shaper.sent.Store(0)
+	shaper.windowSize = uint64(config.WindowSize)
+	shaper.highest = 0
+	shaper.window = make([]uint64, (config.WindowSize+63)/64)
+	shaper.stats = ReplayStats{}
+	return nil
+}
+
+// Prefix the packet with the next sequence number.
+func (this *ReplayShaper) Transform(buffer []byte) ([][]byte, error) {
+	sequence := this.sent.Add(1)
+	if sequence == math.MaxUint64 {
+		return nil, fmt.Errorf("replay shaper has run out of sequence numbers")
+	}
+
+	result := make([]byte, REPLAY_SEQUENCE_SIZE+len(buffer))
+	binary.BigEndian.PutUint64(result, sequence)
+	copy(result[REPLAY_SEQUENCE_SIZE:], buffer)
+
+	return [][]byte{result}, nil
+}
+
+// Remove the sequence number, dropping the packet if it has been seen before
+// or is too old to tell.
+func (this *ReplayShaper) Restore(buffer []byte) ([][]byte, error) {
+	if len(buffer) < REPLAY_SEQUENCE_SIZE {
+		return nil, fmt.Errorf("%w: packet shorter than sequence number", ErrTruncatedPacket)
+	}
+
+	sequence := binary.BigEndian.Uint64(buffer)
+	if sequence == 0 {
+		return nil, fmt.Errorf("%w: sequence number is zero", ErrMalformedPacket)
+	}
+
+	if !this.accept(sequence) {
+		return [][]byte{}, nil
+	}
+
+	return [][]byte{buffer[REPLAY_SEQUENCE_SIZE:]}, nil
+}
+
+// Nothing to Dispose of.
+func (shaper *ReplayShaper) Dispose() {
+}
+
+// Returns the counts of dropped packets so far.
+func (this *ReplayShaper) Stats() ReplayStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.stats
+}
+
+// Each packet is prefixed with a sequence number.
+func (this *ReplayShaper) Overhead(length int) int {
+	return REPLAY_SEQUENCE_SIZE
+}
+
+// Record a sequence number in the window, returning false if the packet should
+// be dropped.
+func (this *ReplayShaper) accept(sequence uint64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ringSize := uint64(len(this.window)) * 64
+
+	if sequence > this.highest {
+		// Slide the window forward, clearing the bits of the sequence
+		// numbers skipped over, which have not been received.
+		if sequence-this.highest >= ringSize {
+			clear(this.window)
+		} else {
+			for skipped := this.highest + 1; skipped < sequence; skipped++ {
+				this.clearBit(skipped % ringSize)
+			}
+		}
+
+		this.highest = sequence
+		this.setBit(sequence % ringSize)
+		return true
+	}
+
+	if this.highest-sequence >= this.windowSize {
+		this.stats.StalePackets++
+		return false
+	}
+
+	if this.bit(sequence % ringSize) {
+		this.stats.ReplayedPackets++
+		return false
+	}
+
+	this.setBit(sequence % ringSize)
+	return true
+}
+
+func (this *ReplayShaper) bit(position uint64) bool {
+	return this.window[position/64]&(1<<(position%64)) != 0
+}
+
+func (this *ReplayShaper) setBit(position uint64) {
+	this.window[position/64] |= 1 << (position % 64)
+}
+
+func (this *ReplayShaper) clearBit(position uint64) {
+	this.window[position/64] &^= 1 << (position % 64)
+}
@@ -0,0 +1,115 @@
+package protean
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	shaper := &ReplayShaper{}
+	err := shaper.ConfigureStruct(ReplayConfig{WindowSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		sequence uint64
+		accepted bool
+	}{
+		{1, true},
+		{1, false},
+		{5, true},
+		{3, true},
+		{3, false},
+		{300, true},
+		{201, true},
+		{200, false},
+		{5, false},
+		{299, true},
+		{1000, true},
+		{300, false},
+	}
+
+	for _, test := range cases {
+		if accepted := shaper.accept(test.sequence); accepted != test.accepted {
+			t.Errorf("sequence %d: accepted %v, expected %v", test.sequence, accepted, test.accepted)
+		}
+	}
+
+	stats := shaper.Stats()
+	if stats.ReplayedPackets != 2 || stats.StalePackets != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// Packets replayed through an encrypted pipeline are dropped.
+func TestReplayPipeline(t *testing.T) {
+	config := sampleProteanConfig()
+	config.Encryption.Mode = ENCRYPTION_MODE_AES_128_GCM
+	config.Pipeline = PipelineConfig{Stages: []PipelineStage{
+		{Name: STAGE_FRAGMENTATION},
+		{Name: STAGE_REPLAY},
+		{Name: STAGE_ENCRYPTION},
+	}}
+
+	var sender, receiver ProteanShaper
+	for _, shaper := range []*ProteanShaper{&sender, &receiver} {
+		if err := shaper.ConfigureStruct(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, _ := sender.Transform([]byte("first"))
+	second, _ := sender.Transform([]byte("second"))
+
+	for _, packet := range [][]byte{second[0], first[0], second[0], first[0]} {
+		_, err := receiver.Restore(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, err := receiver.Restore(first[0])
+	if err != nil || len(restored) != 0 {
+		t.Errorf("replayed packet was restored as %q, %v", restored, err)
+	}
+
+	if stats := receiver.Stats().Replay; stats.ReplayedPackets != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	third, _ := sender.Transform([]byte("third"))
+	restored, err = receiver.Restore(third[0])
+	if err != nil || len(restored) != 1 || !bytes.Equal(restored[0], []byte("third")) {
+		t.Errorf("new packet was restored as %q, %v", restored, err)
+	}
+
+	// Changing the sequence number, which is in the first block, is caught.
+	fourth, _ := sender.Transform([]byte("fourth"))
+	fourth[0][9] ^= 0x40
+	if restored, err := receiver.Restore(fourth[0]); err == nil {
+		t.Errorf("changed packet was restored as %q", restored)
+	}
+
+	config.Pipeline.Stages = config.Pipeline.Stages[:2]
+	if err := config.Validate(); err == nil {
+		t.Error("expected a replay stage without encryption to be rejected")
+	}
+
+	// CBC does not detect changes to the sequence number.
+	config.Pipeline.Stages = append(config.Pipeline.Stages, PipelineStage{Name: STAGE_ENCRYPTION})
+	config.Encryption.Mode = ENCRYPTION_MODE_AES_CBC
+	var problems ConfigErrors
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != "pipeline.stages[1].name" {
+		t.Errorf("replay followed by CBC: got %v", err)
+	}
+
+	// Nor does it when the encryption stage has its own config.
+	config.Encryption.Mode = ENCRYPTION_MODE_CHACHA20_POLY1305
+	config.Pipeline.Stages[2].Config = json.RawMessage(`{"key":"00000000000000000000000000000000"}`)
+	if err := config.Validate(); !errors.As(err, &problems) || len(problems) != 1 || problems[0].Path != "pipeline.stages[1].name" {
+		t.Errorf("replay followed by a stage configured for CBC: got %v", err)
+	}
+}
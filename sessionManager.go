@@ -0,0 +1,349 @@
+package protean
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The number of sessions a SessionManager holds when no maximum is given.
+const DEFAULT_MAX_SESSIONS = 4096
+
+// Keeps an independent ProteanShaper for each peer.
+// A ProteanShaper has per-stream state, such as the byte sequence injection
+// index and the partially defragmented packets, so a server that shares one
+// shaper between many clients would mix their state. The SessionManager
+// creates a shaper for each session key (usually the remote address) the
+// first time it is seen, and expires sessions that have been idle for longer
+// than the idle timeout.
+//
+// As anyone can send from a new address, the number of sessions is limited.
+// When a new session would exceed the limit, the session least recently
+// returned by Get is disposed of to make room.
+type SessionManager struct {
+	// The configuration for every new session.
+	config ProteanConfig
+
+	// Sessions idle for longer than this are expired.
+	idleTimeout time.Duration
+
+	// The most sessions held at once.
+	maxSessions int
+
+	// Used to tell how long sessions have been idle, and given to the
+	// shaper of every new session.
+	clock Clock
+
+	// Guards sessions, order, lastSweep and secret.
+	lock sync.Mutex
+
+	sessions map[string]*Session
+
+	// The sessions, most recently returned by Get first.
+	order *list.List
+
+	// The last time idle sessions were expired.
+	lastSweep time.Time
+
+	// The shared secret given to SetKey, nil if there has been none.
+	secret []byte
+}
+
+// A single peer's ProteanShaper.
+// Session implements TransformerV2, and is safe for concurrent use.
+type Session struct {
+	// The key the Session is stored under in the SessionManager.
+	Key string
+
+	// The Session's place in the SessionManager's order.
+	element *list.Element
+
+	clock Clock
+
+	// Guards shaper, lastActive, attached and disposed.
+	lock sync.Mutex
+
+	shaper *ProteanShaper
+
+	// The last time the Session was returned by Get, or transformed or
+	// restored a packet.
+	lastActive time.Time
+
+	// The resource given to Attach, nil if there has been none.
+	attached io.Closer
+
+	disposed bool
+}
+
+// Create a SessionManager which creates sessions from config, holding at most
+// maxSessions at once. Zero selects DEFAULT_MAX_SESSIONS.
+// Returns ErrMalformedConfig if config cannot configure a ProteanShaper, or if
+// idleTimeout is not positive, as every session would be expired as soon as
+// it was used.
+func NewSessionManager(config ProteanConfig, idleTimeout time.Duration, maxSessions int) (*SessionManager, error) {
+	if idleTimeout <= 0 {
+		return nil, fmt.Errorf("%w: idle timeout of %v is not positive", ErrMalformedConfig, idleTimeout)
+	}
+
+	if maxSessions < 0 {
+		return nil, fmt.Errorf("%w: maximum of %d sessions is negative", ErrMalformedConfig, maxSessions)
+	}
+
+	if maxSessions == 0 {
+		maxSessions = DEFAULT_MAX_SESSIONS
+	}
+
+	// Check the config now so that errors are not deferred to the first peer.
+	probe := &ProteanShaper{}
+	err := probe.ConfigureStruct(config)
+	if err != nil {
+		return nil, err
+	}
+	probe.Dispose()
+
+	return &SessionManager{config: config, idleTimeout: idleTimeout, maxSessions: maxSessions, clock: SystemClock, sessions: make(map[string]*Session), order: list.New(), lastSweep: SystemClock.Now()}, nil
+}
+
+// Set the Clock used to expire idle sessions, which is also given to the
+// shaper of every new session.
+// This takes effect for the sessions created after it is set.
+func (this *SessionManager) SetClock(clock Clock) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if clock == nil {
+		clock = SystemClock
+	}
+
+	this.clock = clock
+	this.lastSweep = clock.Now()
+}
+
+// Give a shared secret to every session, from which each derives its own
+// keys, as with ProteanShaper.SetKey. The secret is kept and given to the
+// sessions created later as well.
+func (this *SessionManager) SetKey(key []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty secret", ErrMalformedConfig)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, session := range this.sessions {
+		if err := session.SetKey(key); err != nil {
+			return fmt.Errorf("session %q: %w", session.Key, err)
+		}
+	}
+
+	this.secret = append([]byte(nil), key...)
+	return nil
+}
+
+// Return the Session for key, creating it if it does not exist.
+// Idle sessions are expired from time to time as a side effect, and the
+// least recently used session is disposed of if a new one would exceed the
+// maximum.
+func (this *SessionManager) Get(key string) (*Session, error) {
+	return this.get(key, nil)
+}
+
+// Return the Session for key like Get, calling created with the Session if it
+// is new, before it is returned to any caller.
+func (this *SessionManager) get(key string, created func(session *Session)) (*Session, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.clock.Now()
+	if now.Sub(this.lastSweep) >= this.idleTimeout {
+		this.expire(now)
+	}
+
+	if session, ok := this.sessions[key]; ok {
+		this.order.MoveToFront(session.element)
+		session.touch(now)
+		return session, nil
+	}
+
+	shaper := &ProteanShaper{}
+	shaper.SetClock(this.clock)
+	err := shaper.ConfigureStruct(this.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.secret != nil {
+		if err := shaper.SetKey(this.secret); err != nil {
+			shaper.Dispose()
+			return nil, err
+		}
+	}
+
+	for len(this.sessions) >= this.maxSessions {
+		this.remove(this.order.Back().Value.(*Session))
+	}
+
+	session := &Session{Key: key, clock: this.clock, shaper: shaper, lastActive: now}
+	if created != nil {
+		created(session)
+	}
+
+	session.element = this.order.PushFront(session)
+	this.sessions[key] = session
+	return session, nil
+}
+
+// Remove the Session for key, if there is one.
+func (this *SessionManager) Remove(key string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if session, ok := this.sessions[key]; ok {
+		this.remove(session)
+	}
+}
+
+// Expire all sessions that have been idle for longer than the idle timeout.
+// Returns the number of sessions expired.
+func (this *SessionManager) Expire() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.expire(this.clock.Now())
+}
+
+// Returns the number of sessions.
+func (this *SessionManager) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.sessions)
+}
+
+// Remove and dispose of the idle sessions. The caller must hold the lock.
+func (this *SessionManager) expire(now time.Time) int {
+	this.lastSweep = now
+
+	var expired int
+	for _, session := range this.sessions {
+		if session.idleSince(now) >= this.idleTimeout {
+			this.remove(session)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// Remove and dispose of a session. The caller must hold the lock.
+func (this *SessionManager) remove(session *Session) {
+	delete(this.sessions, session.Key)
+	this.order.Remove(session.element)
+	session.Dispose()
+}
+
+// Dispose of all sessions.
+func (this *SessionManager) Dispose() {
+	this.lock.Lock()
+	sessions := this.sessions
+	this.sessions = make(map[string]*Session)
+	this.order.Init()
+	this.lock.Unlock()
+
+	for _, session := range sessions {
+		session.Dispose()
+	}
+}
+
+// Record that the Session was used at now.
+func (this *Session) touch(now time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lastActive = now
+}
+
+func (this *Session) idleSince(now time.Time) time.Duration {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return now.Sub(this.lastActive)
+}
+
+// This method is required to implement the Transformer API.
+func (this *Session) SetKey(key []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.shaper.SetKey(key)
+}
+
+// Reconfigure this Session's shaper.
+func (this *Session) Configure(jsonConfig string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.shaper.Configure(jsonConfig)
+}
+
+func (this *Session) Transform(buffer []byte) ([][]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lastActive = this.clock.Now()
+	return this.shaper.Transform(buffer)
+}
+
+func (this *Session) Restore(buffer []byte) ([][]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lastActive = this.clock.Now()
+	return this.shaper.Restore(buffer)
+}
+
+// Set the function used to send the packets the shaper sends of its own
+// accord, such as handshake messages.
+func (this *Session) SetOutput(output func(packets [][]byte)) {
+	this.shaper.SetOutput(output)
+}
+
+// Keep a resource for the Session's peer, such as a socket, which is closed
+// when the Session is disposed of, so that it lasts as long as the Session
+// does. If the Session has already been disposed of, the resource is closed
+// at once and net.ErrClosed is returned.
+func (this *Session) Attach(resource io.Closer) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.disposed {
+		resource.Close()
+		return fmt.Errorf("session %q: %w", this.Key, net.ErrClosed)
+	}
+
+	this.attached = resource
+	return nil
+}
+
+// Returns the resource given to Attach, or nil if there has been none.
+func (this *Session) Attached() io.Closer {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.attached
+}
+
+// Dispose of the shaper and close the resource given to Attach.
+func (this *Session) Dispose() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.disposed = true
+	this.shaper.Dispose()
+	if this.attached != nil {
+		this.attached.Close()
+	}
+}
@@ -0,0 +1,215 @@
+package protean
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// Each session injects its own byte sequence packet, as each has its own
+// injection index.
+func TestSessionManagerIndependentState(t *testing.T) {
+	sessions, err := NewSessionManager(testPipelineConfig(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"alice", "bob"} {
+		session, err := sessions.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		transformed, err := session.Transform([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(transformed) != 2 || !bytes.HasPrefix(transformed[0], []byte("OH HELLO")) {
+			t.Errorf("%s: expected an injected packet, got %x", key, transformed)
+		}
+	}
+
+	if sessions.Len() != 2 {
+		t.Errorf("expected 2 sessions, got %d", sessions.Len())
+	}
+}
+
+func TestSessionManagerExpire(t *testing.T) {
+	sessions, err := NewSessionManager(testPipelineConfig(), 20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewManualClock(time.Unix(1000, 0))
+	sessions.SetClock(clock)
+
+	idle, _ := sessions.Get("idle")
+	active, _ := sessions.Get("active")
+
+	clock.Advance(30 * time.Millisecond)
+	active.Transform([]byte("keepalive"))
+
+	if expired := sessions.Expire(); expired != 1 {
+		t.Errorf("expected 1 expired session, got %d", expired)
+	}
+
+	if again, _ := sessions.Get("idle"); again == idle {
+		t.Error("expected a new session after expiry")
+	}
+}
+
+// Once the maximum is reached, each new session replaces the least recently
+// used.
+func TestSessionManagerLimit(t *testing.T) {
+	sessions, err := NewSessionManager(testPipelineConfig(), time.Minute, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := sessions.Get("first")
+	second, _ := sessions.Get("second")
+	sessions.Get("third")
+
+	socket := &closeRecorder{}
+	if err := second.Attach(socket); err != nil {
+		t.Fatal(err)
+	}
+
+	// Using the first makes the second the least recently used.
+	if again, _ := sessions.Get("first"); again != first {
+		t.Fatal("expected the same session")
+	}
+
+	for index := 0; index < 100; index++ {
+		if _, err := sessions.Get(fmt.Sprintf("spoofed %d", index)); err != nil {
+			t.Fatal(err)
+		}
+
+		if sessions.Len() > 3 {
+			t.Fatalf("%d sessions, expected at most 3", sessions.Len())
+		}
+
+		if index == 0 {
+			if again, _ := sessions.Get("first"); again != first {
+				t.Error("the most recently used session was evicted")
+			}
+
+			// The evicted session's resources are released with it.
+			if !socket.closed {
+				t.Error("the evicted session's socket is open")
+			}
+
+			late := &closeRecorder{}
+			if err := second.Attach(late); !errors.Is(err, net.ErrClosed) || !late.closed {
+				t.Errorf("attached to an evicted session: got %v", err)
+			}
+		}
+	}
+
+	if _, err := NewSessionManager(testPipelineConfig(), time.Minute, -1); !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("negative maximum: got %v", err)
+	}
+
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		if _, err := NewSessionManager(testPipelineConfig(), timeout, 0); !errors.Is(err, ErrMalformedConfig) {
+			t.Errorf("idle timeout of %v: got %v", timeout, err)
+		}
+	}
+}
+
+// Records whether it has been closed.
+type closeRecorder struct {
+	closed bool
+}
+
+func (this *closeRecorder) Close() error {
+	this.closed = true
+	return nil
+}
+
+// Sessions created before and after SetKey use keys from the secret.
+func TestSessionManagerSetKey(t *testing.T) {
+	config := testPipelineConfig()
+	config.Encryption = EncryptionConfig{Mode: ENCRYPTION_MODE_AES_256_GCM, Role: ROLE_SERVER}
+	sessions, err := NewSessionManager(config, time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	early, _ := sessions.Get("early")
+	if err := sessions.SetKey(nil); !errors.Is(err, ErrMalformedConfig) {
+		t.Errorf("empty secret: got %v", err)
+	}
+
+	if err := sessions.SetKey([]byte("shared secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	late, _ := sessions.Get("late")
+
+	config.Encryption.Role = ROLE_CLIENT
+	client := &ProteanShaper{}
+	client.SetKey([]byte("shared secret"))
+	if err := client.ConfigureStruct(config); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, session := range map[string]*Session{"early": early, "late": late} {
+		transformed, err := client.Transform([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var restored [][]byte
+		for _, packet := range transformed {
+			packets, err := session.Restore(packet)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+
+			restored = append(restored, packets...)
+		}
+
+		if len(restored) != 1 || !bytes.Equal(restored[0], []byte("hello")) {
+			t.Errorf("%s: restored %q", name, restored)
+		}
+	}
+}
+
+// Two clients share one server socket, and each gets its own session.
+func TestWrapSessionPacketConn(t *testing.T) {
+	sessions, err := NewSessionManager(testPipelineConfig(), time.Minute, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn := listenLoopback(t)
+	server := WrapSessionPacketConn(serverConn, sessions)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for _, name := range []string{"alice", "bob"} {
+		client := WrapPacketConn(listenLoopback(t), newTestShaper(t))
+		_, err := client.WriteTo([]byte(name), serverConn.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buffer := make([]byte, MAX_DATAGRAM_SIZE)
+		n, _, err := server.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buffer[:n]) != name {
+			t.Errorf("read %q, expected %q", buffer[:n], name)
+		}
+	}
+
+	if sessions.Len() != 2 {
+		t.Errorf("expected 2 sessions, got %d", sessions.Len())
+	}
+}
@@ -0,0 +1,124 @@
+package protean
+
+import (
+	"container/list"
+	"time"
+)
+
+// The number of ticks in the reassembly timeout of a Defragmenter.
+// Partial packets expire up to 1/WHEEL_SLOTS of the timeout late.
+const WHEEL_SLOTS = 64
+
+// A hashed timer wheel that tracks when partial packets expire, so that a
+// Defragmenter needs only one Timer however many packets it holds.
+// Time is divided into ticks, and each packet is kept in the slot for the first
+// tick at or after its deadline. As every deadline is at most one timeout
+// ahead, the slots never need to hold packets for more than one rotation.
+type timerWheel struct {
+	// The length of a tick.
+	tick time.Duration
+
+	// The start of tick zero.
+	epoch time.Time
+
+	// The last tick whose slot has been expired.
+	processed int64
+
+	// Lists of the *PacketTracker due in each tick, indexed by the tick
+	// modulo the number of slots.
+	slots []*list.List
+}
+
+func newTimerWheel(timeout time.Duration, now time.Time) *timerWheel {
+	// Round up, so that a timeout spans at most WHEEL_SLOTS ticks.
+	tick := (timeout + WHEEL_SLOTS - 1) / WHEEL_SLOTS
+	if tick <= 0 {
+		tick = 1
+	}
+
+	// Allow a slot for the current tick and one for rounding the deadline up.
+	slots := make([]*list.List, WHEEL_SLOTS+2)
+	for index := range slots {
+		slots[index] = list.New()
+	}
+
+	return &timerWheel{tick: tick, epoch: now, slots: slots}
+}
+
+// The tick containing the given time.
+func (this *timerWheel) tickAt(now time.Time) int64 {
+	return int64(now.Sub(this.epoch) / this.tick)
+}
+
+// The slot for the given tick.
+func (this *timerWheel) slot(tick int64) *list.List {
+	return this.slots[tick%int64(len(this.slots))]
+}
+
+// Schedule tracked to expire at the deadline.
+// The wheel must have been advanced to the current time first.
+func (this *timerWheel) add(tracked *PacketTracker, deadline time.Time) {
+	// The first tick starting at or after the deadline, kept within one
+	// rotation in case the clock has gone backwards.
+	tick := this.tickAt(deadline.Add(this.tick - 1))
+	if tick <= this.processed {
+		tick = this.processed + 1
+	}
+
+	if last := this.processed + int64(len(this.slots)) - 1; tick > last {
+		tick = last
+	}
+
+	tracked.wheelSlot = this.slot(tick)
+	tracked.wheelElement = tracked.wheelSlot.PushBack(tracked)
+}
+
+// Stop tracking when a packet expires.
+func (this *timerWheel) remove(tracked *PacketTracker) {
+	if tracked.wheelSlot == nil {
+		return
+	}
+
+	tracked.wheelSlot.Remove(tracked.wheelElement)
+	tracked.wheelSlot = nil
+	tracked.wheelElement = nil
+}
+
+// Remove and return the packets that have expired by now.
+func (this *timerWheel) advance(now time.Time) []*PacketTracker {
+	target := this.tickAt(now)
+
+	// Visiting each slot once expires everything, however far the clock has
+	// moved.
+	if skipped := target - this.processed - int64(len(this.slots)); skipped > 0 {
+		this.processed = this.processed + skipped
+	}
+
+	var expired []*PacketTracker
+	for this.processed < target {
+		this.processed++
+
+		slot := this.slot(this.processed)
+		for element := slot.Front(); element != nil; element = element.Next() {
+			tracked := element.Value.(*PacketTracker)
+			tracked.wheelSlot = nil
+			tracked.wheelElement = nil
+			expired = append(expired, tracked)
+		}
+
+		slot.Init()
+	}
+
+	return expired
+}
+
+// The time at which the next packet will expire, or false if there are none.
+func (this *timerWheel) next() (time.Time, bool) {
+	for tick := this.processed + 1; tick < this.processed+int64(len(this.slots)); tick++ {
+		if this.slot(tick).Len() > 0 {
+			return this.epoch.Add(time.Duration(tick) * this.tick), true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -1,5 +1,7 @@
 package protean
 
+import "fmt"
+
 type Transformer interface {
 	/**
 	 * Sets the key for this Transformer session.
@@ -47,3 +49,235 @@ type Transformer interface {
 	 */
 	Dispose()
 }
+
+// The error-aware version of the Transformer interface.
+// All of the shapers in this package implement TransformerV2.
+// Use NewLegacyTransformer to pass a TransformerV2 to code that expects a
+// Transformer, and NewTransformerV2 to go the other way.
+type TransformerV2 interface {
+	/**
+	 * Sets the key for this Transformer session.
+	 *
+	 * @param {[]byte} key session key.
+	 * @return {error} nil if successful.
+	 */
+	SetKey(key []byte) error
+
+	/**
+	 * Configures this Transformer.
+	 *
+	 * @param {String} serialized Json string.
+	 * @return {error} wraps ErrMalformedConfig if the config is invalid.
+	 */
+	Configure(json string) error
+
+	/**
+	 * Transforms a piece of data to obfuscated form.
+	 *
+	 * @param {[]byte} plaintext data that needs to be obfuscated.
+	 * @return {[]byte[]} list of []bytes of obfuscated data.
+	 * @return {error} non-nil if the data could not be transformed.
+	 */
+	Transform(buffer []byte) ([][]byte, error)
+
+	/**
+	 * Restores data from obfuscated form to original form.
+	 *
+	 * @param {[]byte} ciphertext obfuscated data.
+	 * @return {[]byte[]} list of []bytes of original data.
+	 * @return {error} non-nil if the packet should be dropped. The sentinel
+	 * errors ErrAuthenticationFailed, ErrTruncatedPacket, ErrMalformedPacket
+	 * and ErrUnknownHeader describe the reason.
+	 */
+	Restore(buffer []byte) ([][]byte, error)
+
+	/**
+	 * Dispose the Transformer.
+	 *
+	 * This should be the last method called on a Transformer instance.
+	 */
+	Dispose()
+}
+
+// Implemented by Transformers that can make use of the address of the peer
+// that sent a packet, for instance to limit the resources used by each peer.
+// Restore is equivalent to RestoreFrom with an empty source.
+type SourceRestorer interface {
+	/**
+	 * Restores data from obfuscated form to original form.
+	 *
+	 * @param {string} source identifies the peer that sent the data.
+	 * @param {[]byte} ciphertext obfuscated data.
+	 * @return {[]byte[]} list of []bytes of original data.
+	 * @return {error} non-nil if the packet should be dropped.
+	 */
+	RestoreFrom(source string, buffer []byte) ([][]byte, error)
+}
+
+// Implemented by Transformers that send packets of their own accord, such as
+// the messages of a handshake and their retransmissions, in addition to those
+// returned by Transform.
+type PacketEmitter interface {
+	/**
+	 * Sets the function used to send the Transformer's own packets.
+	 *
+	 * @param {func([][]byte)} output sends wire packets to the peer.
+	 */
+	SetOutput(output func(packets [][]byte))
+}
+
+// Implemented by Transformers that can bound how much they expand a packet.
+// A FragmentationShaper uses this to size fragments so that they still fit in
+// its maximum length after the stages that follow it have been applied.
+// Transformers that do not implement it are taken to add nothing.
+type OverheadReporter interface {
+	/**
+	 * The maximum number of bytes added to a packet.
+	 *
+	 * @param {int} length of the packet given to Transform.
+	 * @return {int} the most that any packet Transform returns for it can
+	 * exceed length by.
+	 */
+	Overhead(length int) int
+}
+
+// Presents a TransformerV2 through the original Transformer interface.
+// As the original interface cannot report failure, errors are passed to the
+// handler given to NewLegacyTransformer and the affected packet is dropped.
+type legacyTransformer struct {
+	transformer TransformerV2
+
+	// Called with each error, wrapped with the name of the method that
+	// failed. Nil to drop errors.
+	handleError func(err error)
+}
+
+// Wrap transformer for code that expects a Transformer. Errors from each method
+// are wrapped with its name and passed to handleError, which may be nil to
+// ignore them. Test for the sentinel errors with errors.Is.
+func NewLegacyTransformer(transformer TransformerV2, handleError func(err error)) Transformer {
+	return &legacyTransformer{transformer: transformer, handleError: handleError}
+}
+
+// Pass an error from the named method to the handler, if there is one.
+func (this *legacyTransformer) report(method string, err error) {
+	if this.handleError != nil {
+		this.handleError(fmt.Errorf("%s: %w", method, err))
+	}
+}
+
+func (this *legacyTransformer) SetKey(key []byte) {
+	if err := this.transformer.SetKey(key); err != nil {
+		this.report("SetKey", err)
+	}
+}
+
+func (this *legacyTransformer) Configure(json string) {
+	if err := this.transformer.Configure(json); err != nil {
+		this.report("Configure", err)
+	}
+}
+
+func (this *legacyTransformer) Transform(buffer []byte) [][]byte {
+	results, err := this.transformer.Transform(buffer)
+	if err != nil {
+		this.report("Transform", err)
+		return nil
+	}
+
+	return results
+}
+
+func (this *legacyTransformer) Restore(buffer []byte) [][]byte {
+	results, err := this.transformer.Restore(buffer)
+	if err != nil {
+		this.report("Restore", err)
+		return nil
+	}
+
+	return results
+}
+
+func (this *legacyTransformer) Dispose() {
+	this.transformer.Dispose()
+}
+
+// Pass on the overhead of the wrapped Transformer, if it reports one.
+func (this *legacyTransformer) Overhead(length int) int {
+	return reportedOverhead(this.transformer, length)
+}
+
+// Presents an original Transformer through the TransformerV2 interface.
+// The wrapped Transformer never reports errors.
+type transformerV2 struct {
+	transformer Transformer
+}
+
+func NewTransformerV2(transformer Transformer) TransformerV2 {
+	return &transformerV2{transformer: transformer}
+}
+
+func (this *transformerV2) SetKey(key []byte) error {
+	this.transformer.SetKey(key)
+	return nil
+}
+
+func (this *transformerV2) Configure(json string) error {
+	this.transformer.Configure(json)
+	return nil
+}
+
+func (this *transformerV2) Transform(buffer []byte) ([][]byte, error) {
+	return this.transformer.Transform(buffer), nil
+}
+
+func (this *transformerV2) Restore(buffer []byte) ([][]byte, error) {
+	return this.transformer.Restore(buffer), nil
+}
+
+func (this *transformerV2) Dispose() {
+	this.transformer.Dispose()
+}
+
+// Pass on the overhead of the wrapped Transformer, if it reports one.
+func (this *transformerV2) Overhead(length int) int {
+	return reportedOverhead(this.transformer, length)
+}
+
+// The interfaces implemented by the shapers in this package.
+var (
+	_ TransformerV2 = (*ByteSequenceShaper)(nil)
+	_ TransformerV2 = (*DecompressionShaper)(nil)
+	_ TransformerV2 = (*EncryptionShaper)(nil)
+	_ TransformerV2 = (*FECShaper)(nil)
+	_ TransformerV2 = (*FragmentationShaper)(nil)
+	_ TransformerV2 = (*HandshakeShaper)(nil)
+	_ TransformerV2 = (*HeaderShaper)(nil)
+	_ TransformerV2 = (*ReplayShaper)(nil)
+	_ TransformerV2 = (*ProteanShaper)(nil)
+
+	_ SourceRestorer = (*FECShaper)(nil)
+	_ SourceRestorer = (*FragmentationShaper)(nil)
+	_ SourceRestorer = (*ProteanShaper)(nil)
+
+	_ PacketEmitter = (*ProteanShaper)(nil)
+
+	_ OverheadReporter = (*ByteSequenceShaper)(nil)
+	_ OverheadReporter = (*DecompressionShaper)(nil)
+	_ OverheadReporter = (*EncryptionShaper)(nil)
+	_ OverheadReporter = (*FECShaper)(nil)
+	_ OverheadReporter = (*FragmentationShaper)(nil)
+	_ OverheadReporter = (*HandshakeShaper)(nil)
+	_ OverheadReporter = (*HeaderShaper)(nil)
+	_ OverheadReporter = (*ReplayShaper)(nil)
+	_ OverheadReporter = (*ProteanShaper)(nil)
+)
+
+// The overhead of a Transformer that may be an OverheadReporter, otherwise 0.
+func reportedOverhead(transformer interface{}, length int) int {
+	if reporter, ok := transformer.(OverheadReporter); ok {
+		return reporter.Overhead(length)
+	}
+
+	return 0
+}
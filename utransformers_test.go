@@ -0,0 +1,120 @@
+package protean
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// A Transformer with the original interface that reverses each packet.
+type reversingTransformer struct {
+	key      []byte
+	disposed bool
+}
+
+func (this *reversingTransformer) SetKey(key []byte) {
+	this.key = key
+}
+
+func (this *reversingTransformer) Configure(json string) {
+}
+
+func (this *reversingTransformer) Transform(buffer []byte) [][]byte {
+	reversed := make([]byte, len(buffer))
+	for index, b := range buffer {
+		reversed[len(buffer)-1-index] = b
+	}
+
+	return [][]byte{reversed}
+}
+
+func (this *reversingTransformer) Restore(buffer []byte) [][]byte {
+	return this.Transform(buffer)
+}
+
+func (this *reversingTransformer) Dispose() {
+	this.disposed = true
+}
+
+// Errors from a TransformerV2 reach the handler and the packet is dropped.
+func TestLegacyTransformer(t *testing.T) {
+	var errs []error
+	shaper := &HeaderShaper{}
+	legacy := NewLegacyTransformer(shaper, func(err error) { errs = append(errs, err) })
+
+	legacy.Configure("{")
+	if len(errs) != 1 || !errors.Is(errs[0], ErrMalformedConfig) {
+		t.Fatalf("bad config: got %v", errs)
+	}
+
+	if err := shaper.ConfigureStruct(sampleHeaderConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	transformed := legacy.Transform([]byte("data"))
+	if len(transformed) != 1 || !bytes.Equal(transformed[0], []byte("\x41\x02data")) {
+		t.Fatalf("transformed %q", transformed)
+	}
+
+	restored := legacy.Restore(transformed[0])
+	if len(restored) != 1 || !bytes.Equal(restored[0], []byte("data")) {
+		t.Fatalf("restored %q", restored)
+	}
+
+	if restored := legacy.Restore([]byte("\x42\x02data")); restored != nil {
+		t.Errorf("unknown header restored as %q", restored)
+	}
+
+	if len(errs) != 2 || !errors.Is(errs[1], ErrUnknownHeader) || !strings.HasPrefix(errs[1].Error(), "Restore: ") {
+		t.Errorf("unknown header: got %v", errs)
+	}
+
+	if overhead := legacy.(OverheadReporter).Overhead(10); overhead != 2 {
+		t.Errorf("overhead %d, expected 2", overhead)
+	}
+
+	// Without a handler the errors are dropped.
+	if restored := NewLegacyTransformer(shaper, nil).Restore(nil); restored != nil {
+		t.Errorf("empty packet restored as %q", restored)
+	}
+}
+
+// A Transformer is passed through unchanged, and reports no errors.
+func TestTransformerV2(t *testing.T) {
+	legacy := &reversingTransformer{}
+	transformer := NewTransformerV2(legacy)
+
+	if err := transformer.SetKey([]byte("key")); err != nil || string(legacy.key) != "key" {
+		t.Errorf("key %q: %v", legacy.key, err)
+	}
+
+	if err := transformer.Configure("{}"); err != nil {
+		t.Error(err)
+	}
+
+	transformed, err := transformer.Transform([]byte("abc"))
+	if err != nil || len(transformed) != 1 || string(transformed[0]) != "cba" {
+		t.Fatalf("transformed %q: %v", transformed, err)
+	}
+
+	restored, err := transformer.Restore(transformed[0])
+	if err != nil || len(restored) != 1 || string(restored[0]) != "abc" {
+		t.Fatalf("restored %q: %v", restored, err)
+	}
+
+	if overhead := transformer.(OverheadReporter).Overhead(10); overhead != 0 {
+		t.Errorf("overhead %d, expected 0", overhead)
+	}
+
+	// Wrapping in both directions gives the same packets.
+	roundTrip := NewTransformerV2(NewLegacyTransformer(transformer, nil))
+	if again, err := roundTrip.Transform([]byte("abc")); err != nil || string(again[0]) != "cba" {
+		t.Errorf("transformed %q: %v", again, err)
+	}
+
+	transformer.Dispose()
+	if !legacy.disposed {
+		t.Error("not disposed")
+	}
+}